@@ -13,7 +13,7 @@ func main() {
 	if err := cmd.RootCmd.Execute(); err != nil {
 		if err != cmd.ErrUsage {
 			log.Errorf("Error: %s ", err.Error())
-			os.Exit(1)
+			os.Exit(cmd.ExitStatus(err))
 		}
 	}
 }
@@ -5,5 +5,6 @@ import "github.com/labstack/echo/v4"
 func Route() {
 	e := echo.New()
 
+	e.GET("/services", listServices)
 	e.GET("/:service/manifest", getmainfest)
 }
@@ -0,0 +1,45 @@
+package apigateway
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"keyayun.com/seal-kafka-runner/pkg/client"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/registry"
+	"keyayun.com/seal-kafka-runner/pkg/services"
+)
+
+func manifest(s services.Service) *client.ServiceManifest {
+	return &client.ServiceManifest{
+		Name:       s.Name(),
+		Version:    s.Version(),
+		Categories: s.Categories(),
+		Scope:      s.Scope(),
+		Params:     s.Params()[s.Version()],
+		DocTypes:   s.DocTypes(),
+	}
+}
+
+// listServices returns the manifests of every registered service version
+func listServices(c echo.Context) error {
+	list := registry.List()
+	manifests := make([]*client.ServiceManifest, 0, len(list))
+	for _, s := range list {
+		manifests = append(manifests, manifest(s))
+	}
+	return c.JSON(http.StatusOK, manifests)
+}
+
+// getmainfest returns the manifest of a service, the latest version is used
+// unless the version query parameter is given
+func getmainfest(c echo.Context) error {
+	s, err := registry.Lookup(c.Param("service"), c.QueryParam("version"))
+	if errors.IsNotFound(err) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, manifest(s))
+}
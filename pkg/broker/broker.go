@@ -0,0 +1,152 @@
+// Package broker defines the messages, consumers and producers the runner
+// works with, whatever the client library talking to the brokers. The
+// kafka package provides the sarama adapter and the memory package an
+// in-memory one.
+package broker
+
+import (
+	"context"
+	"time"
+)
+
+// Header is a header of a message
+type Header struct {
+	Key   []byte
+	Value []byte
+}
+
+// Message is a record of a topic. The partition, offset and timestamp of a
+// consumed message are set by the broker, those of a sent message once it is
+// acknowledged.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	// Key is nil for the messages without key
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Timestamp time.Time
+}
+
+// Header returns the value of the message header, or "" when it is missing
+func (m *Message) Header(key string) string {
+	for _, h := range m.Headers {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Cluster is a connection to the brokers, it creates the consumers and the
+// producers
+type Cluster interface {
+	// Topics returns the topics of the cluster, from refreshed metadata
+	Topics() ([]string, error)
+	// ReadTopic hands the committed messages present in the topic when it is
+	// called to fn, partition by partition, the records of the aborted
+	// transactions are skipped
+	ReadTopic(topic string, fn func(*Message) error) error
+	NewConsumer(group string, opts ConsumerOptions) (Consumer, error)
+	NewProducer() (Producer, error)
+	// NewTxnProducer returns a producer sending within transactions, a
+	// producer created with the same transactional id fences this one off
+	NewTxnProducer(transactionalId string) (TxnProducer, error)
+	NewAsyncProducer(opts BatchOptions) (AsyncProducer, error)
+	Close() error
+}
+
+// ConsumerOptions configures a consumer
+type ConsumerOptions struct {
+	// AutoCommit commits the marked offsets in the background, they are
+	// only committed by Session.Commit otherwise
+	AutoCommit bool
+	// ReadCommitted skips the messages of the aborted transactions
+	ReadCommitted bool
+}
+
+// BatchOptions configures the batching of an AsyncProducer
+type BatchOptions struct {
+	// Size and Bytes send a batch once it has that many messages or bytes
+	Size  int
+	Bytes int
+	// Linger is the longest time a message waits for its batch to fill up
+	Linger time.Duration
+	// Compression is one of none, gzip, snappy, lz4 or zstd
+	Compression string
+}
+
+// Consumer consumes topics as a member of a consumer group, the partitions
+// of the topics are shared among the members
+type Consumer interface {
+	// Consume joins the group and runs a session claiming the partitions
+	// assigned to the member, it blocks until the session ends: ctx is done,
+	// the group rebalances or a claim fails. The error of a failed claim is
+	// returned.
+	Consume(ctx context.Context, topics []string, handler Handler) error
+	// Close leaves the group
+	Close() error
+}
+
+// Handler handles the sessions of a Consumer
+type Handler interface {
+	// Setup is run at the beginning of a session, before ConsumeClaim
+	Setup(Session) error
+	// Cleanup is run at the end of a session, once every ConsumeClaim returned
+	Cleanup(Session) error
+	// ConsumeClaim consumes the messages of a claimed partition until its
+	// channel is closed, it runs in its own goroutine. The session ends as
+	// soon as a claim returns.
+	ConsumeClaim(Session, Claim) error
+}
+
+// Session is a generation of the group, between two rebalances
+type Session interface {
+	// Context is done once the session ends
+	Context() context.Context
+	// MarkOffset marks offset as the next offset to consume of the
+	// partition, the marks only move forward
+	MarkOffset(topic string, partition int32, offset int64)
+	// Commit commits the marked offsets
+	Commit()
+}
+
+// Claim is a partition claimed by the member for a session
+type Claim interface {
+	Topic() string
+	Partition() int32
+	// Messages is closed when the session ends
+	Messages() <-chan *Message
+}
+
+// Producer sends messages and waits for their acknowledgement
+type Producer interface {
+	// Send sends the messages, their partition and offset are set once they
+	// are acknowledged
+	Send(msgs ...*Message) error
+	Close() error
+}
+
+// TxnProducer is a Producer sending within transactions
+type TxnProducer interface {
+	Producer
+	// BeginTxn starts a transaction, the messages sent until CommitTxn or
+	// AbortTxn belong to it
+	BeginTxn() error
+	// CommitTxn atomically commits the messages and offsets of the transaction
+	CommitTxn() error
+	// AbortTxn drops the messages and offsets of the transaction
+	AbortTxn() error
+	// AddMessageToTxn commits the offset of the consumed message along with
+	// the transaction
+	AddMessageToTxn(m *Message, group string) error
+}
+
+// AsyncProducer sends messages in batches without waiting for them
+type AsyncProducer interface {
+	// Send queues the message, done is called once it is delivered or failed
+	Send(m *Message, done func(*Message, error))
+	// Close sends the queued messages then closes the producer
+	Close() error
+}
@@ -0,0 +1,638 @@
+// Package memory is an in-memory broker.Cluster, for the tests and the local
+// development without kafka. The topics are created with a default number of
+// partitions when first used, the consumer groups share the partitions among
+// their members and rebalance when a member joins or leaves.
+package memory
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// Cluster is the in-memory broker.Cluster
+type Cluster struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	partitions int32
+	topics     map[string]*topic
+	groups     map[string]*group
+	nextMember int
+}
+
+type topic struct {
+	partitions []*partition
+	next       uint32
+}
+
+type partition struct {
+	messages []*broker.Message
+	// appended is closed and replaced when messages are appended
+	appended chan struct{}
+}
+
+type group struct {
+	offsets map[string]map[int32]int64
+	members map[*consumer][]string
+	// generation is bumped and changed closed when the members change
+	generation int
+	changed    chan struct{}
+	// sessions are the running sessions and their generation
+	sessions map[*session]int
+}
+
+// NewCluster returns an empty cluster, its topics are created with the given
+// number of partitions
+func NewCluster(partitions int32) *Cluster {
+	if partitions <= 0 {
+		partitions = 1
+	}
+	c := &Cluster{
+		partitions: partitions,
+		topics:     make(map[string]*topic),
+		groups:     make(map[string]*group),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// CreateTopic creates the topic with its number of partitions, an existing
+// topic is left as is
+func (c *Cluster) CreateTopic(name string, partitions int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.createTopic(name, partitions)
+}
+
+// createTopic is CreateTopic with c.mu held
+func (c *Cluster) createTopic(name string, partitions int32) *topic {
+	if t, ok := c.topics[name]; ok {
+		return t
+	}
+	if partitions <= 0 {
+		partitions = c.partitions
+	}
+	t := &topic{partitions: make([]*partition, partitions)}
+	for i := range t.partitions {
+		t.partitions[i] = &partition{appended: make(chan struct{})}
+	}
+	c.topics[name] = t
+	return t
+}
+
+// topic returns the topic, created when missing, c.mu is held
+func (c *Cluster) topic(name string) *topic {
+	return c.createTopic(name, c.partitions)
+}
+
+// group returns the consumer group, created when missing, c.mu is held
+func (c *Cluster) group(name string) *group {
+	g, ok := c.groups[name]
+	if !ok {
+		g = &group{
+			offsets:  make(map[string]map[int32]int64),
+			members:  make(map[*consumer][]string),
+			changed:  make(chan struct{}),
+			sessions: make(map[*session]int),
+		}
+		c.groups[name] = g
+	}
+	return g
+}
+
+// Messages returns the messages of the topic, partition by partition
+func (c *Cluster) Messages(topic string) []*broker.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var messages []*broker.Message
+	if t, ok := c.topics[topic]; ok {
+		for _, p := range t.partitions {
+			for _, m := range p.messages {
+				messages = append(messages, copyMessage(m))
+			}
+		}
+	}
+	return messages
+}
+
+// Committed returns the offset committed by the group for the partition, -1
+// when there is none
+func (c *Cluster) Committed(group, topic string, partition int32) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if g, ok := c.groups[group]; ok {
+		if offset, ok := g.offsets[topic][partition]; ok {
+			return offset
+		}
+	}
+	return -1
+}
+
+func (c *Cluster) Topics() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for name := range c.topics {
+		topics = append(topics, name)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+func (c *Cluster) ReadTopic(topic string, fn func(*broker.Message) error) error {
+	for _, m := range c.Messages(topic) {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) NewConsumer(group string, opts broker.ConsumerOptions) (broker.Consumer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextMember++
+	return &consumer{
+		cluster: c,
+		group:   c.group(group),
+		opts:    opts,
+		id:      c.nextMember,
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+func (c *Cluster) NewProducer() (broker.Producer, error) {
+	return &producer{cluster: c}, nil
+}
+
+// NewTxnProducer returns a transactional producer, the fencing of the
+// producers sharing a transactional id is not implemented
+func (c *Cluster) NewTxnProducer(transactionalId string) (broker.TxnProducer, error) {
+	return &producer{cluster: c}, nil
+}
+
+// NewAsyncProducer returns a producer sending the messages in order from a
+// goroutine, the batch options are ignored
+func (c *Cluster) NewAsyncProducer(opts broker.BatchOptions) (broker.AsyncProducer, error) {
+	p := &asyncProducer{
+		cluster: c,
+		queue:   make(chan asyncMessage, 64),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (c *Cluster) Close() error {
+	return nil
+}
+
+// append appends the messages to their partition, chosen by the hash of their
+// key or round-robin, and sets their partition, offset and timestamp. c.mu is
+// held.
+func (c *Cluster) append(msgs []*broker.Message) {
+	now := time.Now()
+	for _, m := range msgs {
+		t := c.topic(m.Topic)
+		var index uint32
+		if m.Key == nil {
+			index = t.next % uint32(len(t.partitions))
+			t.next++
+		} else {
+			h := fnv.New32a()
+			h.Write(m.Key)
+			index = h.Sum32() % uint32(len(t.partitions))
+		}
+		p := t.partitions[index]
+		m.Partition, m.Offset = int32(index), int64(len(p.messages))
+		if m.Timestamp.IsZero() {
+			m.Timestamp = now
+		}
+		p.messages = append(p.messages, copyMessage(m))
+		close(p.appended)
+		p.appended = make(chan struct{})
+	}
+}
+
+func copyMessage(m *broker.Message) *broker.Message {
+	msg := *m
+	return &msg
+}
+
+// consumer is a member of a group
+type consumer struct {
+	cluster *Cluster
+	group   *group
+	opts    broker.ConsumerOptions
+	id      int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// join makes the consumer a member subscribed to the topics, the group
+// rebalances unless it already was. c.mu is held.
+func (c *consumer) join(topics []string) {
+	g := c.group
+	subscribed, ok := g.members[c]
+	if ok && sameTopics(subscribed, topics) {
+		return
+	}
+	g.members[c] = append([]string(nil), topics...)
+	g.rebalance()
+}
+
+func (g *group) rebalance() {
+	g.generation++
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// claims returns the partitions assigned to the member: the partitions of a
+// topic are dealt to the members subscribed to it in turn. c.mu is held.
+func (c *consumer) claims() map[string][]int32 {
+	g := c.group
+	members := make([]*consumer, 0, len(g.members))
+	for m := range g.members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].id < members[j].id })
+	claims := make(map[string][]int32)
+	for _, name := range g.members[c] {
+		var subscribers []*consumer
+		for _, m := range members {
+			for _, t := range g.members[m] {
+				if t == name {
+					subscribers = append(subscribers, m)
+				}
+			}
+		}
+		t := c.cluster.topic(name)
+		for p := range t.partitions {
+			if subscribers[p%len(subscribers)] == c {
+				claims[name] = append(claims[name], int32(p))
+			}
+		}
+	}
+	return claims
+}
+
+func (c *consumer) Consume(ctx context.Context, topics []string, handler broker.Handler) error {
+	cluster, g := c.cluster, c.group
+	cluster.mu.Lock()
+	select {
+	case <-c.closed:
+		cluster.mu.Unlock()
+		return errors.Closed("consumer")
+	default:
+	}
+	c.join(topics)
+	// the partitions are claimed once the sessions of the previous
+	// generations released them
+	for g.runningBefore(g.generation) {
+		cluster.cond.Wait()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sess := &session{
+		ctx:      ctx,
+		consumer: c,
+		marked:   make(map[string]map[int32]int64),
+	}
+	g.sessions[sess] = g.generation
+	changed := g.changed
+	claims := c.claims()
+	cluster.mu.Unlock()
+
+	defer func() {
+		cluster.mu.Lock()
+		delete(g.sessions, sess)
+		cluster.cond.Broadcast()
+		cluster.mu.Unlock()
+	}()
+	go func() {
+		select {
+		case <-changed:
+		case <-c.closed:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	if err := handler.Setup(sess); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var claimErr error
+	for name, partitions := range claims {
+		for _, p := range partitions {
+			claim := &claim{topic: name, partition: p, messages: make(chan *broker.Message)}
+			go c.feed(ctx, claim, c.offset(name, p))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// the session ends as soon as a claim returns
+				defer cancel()
+				if err := handler.ConsumeClaim(sess, claim); err != nil {
+					mu.Lock()
+					if claimErr == nil {
+						claimErr = err
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	if len(claims) == 0 {
+		<-ctx.Done()
+	}
+	wg.Wait()
+	err := handler.Cleanup(sess)
+	if claimErr != nil {
+		return claimErr
+	}
+	return err
+}
+
+// runningBefore tells if sessions of older generations are running, c.mu is held
+func (g *group) runningBefore(generation int) bool {
+	for _, gen := range g.sessions {
+		if gen < generation {
+			return true
+		}
+	}
+	return false
+}
+
+// offset returns the offset the partition is consumed from: the committed
+// one, or the oldest
+func (c *consumer) offset(topic string, partition int32) int64 {
+	c.cluster.mu.Lock()
+	defer c.cluster.mu.Unlock()
+	if offset, ok := c.group.offsets[topic][partition]; ok {
+		return offset
+	}
+	return 0
+}
+
+// feed sends the messages of the partition to the claim from offset, until
+// ctx is done
+func (c *consumer) feed(ctx context.Context, cl *claim, offset int64) {
+	defer close(cl.messages)
+	for {
+		c.cluster.mu.Lock()
+		p := c.cluster.topic(cl.topic).partitions[cl.partition]
+		if offset < int64(len(p.messages)) {
+			m := copyMessage(p.messages[offset])
+			c.cluster.mu.Unlock()
+			select {
+			case cl.messages <- m:
+				offset++
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		appended := p.appended
+		c.cluster.mu.Unlock()
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close leaves the group, the other members rebalance
+func (c *consumer) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.cluster.mu.Lock()
+		if _, ok := c.group.members[c]; ok {
+			delete(c.group.members, c)
+			c.group.rebalance()
+		}
+		c.cluster.mu.Unlock()
+	})
+	return nil
+}
+
+type session struct {
+	ctx      context.Context
+	consumer *consumer
+
+	mu     sync.Mutex
+	marked map[string]map[int32]int64
+}
+
+func (s *session) Context() context.Context {
+	return s.ctx
+}
+
+func (s *session) MarkOffset(topic string, partition int32, offset int64) {
+	s.mu.Lock()
+	partitions, ok := s.marked[topic]
+	if !ok {
+		partitions = make(map[int32]int64)
+		s.marked[topic] = partitions
+	}
+	if offset > partitions[partition] {
+		partitions[partition] = offset
+	}
+	s.mu.Unlock()
+	if s.consumer.opts.AutoCommit {
+		s.Commit()
+	}
+}
+
+func (s *session) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cluster, g := s.consumer.cluster, s.consumer.group
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	for topic, partitions := range s.marked {
+		commitOffsets(g, topic, partitions)
+	}
+}
+
+// commitOffsets moves the committed offsets of the group forward, c.mu is held
+func commitOffsets(g *group, topic string, partitions map[int32]int64) {
+	committed, ok := g.offsets[topic]
+	if !ok {
+		committed = make(map[int32]int64)
+		g.offsets[topic] = committed
+	}
+	for p, offset := range partitions {
+		if current, ok := committed[p]; !ok || offset > current {
+			committed[p] = offset
+		}
+	}
+}
+
+type claim struct {
+	topic     string
+	partition int32
+	messages  chan *broker.Message
+}
+
+func (c *claim) Topic() string {
+	return c.topic
+}
+
+func (c *claim) Partition() int32 {
+	return c.partition
+}
+
+func (c *claim) Messages() <-chan *broker.Message {
+	return c.messages
+}
+
+// producer is the in-memory broker.TxnProducer, the messages of a transaction
+// are appended when it commits so that they are never read uncommitted
+type producer struct {
+	cluster *Cluster
+
+	mu      sync.Mutex
+	closed  bool
+	txn     bool
+	pending []*broker.Message
+	offsets map[string]map[string]map[int32]int64
+}
+
+func (p *producer) Send(msgs ...*broker.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.Closed("producer")
+	}
+	if p.txn {
+		p.pending = append(p.pending, msgs...)
+		return nil
+	}
+	p.cluster.mu.Lock()
+	p.cluster.append(msgs)
+	p.cluster.mu.Unlock()
+	return nil
+}
+
+func (p *producer) BeginTxn() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.txn {
+		return errors.Conflict("transaction already begun")
+	}
+	p.txn = true
+	p.pending = nil
+	p.offsets = make(map[string]map[string]map[int32]int64)
+	return nil
+}
+
+func (p *producer) CommitTxn() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.txn {
+		return errors.Conflict("no transaction")
+	}
+	p.cluster.mu.Lock()
+	p.cluster.append(p.pending)
+	for group, topics := range p.offsets {
+		for topic, partitions := range topics {
+			commitOffsets(p.cluster.group(group), topic, partitions)
+		}
+	}
+	p.cluster.mu.Unlock()
+	p.txn, p.pending, p.offsets = false, nil, nil
+	return nil
+}
+
+func (p *producer) AbortTxn() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.txn {
+		return errors.Conflict("no transaction")
+	}
+	p.txn, p.pending, p.offsets = false, nil, nil
+	return nil
+}
+
+func (p *producer) AddMessageToTxn(m *broker.Message, group string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.txn {
+		return errors.Conflict("no transaction")
+	}
+	topics, ok := p.offsets[group]
+	if !ok {
+		topics = make(map[string]map[int32]int64)
+		p.offsets[group] = topics
+	}
+	partitions, ok := topics[m.Topic]
+	if !ok {
+		partitions = make(map[int32]int64)
+		topics[m.Topic] = partitions
+	}
+	partitions[m.Partition] = m.Offset + 1
+	return nil
+}
+
+func (p *producer) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return nil
+}
+
+// asyncProducer appends the queued messages from its goroutine
+type asyncProducer struct {
+	cluster *Cluster
+	queue   chan asyncMessage
+	done    chan struct{}
+}
+
+type asyncMessage struct {
+	message *broker.Message
+	done    func(*broker.Message, error)
+}
+
+func (p *asyncProducer) Send(m *broker.Message, done func(*broker.Message, error)) {
+	p.queue <- asyncMessage{m, done}
+}
+
+func (p *asyncProducer) run() {
+	defer close(p.done)
+	for m := range p.queue {
+		p.cluster.mu.Lock()
+		p.cluster.append([]*broker.Message{m.message})
+		p.cluster.mu.Unlock()
+		m.done(m.message, nil)
+	}
+}
+
+func (p *asyncProducer) Close() error {
+	close(p.queue)
+	<-p.done
+	return nil
+}
+
+func sameTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -5,12 +5,29 @@ import (
 
 	"github.com/spf13/cobra"
 	"keyayun.com/seal-kafka-runner/pkg/config"
+	"keyayun.com/seal-kafka-runner/pkg/kafka"
 	"keyayun.com/seal-kafka-runner/pkg/logger"
 )
 
 // ErrUsage is returned by the cmd.Usage() method
 var ErrUsage = errors.New("Bad usage of command")
 
+// Exit statuses of the runner, a clean shutdown exits with 0
+const (
+	ExitFailure = 1
+	// ExitDrainTimeout tells that jobs were still running at the shutdown
+	// drain timeout, their messages are consumed again on restart
+	ExitDrainTimeout = 3
+)
+
+// ExitStatus returns the exit status of the error of a command
+func ExitStatus(err error) int {
+	if errors.Is(err, kafka.ErrDrainTimeout) {
+		return ExitDrainTimeout
+	}
+	return ExitFailure
+}
+
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "runner-server",
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"keyayun.com/seal-kafka-runner/pkg/kafka/registrytest"
+	"keyayun.com/seal-kafka-runner/pkg/logger"
+)
+
+var devFlags struct {
+	addr string
+}
+
+var devCmd = &cobra.Command{
+	Use:   "dev",
+	Short: "tools of the local development",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var devRegistryCmd = &cobra.Command{
+	Use:   "registry",
+	Short: "serve an in-memory schema registry, its schemas are lost on exit",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger.WithNamespace("dev").Infof("schema registry listening on %s", devFlags.addr)
+		return http.ListenAndServe(devFlags.addr, registrytest.New())
+	},
+}
+
+func init() {
+	devRegistryCmd.Flags().StringVar(&devFlags.addr, "addr", "127.0.0.1:8081", "address the registry listens on")
+	devCmd.AddCommand(devRegistryCmd)
+	RootCmd.AddCommand(devCmd)
+}
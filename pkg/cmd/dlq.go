@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/config"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/kafka"
+)
+
+var dlqFlags struct {
+	topic  string
+	dlq    string
+	since  string
+	until  string
+	err    string
+	key    string
+	dryRun bool
+}
+
+var dlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "inspect and replay the dead-lettered messages",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var dlqListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the dead-lettered messages matching the filters",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return dlqList(cmd)
+	},
+}
+
+var dlqReplayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "write the dead-lettered messages matching the filters back to their original topic",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return dlqReplay(cmd)
+	},
+}
+
+func dlqFilter() (string, *kafka.DLQFilter, error) {
+	if dlqFlags.topic == "" && dlqFlags.dlq == "" {
+		return "", nil, errors.InvalidArg("--topic or --dlq is required")
+	}
+	filter := &kafka.DLQFilter{
+		Topic: dlqFlags.topic,
+		Error: dlqFlags.err,
+		Key:   dlqFlags.key,
+	}
+	var err error
+	if dlqFlags.since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, dlqFlags.since); err != nil {
+			return "", nil, errors.InvalidArg("--since", err)
+		}
+	}
+	if dlqFlags.until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, dlqFlags.until); err != nil {
+			return "", nil, errors.InvalidArg("--until", err)
+		}
+	}
+	topic := dlqFlags.dlq
+	if topic == "" {
+		topic = kafka.DLQTopic(dlqFlags.topic)
+	}
+	return topic, filter, nil
+}
+
+func printDLQMessage(w io.Writer, m *broker.Message) {
+	fmt.Fprintf(w, "%d/%d\t%s\tkey=%s\torigin=%s/%s/%s\tattempt=%s\terror=%s\n",
+		m.Partition, m.Offset, m.Timestamp.Format(time.RFC3339), string(m.Key),
+		m.Header(kafka.HeaderOriginalTopic),
+		m.Header(kafka.HeaderOriginalPartition),
+		m.Header(kafka.HeaderOriginalOffset),
+		m.Header(kafka.HeaderAttempt),
+		m.Header(kafka.HeaderError))
+}
+
+func dlqList(cmd *cobra.Command) error {
+	topic, filter, err := dlqFilter()
+	if err != nil {
+		return err
+	}
+	brokers := config.Config.GetStringSlice("kafka.brokers")
+	return kafka.ReadDLQ(brokers, topic, filter, func(m *broker.Message) error {
+		printDLQMessage(cmd.OutOrStdout(), m)
+		return nil
+	})
+}
+
+func dlqReplay(cmd *cobra.Command) error {
+	topic, filter, err := dlqFilter()
+	if err != nil {
+		return err
+	}
+	brokers := config.Config.GetStringSlice("kafka.brokers")
+	var replayer *kafka.DLQReplayer
+	if !dlqFlags.dryRun {
+		if replayer, err = kafka.NewDLQReplayer(brokers); err != nil {
+			return err
+		}
+		defer replayer.Close()
+	}
+	count := 0
+	err = kafka.ReadDLQ(brokers, topic, filter, func(m *broker.Message) error {
+		printDLQMessage(cmd.OutOrStdout(), m)
+		count++
+		if replayer == nil {
+			return nil
+		}
+		return replayer.Replay(m)
+	})
+	if dlqFlags.dryRun {
+		fmt.Fprintf(cmd.OutOrStdout(), "%d messages would be replayed\n", count)
+	} else {
+		fmt.Fprintf(cmd.OutOrStdout(), "%d messages replayed\n", count)
+	}
+	return err
+}
+
+func init() {
+	for _, c := range []*cobra.Command{dlqListCmd, dlqReplayCmd} {
+		flags := c.Flags()
+		flags.StringVar(&dlqFlags.topic, "topic", "", "original topic of the messages, its dead letter topic is read")
+		flags.StringVar(&dlqFlags.dlq, "dlq", "", "dead letter topic to read, defaults to <topic>.dlq")
+		flags.StringVar(&dlqFlags.since, "since", "", "only the messages dead-lettered at or after this RFC3339 time")
+		flags.StringVar(&dlqFlags.until, "until", "", "only the messages dead-lettered before this RFC3339 time")
+		flags.StringVar(&dlqFlags.err, "error", "", "only the messages whose error contains this substring")
+		flags.StringVar(&dlqFlags.key, "key", "", "only the messages with this key")
+	}
+	dlqReplayCmd.Flags().BoolVar(&dlqFlags.dryRun, "dry-run", false, "print the messages without replaying them")
+	dlqCmd.AddCommand(dlqListCmd, dlqReplayCmd)
+	kafkaCmd.AddCommand(dlqCmd)
+}
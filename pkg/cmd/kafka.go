@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"github.com/Shopify/sarama"
 	"github.com/spf13/cobra"
 	"keyayun.com/seal-kafka-runner/pkg/errors"
 	"keyayun.com/seal-kafka-runner/pkg/kafka"
@@ -25,15 +24,7 @@ func producerTopic(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	kafkaKey, err := sarama.StringEncoder(key).Encode()
-	if err != nil {
-		return err
-	}
-	kafkaVal, err := sarama.StringEncoder(val).Encode()
-	if err != nil {
-		return err
-	}
-	return pro.Add("test", "string", kafkaKey, kafkaVal)
+	return pro.Add("test", "string", []byte(key), []byte(val))
 }
 
 var kafkaCmd = &cobra.Command{
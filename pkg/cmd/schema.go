@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"keyayun.com/seal-kafka-runner/pkg/config"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/kafka"
+)
+
+var schemaFlags struct {
+	registries []string
+	subject    string
+	topic      string
+	key        bool
+	version    string
+	schemaType string
+}
+
+// schemaTypes gives the schema type of the schema file extensions
+var schemaTypes = map[string]string{
+	".avsc":  kafka.SchemaTypeAvro,
+	".json":  kafka.SchemaTypeJSON,
+	".proto": kafka.SchemaTypeProtobuf,
+}
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "manage the schemas of the schema registry",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var schemaCheckCmd = &cobra.Command{
+	Use:   "check <schema file>...",
+	Short: "check that the schemas are compatible with the registered versions of the subject",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return schemaCheck(cmd, args)
+	},
+}
+
+func schemaSubject() (string, error) {
+	if schemaFlags.subject != "" {
+		return schemaFlags.subject, nil
+	}
+	if schemaFlags.topic == "" {
+		return "", errors.InvalidArg("--subject or --topic is required")
+	}
+	return kafka.TopicNameStrategy.Subject(schemaFlags.topic, schemaFlags.key, "")
+}
+
+func readSchemaFile(file string) (*kafka.RawSchema, error) {
+	schemaType := strings.ToUpper(schemaFlags.schemaType)
+	if schemaType == "" {
+		schemaType = schemaTypes[strings.ToLower(filepath.Ext(file))]
+	}
+	if schemaType == "" {
+		return nil, errors.InvalidArg("unknown schema type of", file, ", use --type")
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	schema := &kafka.RawSchema{Schema: string(b), SchemaType: schemaType}
+	if schemaType == kafka.SchemaTypeAvro {
+		// the registry omits the type of the Avro schemas
+		schema.SchemaType = ""
+	}
+	return schema, nil
+}
+
+func schemaCheck(cmd *cobra.Command, files []string) error {
+	subject, err := schemaSubject()
+	if err != nil {
+		return err
+	}
+	registries := schemaFlags.registries
+	if len(registries) == 0 {
+		registries = config.Config.GetStringSlice("kafka.schemaRegistries")
+	}
+	opts, err := kafka.LoadSchemaRegistryOptions()
+	if err != nil {
+		return err
+	}
+	client := kafka.NewSchemaRegistryClientWithOptions(registries, opts)
+	w := cmd.OutOrStdout()
+	incompatible := 0
+	for _, file := range files {
+		schema, err := readSchemaFile(file)
+		if err != nil {
+			return err
+		}
+		result, err := client.TestCompatibility(subject, schemaFlags.version, schema)
+		if errors.IsNotFound(err) {
+			fmt.Fprintf(w, "%s\tcompatible\tsubject %s has no version yet\n", file, subject)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if result.IsCompatible {
+			fmt.Fprintf(w, "%s\tcompatible\n", file)
+			continue
+		}
+		incompatible++
+		fmt.Fprintf(w, "%s\tincompatible\t%s\n", file, strings.Join(result.Messages, "; "))
+	}
+	if incompatible > 0 {
+		return errors.Errorf("%d schemas are incompatible with subject %s", incompatible, subject)
+	}
+	return nil
+}
+
+func init() {
+	flags := schemaCheckCmd.Flags()
+	flags.StringSliceVar(&schemaFlags.registries, "registry", nil, "schema registry urls, defaults to kafka.schemaRegistries")
+	flags.StringVar(&schemaFlags.subject, "subject", "", "subject to check the schemas against")
+	flags.StringVar(&schemaFlags.topic, "topic", "", "topic whose <topic>-value subject is checked")
+	flags.BoolVar(&schemaFlags.key, "key", false, "check the <topic>-key subject of --topic")
+	flags.StringVar(&schemaFlags.version, "version", "latest", "version of the subject to check against")
+	flags.StringVar(&schemaFlags.schemaType, "type", "", "AVRO, JSON or PROTOBUF, defaults to the type of the file extension")
+	schemaCmd.AddCommand(schemaCheckCmd)
+	RootCmd.AddCommand(schemaCmd)
+}
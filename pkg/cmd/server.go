@@ -6,8 +6,7 @@ import (
 )
 
 func startUp() error {
-	kafka.StartUpConsumer()
-	return nil
+	return kafka.StartUpConsumer()
 }
 
 var serveCmd = &cobra.Command{
@@ -0,0 +1,252 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// DeliveryReport is the result of a message sent by the AsyncAvroProducer
+type DeliveryReport struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	// Metadata is the value given to Add
+	Metadata interface{}
+	Err      error
+}
+
+// AsyncProducerOptions configures the batching of the AsyncAvroProducer
+type AsyncProducerOptions struct {
+	// BatchSize and BatchBytes send a batch once it has that many messages or bytes
+	BatchSize  int
+	BatchBytes int
+	// Linger is the longest time a message waits for its batch to fill up
+	Linger time.Duration
+	// Compression is one of none, gzip, snappy, lz4 or zstd
+	Compression string
+	// OnDelivery is called with the report of every message, the reports are
+	// sent to Deliveries() when it is nil
+	OnDelivery func(*DeliveryReport)
+}
+
+// AsyncAvroProducer sends the messages in batches without waiting for their
+// delivery, which is reported through OnDelivery or Deliveries()
+type AsyncAvroProducer struct {
+	producer             broker.AsyncProducer
+	schemaRegistryClient *CachedSchemaRegistryClient
+	subjects             *subjectNames
+	onDelivery           func(*DeliveryReport)
+	deliveries           chan *DeliveryReport
+
+	mu       sync.Mutex
+	inflight int
+	idle     chan struct{}
+}
+
+// deliveriesBufferSize is the capacity of the Deliveries() channel
+const deliveriesBufferSize = 256
+
+// NewAsyncAvroProducer is a batching producer to interact with schema registry, avro and kafka
+func NewAsyncAvroProducer(kafkaServers []string, schemaRegistryServers []string, opts AsyncProducerOptions) (*AsyncAvroProducer, error) {
+	return NewAsyncAvroProducerFromCluster(NewSaramaCluster(kafkaServers), schemaRegistryServers, opts)
+}
+
+// NewAsyncAvroProducerFromCluster is like NewAsyncAvroProducer on the brokers
+// of the cluster
+func NewAsyncAvroProducerFromCluster(cluster broker.Cluster, schemaRegistryServers []string, opts AsyncProducerOptions) (*AsyncAvroProducer, error) {
+	var schemaRegistryClient *CachedSchemaRegistryClient
+	if schemaRegistryServers != nil {
+		var err error
+		if schemaRegistryClient, err = newRegistryClient(schemaRegistryServers); err != nil {
+			return nil, err
+		}
+	}
+	producer, err := cluster.NewAsyncProducer(broker.BatchOptions{
+		Size:        opts.BatchSize,
+		Bytes:       opts.BatchBytes,
+		Linger:      opts.Linger,
+		Compression: opts.Compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+	subjects, _ := newSubjectNames(TopicNameStrategy, nil)
+	p := &AsyncAvroProducer{
+		producer:             producer,
+		schemaRegistryClient: schemaRegistryClient,
+		subjects:             subjects,
+		onDelivery:           opts.OnDelivery,
+	}
+	if p.onDelivery == nil {
+		p.deliveries = make(chan *DeliveryReport, deliveriesBufferSize)
+	}
+	return p, nil
+}
+
+// Add encodes the textual JSON value and queues it, metadata is handed back
+// in the delivery report
+func (p *AsyncAvroProducer) Add(topic string, schema string, key []byte, value []byte, metadata interface{}) error {
+	binaryMsg, err := encodeAvro(p.schemaRegistryClient, p.subjects, topic, false, schema, value)
+	if err != nil {
+		return err
+	}
+	return p.send(topic, key, binaryMsg, metadata)
+}
+
+// AddValue is like Add for v, a struct mapped to the Avro record through its avro tags
+func (p *AsyncAvroProducer) AddValue(topic string, schema string, key []byte, v interface{}, metadata interface{}) error {
+	binaryMsg, err := encodeAvroValue(p.schemaRegistryClient, p.subjects, topic, false, schema, v)
+	if err != nil {
+		return err
+	}
+	return p.send(topic, key, binaryMsg, metadata)
+}
+
+// AddWithKey is like Add with a textual JSON key encoded with keySchema,
+// registered under the key subject of the topic
+func (p *AsyncAvroProducer) AddWithKey(topic string, keySchema string, key []byte, schema string, value []byte, metadata interface{}) error {
+	binaryKey, err := encodeAvro(p.schemaRegistryClient, p.subjects, topic, true, keySchema, key)
+	if err != nil {
+		return err
+	}
+	binaryMsg, err := encodeAvro(p.schemaRegistryClient, p.subjects, topic, false, schema, value)
+	if err != nil {
+		return err
+	}
+	encodedKey, err := binaryKey.Encode()
+	if err != nil {
+		return err
+	}
+	return p.send(topic, encodedKey, binaryMsg, metadata)
+}
+
+// AddValueWithKey is like AddValue with a Go key value encoded with keySchema,
+// registered under the key subject of the topic
+func (p *AsyncAvroProducer) AddValueWithKey(topic string, keySchema string, key interface{}, schema string, v interface{}, metadata interface{}) error {
+	binaryKey, err := encodeAvroValue(p.schemaRegistryClient, p.subjects, topic, true, keySchema, key)
+	if err != nil {
+		return err
+	}
+	binaryMsg, err := encodeAvroValue(p.schemaRegistryClient, p.subjects, topic, false, schema, v)
+	if err != nil {
+		return err
+	}
+	encodedKey, err := binaryKey.Encode()
+	if err != nil {
+		return err
+	}
+	return p.send(topic, encodedKey, binaryMsg, metadata)
+}
+
+// AddJSON is like Add for a JSON document validated against the JSON schema
+func (p *AsyncAvroProducer) AddJSON(topic string, schema string, key []byte, doc []byte, metadata interface{}) error {
+	binaryMsg, err := encodeJSON(p.schemaRegistryClient, p.subjects, topic, false, schema, doc)
+	if err != nil {
+		return err
+	}
+	return p.send(topic, key, binaryMsg, metadata)
+}
+
+// AddProto is like Add for the message type of a .proto schema
+func (p *AsyncAvroProducer) AddProto(topic string, schema string, message string, key []byte, value []byte, metadata interface{}) error {
+	binaryMsg, err := encodeProto(p.schemaRegistryClient, p.subjects, topic, false, schema, message, value)
+	if err != nil {
+		return err
+	}
+	return p.send(topic, key, binaryMsg, metadata)
+}
+
+// SetSubjectNameStrategy sets the subject name strategy of the schemas of the
+// topic, the default is TopicNameStrategy
+func (p *AsyncAvroProducer) SetSubjectNameStrategy(topic string, strategy SubjectNameStrategy) {
+	p.subjects.set(topic, strategy)
+}
+
+// send queues the encoded value
+func (p *AsyncAvroProducer) send(topic string, key []byte, value *AvroEncoder, metadata interface{}) error {
+	encoded, err := value.Encode()
+	if err != nil {
+		return err
+	}
+	p.Publish(&broker.Message{
+		Topic: topic,
+		Key:   key,
+		Value: encoded,
+	}, metadata)
+	return nil
+}
+
+// Publish queues an already encoded message
+func (p *AsyncAvroProducer) Publish(msg *broker.Message, metadata interface{}) {
+	p.mu.Lock()
+	if p.inflight == 0 {
+		p.idle = make(chan struct{})
+	}
+	p.inflight++
+	p.mu.Unlock()
+	p.producer.Send(msg, func(m *broker.Message, err error) {
+		p.report(m, metadata, err)
+	})
+}
+
+// Deliveries returns the channel of the delivery reports when no OnDelivery
+// callback is set, it must be read to not block the producer
+func (p *AsyncAvroProducer) Deliveries() <-chan *DeliveryReport {
+	return p.deliveries
+}
+
+// Flush waits until every queued message is delivered or ctx is done
+func (p *AsyncAvroProducer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	idle := p.idle
+	inflight := p.inflight
+	p.mu.Unlock()
+	if inflight == 0 {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return errors.Timeout("flush producer", ctx.Err())
+	}
+}
+
+// Close flushes the queued messages then closes the producer
+func (p *AsyncAvroProducer) Close() error {
+	asyncProducersLock.Lock()
+	delete(asyncProducers, p)
+	asyncProducersLock.Unlock()
+	err := p.producer.Close()
+	if p.deliveries != nil {
+		close(p.deliveries)
+	}
+	return err
+}
+
+func (p *AsyncAvroProducer) report(msg *broker.Message, metadata interface{}, err error) {
+	report := &DeliveryReport{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       msg.Key,
+		Metadata:  metadata,
+		Err:       err,
+	}
+	if p.onDelivery != nil {
+		p.onDelivery(report)
+	} else {
+		p.deliveries <- report
+	}
+	p.mu.Lock()
+	p.inflight--
+	if p.inflight == 0 {
+		close(p.idle)
+	}
+	p.mu.Unlock()
+}
@@ -0,0 +1,181 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// holdingCluster returns an async producer which holds the messages until
+// deliver is called
+type holdingCluster struct {
+	broker.Cluster
+	producer *holdingProducer
+}
+
+func (c *holdingCluster) NewAsyncProducer(opts broker.BatchOptions) (broker.AsyncProducer, error) {
+	return c.producer, nil
+}
+
+type holdingProducer struct {
+	mu   sync.Mutex
+	held []func()
+}
+
+func (p *holdingProducer) Send(m *broker.Message, done func(*broker.Message, error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.held = append(p.held, func() { done(m, nil) })
+}
+
+// deliver reports the held messages as delivered
+func (p *holdingProducer) deliver() {
+	p.mu.Lock()
+	held := p.held
+	p.held = nil
+	p.mu.Unlock()
+	for _, done := range held {
+		done()
+	}
+}
+
+func (p *holdingProducer) Close() error {
+	p.deliver()
+	return nil
+}
+
+func TestAsyncFlushHonorsContext(t *testing.T) {
+	held := &holdingProducer{}
+	var mu sync.Mutex
+	var reports []*DeliveryReport
+	p, err := NewAsyncAvroProducerFromCluster(&holdingCluster{producer: held}, nil, AsyncProducerOptions{
+		OnDelivery: func(r *DeliveryReport) {
+			mu.Lock()
+			reports = append(reports, r)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Flush(cancelled); err != nil {
+		t.Fatalf("flush without messages: %v", err)
+	}
+
+	p.Publish(&broker.Message{Topic: "jobs", Value: []byte("first")}, 1)
+	p.Publish(&broker.Message{Topic: "jobs", Value: []byte("second")}, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.Flush(ctx); !errors.IsTimeout(err) {
+		t.Fatalf("flush of held messages: %v, want a Timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("flush returned after %s", elapsed)
+	}
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- p.Flush(context.Background())
+	}()
+	held.deliver()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("flush still waits for the delivered messages")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) != 2 || reports[0].Metadata != 1 || reports[1].Metadata != 2 {
+		t.Fatalf("delivery reports %v, want the metadata 1 then 2", reports)
+	}
+}
+
+func TestAsyncProducerDeliveries(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	p, err := NewAsyncAvroProducerFromCluster(h.cluster, []string{h.registry}, AsyncProducerOptions{BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for i := 0; i < 3; i++ {
+		if err := p.Add("jobs", testSchema, nil, []byte(`{"id": 1}`), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		report := <-p.Deliveries()
+		if report.Err != nil || report.Topic != "jobs" || report.Metadata != i {
+			t.Fatalf("delivery report %+v, want the metadata %d", report, i)
+		}
+	}
+	if n := len(h.cluster.Messages("jobs")); n != 3 {
+		t.Fatalf("%d messages produced, want 3", n)
+	}
+}
+
+func TestAsyncProducerKeyedValues(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	p, err := NewAsyncAvroProducerFromCluster(h.cluster, []string{h.registry}, AsyncProducerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	const keySchema = `{"type": "record", "name": "JobKey", "fields": [{"name": "tenant", "type": "string"}]}`
+	type jobKey struct {
+		Tenant string `avro:"tenant"`
+	}
+	type job struct {
+		ID int `avro:"id"`
+	}
+	if err := p.AddValueWithKey("jobs", keySchema, jobKey{"acme"}, testSchema, job{7}, "keyed"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	report := <-p.Deliveries()
+	if report.Err != nil || report.Metadata != "keyed" {
+		t.Fatalf("delivery report %+v", report)
+	}
+	messages := h.cluster.Messages("jobs")
+	if len(messages) != 1 || !bytes.Equal(messages[0].Key, report.Key) {
+		t.Fatalf("produced %v, want the key %x of the report", messages, report.Key)
+	}
+
+	deserializer := NewRegistryDeserializer(NewCachedSchemaRegistryClient([]string{h.registry}))
+	payload, err := deserializer.DeserializeFramed(ctx, "jobs", true, report.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key jobKey
+	if err := payload.Decode(&key); err != nil || key.Tenant != "acme" {
+		t.Fatalf("decoded key %+v, %v", key, err)
+	}
+	if payload, err = deserializer.Deserialize(ctx, "jobs", false, messages[0].Value); err != nil {
+		t.Fatal(err)
+	}
+	var value job
+	if err := payload.Decode(&value); err != nil || value.ID != 7 {
+		t.Fatalf("decoded value %+v, %v", value, err)
+	}
+}
@@ -2,51 +2,295 @@ package kafka
 
 import (
 	"context"
-	"encoding/binary"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/Shopify/sarama"
 	"github.com/linkedin/goavro/v2"
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/services"
 )
 
+const (
+	// defaultReconnectBackoff is the delay before a failed session is restarted
+	defaultReconnectBackoff = 2 * time.Second
+	// defaultDrainTimeout is how long the running jobs are waited for at shutdown
+	defaultDrainTimeout = 25 * time.Second
+)
+
+// ErrDrainTimeout is returned by ConsumeContext when jobs were still running
+// at the drain timeout
+var ErrDrainTimeout = errors.New("jobs still running at the drain timeout")
+
 type avroConsumer struct {
-	Consumer             sarama.ConsumerGroup
-	Topic                string
-	SchemaRegistryClient *CachedSchemaRegistryClient
-	handler              *groupConsumerHandler
+	Consumer              broker.Consumer
+	Topics                []string
+	SchemaRegistryClient  *CachedSchemaRegistryClient
+	cluster               broker.Cluster
+	ownsCluster           bool
+	schemaRegistryServers []string
+	groupId               string
+	subscription          *topicSubscription
+	subjects              *subjectNames
+	refresh               time.Duration
+	handler               *groupConsumerHandler
+	deserializer          *RegistryDeserializer
+	// reconnectBackoff is the delay before a failed session is restarted
+	reconnectBackoff time.Duration
+	// drainTimeout is how long the running jobs are waited for at shutdown
+	drainTimeout time.Duration
 }
 
 type groupConsumerHandler struct {
-	ready chan bool
+	ready      chan bool
+	consumer   *avroConsumer
+	dispatcher *Dispatcher
+	retrier    *retrier
+	txn        *txnConfig
+
+	eventsLock sync.Mutex
+	events     *AvroProducer
+
+	commitMode     CommitMode
+	commitBatch    int
+	commitInterval time.Duration
+	committer      *committer
+
+	poolsLock sync.Mutex
+	pools     map[string]*workerPool
+
+	// stopping is closed when the consumer shuts down, the running jobs are
+	// then drained rather than cancelled with their session
+	stopping chan struct{}
+	// drain is the parent of the job contexts, abortJobs cancels it at the
+	// drain timeout
+	drain     context.Context
+	abortJobs context.CancelFunc
+
+	sessionLock sync.Mutex
+	session     broker.Session
+	jobs        context.Context
+	cancelJobs  context.CancelFunc
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (handler *groupConsumerHandler) Setup(sarama.ConsumerGroupSession) error {
+func (handler *groupConsumerHandler) Setup(session broker.Session) error {
+	if handler.commitMode == CommitSync {
+		handler.committer = newCommitter(session, handler.commitBatch, handler.commitInterval)
+	}
+	jobs, cancel := context.WithCancel(handler.drain)
+	handler.sessionLock.Lock()
+	handler.session, handler.jobs, handler.cancelJobs = session, jobs, cancel
+	handler.sessionLock.Unlock()
+	go handler.revokeJobs(session, jobs, cancel)
 	// Mark the consumer as ready
 	close(handler.ready)
 	return nil
 }
 
 // Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (handler *groupConsumerHandler) Cleanup(sarama.ConsumerGroupSession) error {
+func (handler *groupConsumerHandler) Cleanup(broker.Session) error {
+	if handler.committer != nil {
+		// commit the offsets marked by the last jobs of the session
+		handler.committer.close()
+		handler.committer = nil
+	}
+	handler.sessionLock.Lock()
+	handler.cancelJobs()
+	handler.session, handler.jobs, handler.cancelJobs = nil, nil, nil
+	handler.sessionLock.Unlock()
 	return nil
 }
 
+// revokeJobs cancels the jobs of the session once a rebalance ends it, the
+// jobs of a shutdown keep running until they complete or the drain timeout
+func (handler *groupConsumerHandler) revokeJobs(session broker.Session, jobs context.Context, cancel context.CancelFunc) {
+	select {
+	case <-session.Context().Done():
+	case <-jobs.Done():
+		return
+	}
+	select {
+	case <-handler.stopping:
+	default:
+		cancel()
+	}
+}
+
+// jobContext returns the context of the jobs of the current session
+func (handler *groupConsumerHandler) jobContext() context.Context {
+	handler.sessionLock.Lock()
+	defer handler.sessionLock.Unlock()
+	return handler.jobs
+}
+
+// commit commits the offsets marked in the current session, if any
+func (handler *groupConsumerHandler) commit() {
+	handler.sessionLock.Lock()
+	defer handler.sessionLock.Unlock()
+	if handler.session != nil {
+		handler.session.Commit()
+	}
+}
+
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
-func (handler *groupConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+func (handler *groupConsumerHandler) ConsumeClaim(session broker.Session, claim broker.Claim) error {
 	// NOTE:
 	// Do not move the code below to a goroutine.
-	// The `ConsumeClaim` itself is called within a goroutine, see:
-	// https://github.com/Shopify/sarama/blob/master/consumer_group.go#L27-L29
-	for message := range claim.Messages() {
-		log.Printf("Message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
-		session.MarkMessage(message, "")
+	// The `ConsumeClaim` itself is called within a goroutine, see
+	// broker.Handler.
+	// The jobs are run by the worker pools, the partition offset is marked as
+	// they complete, and the claim only returns once its jobs are done.
+	if handler.txn != nil {
+		return handler.consumeTransactional(session, claim)
+	}
+	tracker := newOffsetTracker(session, handler.committer, claim.Topic(), claim.Partition())
+	defer tracker.wait()
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			log.Debugf("Message claimed: timestamp = %v, topic = %s, partition = %d, offset = %d",
+				message.Timestamp, message.Topic, message.Partition, message.Offset)
+			if handler.commitMode == CommitAuto {
+				session.MarkOffset(message.Topic, message.Partition, message.Offset+1)
+			}
+			if handler.retrier != nil {
+				// the messages of a retry topic wait for their delay
+				if err := handler.retrier.wait(session.Context(), message); err != nil {
+					return nil
+				}
+			}
+			service, err := handler.dispatcher.Resolve(message)
+			if err != nil {
+				log.WithError(err).Errorf("no service, topic = %s, partition = %d, offset = %d",
+					message.Topic, message.Partition, message.Offset)
+				return err
+			}
+			j := &job{ctx: handler.jobContext(), claimed: session.Context(), message: message, service: service, tracker: tracker}
+			if err := handler.pool(service).submit(session.Context(), j); err != nil {
+				return nil
+			}
+		case err := <-tracker.failed:
+			// leave the message unmarked: the session is restarted and the
+			// message is consumed again from the last committed offset
+			log.WithError(err).Errorf("job failed, topic = %s, partition = %d", claim.Topic(), claim.Partition())
+			return err
+		}
+	}
+}
+
+// pool returns the worker pool of the service, kafka.workers.<service> sets
+// its number of workers, kafka.workers.default is used otherwise
+func (handler *groupConsumerHandler) pool(service services.Service) *workerPool {
+	key := service.Name() + "@" + service.Version()
+	handler.poolsLock.Lock()
+	defer handler.poolsLock.Unlock()
+	if pool, ok := handler.pools[key]; ok {
+		return pool
+	}
+	workers := conf.GetInt("kafka.workers." + service.Name())
+	if workers <= 0 {
+		workers = conf.GetInt("kafka.workers.default")
+	}
+	pool := newWorkerPool(workers, conf.GetInt("kafka.workerQueueSize"), handler.handleJob)
+	handler.pools[key] = pool
+	return pool
+}
+
+// close stops the worker pools once their queued jobs are done, then closes
+// the retry and events producers
+func (handler *groupConsumerHandler) close() {
+	handler.poolsLock.Lock()
+	for key, pool := range handler.pools {
+		pool.close()
+		delete(handler.pools, key)
+	}
+	handler.poolsLock.Unlock()
+	if handler.retrier != nil {
+		handler.retrier.close()
+		handler.retrier = nil
+	}
+	handler.eventsLock.Lock()
+	if handler.events != nil {
+		handler.events.Close()
+		handler.events = nil
+	}
+	handler.eventsLock.Unlock()
+}
+
+// eventsProducer returns the producer of the events emitted by the jobs
+// outside of transactions
+func (handler *groupConsumerHandler) eventsProducer() (*AvroProducer, error) {
+	handler.eventsLock.Lock()
+	defer handler.eventsLock.Unlock()
+	if handler.events == nil {
+		ac := handler.consumer
+		producer, err := NewAvroProducerFromCluster(ac.cluster, ac.schemaRegistryServers)
+		if err != nil {
+			return nil, err
+		}
+		producer.subjects = ac.subjects
+		handler.events = producer
+	}
+	return handler.events, nil
+}
+
+// handleJob runs the job and publishes its events, a failed job is moved to
+// the retry or dead letter topics when retries are enabled
+func (handler *groupConsumerHandler) handleJob(j *job) error {
+	events, err := handler.runJob(j)
+	if err == nil && len(events) > 0 {
+		var producer *AvroProducer
+		if producer, err = handler.eventsProducer(); err == nil {
+			err = publishEvents(producer, events)
+		}
+	}
+	if err == nil || handler.retrier == nil || j.ctx.Err() != nil {
+		// a cancelled job is consumed again rather than retried
+		return err
+	}
+	return handler.retrier.retry(j.message, err)
+}
+
+// runJob decodes the message and hands it to the service it is routed to,
+// the events of the services.Emitter are returned
+func (handler *groupConsumerHandler) runJob(j *job) ([]services.Event, error) {
+	ctx := services.WithJobInfo(j.ctx, jobInfo(j.message))
+	if typed, ok := j.service.(services.TypedService); ok {
+		value := typed.NewJob()
+		if err := handler.consumer.DecodeValueContext(ctx, j.message, value); err != nil {
+			return nil, err
+		}
+		return nil, typed.RunTypedJob(ctx, value)
+	}
+	msg, err := handler.consumer.ProcessAvroMsgContext(ctx, j.message)
+	if err != nil {
+		return nil, err
+	}
+	if emitter, ok := j.service.(services.Emitter); ok {
+		return emitter.RunJobAndEmit(ctx, []byte(msg.Value))
+	}
+	return nil, j.service.RunJob(ctx, []byte(msg.Value))
+}
+
+// jobInfo returns the JobInfo of the jobs of the message
+func jobInfo(m *broker.Message) *services.JobInfo {
+	headers := make(map[string]string, len(m.Headers))
+	for _, h := range m.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	return &services.JobInfo{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Headers:   headers,
+		Timestamp: m.Timestamp,
+		Attempt:   attempt(m),
 	}
-	return nil
 }
 
 type Message struct {
@@ -54,51 +298,147 @@ type Message struct {
 	Topic     string
 	Partition int32
 	Offset    int64
-	Key       string
-	Value     string
+	// Key is the textual JSON of the Avro keys, KeySchemaId is 0 for the
+	// string keys
+	Key         string
+	Value       string
+	KeySchemaId int
 }
 
-func NewConsumerConfig() (conf *sarama.Config) {
-	conf = sarama.NewConfig()
-	conf.Version = sarama.MaxVersion
-	conf.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
-	conf.Consumer.Offsets.AutoCommit.Enable = true
-	conf.Consumer.Offsets.Initial = sarama.OffsetOldest
-	conf.Consumer.Fetch.Min = 1
-	conf.Consumer.Fetch.Default = 1024
-	conf.Consumer.MaxWaitTime = time.Millisecond * 100
+// avroConsumer is a basic consumer to interact with schema registry, avro and kafka,
+// the topics patterns are re-resolved against the cluster metadata every refresh
+func NewAvroConsumer(kafkaServers []string, schemaRegistryServers []string,
+	topics []TopicConfig, groupId string, refresh time.Duration, dispatcher *Dispatcher) (*avroConsumer, error) {
+	cluster := NewSaramaCluster(kafkaServers)
+	ac, err := NewAvroConsumerFromCluster(cluster, schemaRegistryServers, topics, groupId, refresh, dispatcher)
+	if err != nil {
+		cluster.Close()
+		return nil, err
+	}
+	ac.ownsCluster = true
+	return ac, nil
+}
 
-	// FIXME: For consumer it's per-partition/channel value. It's default value is 256.
-	//  May cause huge memory usage (partition_count*buffer_size*message_size).
-	conf.ChannelBufferSize = 10
-	return
+// NewAvroConsumerFromCluster is like NewAvroConsumer on the brokers of the
+// cluster, which is left open by Close
+func NewAvroConsumerFromCluster(cluster broker.Cluster, schemaRegistryServers []string,
+	topics []TopicConfig, groupId string, refresh time.Duration, dispatcher *Dispatcher) (*avroConsumer, error) {
+	commitMode, err := ParseCommitMode(conf.GetString("kafka.commit.mode"))
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := ParseSubjectNameStrategy(conf.GetString("kafka.subjectStrategy"))
+	if err != nil {
+		return nil, err
+	}
+	subjects, err := newSubjectNames(fallback, topics)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := loadRetryPolicy()
+	if err != nil {
+		return nil, err
+	}
+	schemaRegistryClient, err := newRegistryClient(schemaRegistryServers)
+	if err != nil {
+		return nil, err
+	}
+	deserializer := NewRegistryDeserializer(schemaRegistryClient)
+	deserializer.subjects = subjects
+	if dispatcher == nil {
+		dispatcher = NewDispatcher()
+	}
+	if refresh <= 0 {
+		refresh = defaultTopicRefresh
+	}
+	var r *retrier
+	if policy != nil {
+		if r, err = newRetrier(cluster, policy); err != nil {
+			return nil, err
+		}
+	}
+	txn := loadTxnConfig()
+	consumer, err := cluster.NewConsumer(groupId, broker.ConsumerOptions{
+		// the sync mode commits explicitly
+		AutoCommit: commitMode != CommitSync,
+		// the offsets are committed by the transactions
+		ReadCommitted: txn != nil,
+	})
+	if err != nil {
+		if r != nil {
+			r.close()
+		}
+		return nil, err
+	}
+	ac := &avroConsumer{
+		Consumer:              consumer,
+		SchemaRegistryClient:  schemaRegistryClient,
+		cluster:               cluster,
+		schemaRegistryServers: schemaRegistryServers,
+		groupId:               groupId,
+		subscription:          newTopicSubscription(topics, policy),
+		subjects:              subjects,
+		deserializer:          deserializer,
+		refresh:               refresh,
+		reconnectBackoff:      defaultReconnectBackoff,
+		drainTimeout:          drainTimeout(),
+	}
+	drain, abortJobs := context.WithCancel(context.Background())
+	ac.handler = &groupConsumerHandler{
+		ready:      make(chan bool),
+		consumer:   ac,
+		dispatcher: dispatcher,
+		retrier:    r,
+		txn:        txn,
+
+		commitMode:     commitMode,
+		commitBatch:    conf.GetInt("kafka.commit.batch"),
+		commitInterval: conf.GetDuration("kafka.commit.interval"),
+
+		pools: make(map[string]*workerPool),
+
+		stopping:  make(chan struct{}),
+		drain:     drain,
+		abortJobs: abortJobs,
+	}
+	return ac, nil
 }
 
-// avroConsumer is a basic consumer to interact with schema registry, avro and kafka
-func NewAvroConsumer(kafkaServers []string, schemaRegistryServers []string,
-	topic string, groupId string, callbacks *groupConsumerHandler) (*avroConsumer, error) {
-	// init (custom) config, enable errors and notifications
-	config := NewConsumerConfig()
-	config.Consumer.Return.Errors = true
-	//read from beginning at the first time
-	config.Consumer.Offsets.Initial = sarama.OffsetOldest
-	consumer, err := sarama.NewConsumerGroup(kafkaServers, groupId, config)
+// resolveTopics returns the topics to subscribe to, refreshing the cluster
+// metadata first when the subscription has patterns
+func (ac *avroConsumer) resolveTopics() ([]string, error) {
+	if !ac.subscription.hasPatterns() {
+		return ac.subscription.resolve(nil), nil
+	}
+	available, err := ac.cluster.Topics()
 	if err != nil {
 		return nil, err
 	}
+	return ac.subscription.resolve(available), nil
+}
 
-	schemaRegistryClient := NewCachedSchemaRegistryClient(schemaRegistryServers)
-	if callbacks == nil {
-		callbacks = &groupConsumerHandler{
-			ready: make(chan bool),
+// watchTopics cancels the session once the resolved topics differ from the
+// subscribed ones, so that the next session subscribes to the new topics
+func (ac *avroConsumer) watchTopics(ctx context.Context, cancel context.CancelFunc, topics []string) {
+	ticker := time.NewTicker(ac.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resolved, err := ac.resolveTopics()
+			if err != nil {
+				log.WithError(err).Warn("kafka refresh topics error")
+				continue
+			}
+			if !sameTopics(resolved, topics) {
+				log.Infof("kafka topics changed, topics=(%v), resubscribe", resolved)
+				cancel()
+				return
+			}
 		}
 	}
-	return &avroConsumer{
-		consumer,
-		topic,
-		schemaRegistryClient,
-		callbacks,
-	}, nil
 }
 
 //GetSchemaId get schema id from schema-registry service
@@ -110,68 +450,174 @@ func (ac *avroConsumer) GetSchema(id int) (*goavro.Codec, error) {
 	return codec, nil
 }
 
-func (ac *avroConsumer) Consume() {
-	// trap SIGINT to trigger a shutdown.
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
+// Consume consumes the topics until SIGINT or SIGTERM, see ConsumeContext
+func (ac *avroConsumer) Consume() error {
+	ctx, cancel := signalContext()
+	defer cancel()
+	return ac.ConsumeContext(ctx)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+// ConsumeContext consumes the topics until ctx is done. The sessions ended by
+// a rebalance or an error are restarted, after a backoff when the session
+// failed.
+//
+// Once ctx is done the consumer stops fetching, the queued jobs are skipped
+// and the running ones are waited for up to the drain timeout. The marked
+// offsets are then committed, the producers flushed and the group left.
+// ErrDrainTimeout is returned when jobs are still running at the drain
+// timeout, their context is cancelled and the consumer does not wait for them.
+func (ac *avroConsumer) ConsumeContext(ctx context.Context) error {
+	// the sessions are not bound to ctx: the handler must know about the
+	// shutdown before the sessions end
+	fetch, stopFetching := context.WithCancel(context.Background())
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for {
-			// `Consume` should be called inside an infinite loop, when a
-			// server-side rebalance happens, the handler session will need to be
-			// recreated to get the new claims
-			if err := ac.Consumer.Consume(ctx, []string{ac.Topic}, ac.handler); err != nil {
+			topics, err := ac.resolveTopics()
+			if err != nil {
+				log.WithError(err).Warn("kafka resolve topics error")
+			}
+			ac.Topics = topics
+			sessCtx, sessCancel := context.WithCancel(fetch)
+			if ac.subscription.hasPatterns() {
+				go ac.watchTopics(sessCtx, sessCancel, topics)
+			}
+			if len(topics) == 0 {
+				// nothing matches yet, wait for the watcher to find topics
+				<-sessCtx.Done()
+			} else if err = ac.Consumer.Consume(sessCtx, topics, ac.handler); err != nil {
+				// `Consume` should be called inside an infinite loop, when a
+				// server-side rebalance happens, the handler session will need to be
+				// recreated to get the new claims
 				log.WithError(err).Warn("kafka consumer error")
 			}
-			if ctx.Err() != nil {
+			sessCancel()
+			if err != nil {
+				// do not hammer the brokers while they fail
+				select {
+				case <-fetch.Done():
+				case <-time.After(ac.reconnectBackoff):
+				}
+			}
+			if fetch.Err() != nil {
 				return
 			}
-			log.Warnf("kafka consumer session closed, topics=(%s), need reconnect", ac.Topic)
+			log.Warnf("kafka consumer session closed, topics=(%v), need reconnect", topics)
 			ac.handler.ready = make(chan bool)
 		}
 	}()
 	log.Println("Sarama consumer up and running!...")
-	<-ac.handler.ready
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	log.Printf("terminating: context cancelled, draining the jobs for up to %v", ac.drainTimeout)
+	close(ac.handler.stopping)
+	stopFetching()
+
+	timer := time.NewTimer(ac.drainTimeout)
+	defer timer.Stop()
 	select {
-	case <-ctx.Done():
-		log.Println("terminating: context cancelled")
-	case <-sigterm:
-		log.Println("terminating: via signal")
+	case <-done:
+	case <-timer.C:
+		// the session cannot end while its jobs run, commit what completed
+		ac.handler.abortJobs()
+		ac.handler.commit()
+		log.Errorf("jobs of group %s still running after %v, exiting without them", ac.groupId, ac.drainTimeout)
+		return errors.Wrap(ErrDrainTimeout, ac.groupId)
 	}
-	cancel()
-	wg.Wait()
+	ac.handler.abortJobs()
+	ac.handler.close()
 	if err := ac.Consumer.Close(); err != nil {
-		log.Panicf("Error closing client: %v", err)
+		log.WithError(err).Error("Error closing client")
 	}
+	ac.closeCluster()
+	return nil
 }
 
-func (ac *avroConsumer) ProcessAvroMsg(m *sarama.ConsumerMessage) (Message, error) {
-	schemaId := binary.BigEndian.Uint32(m.Value[1:5])
-	codec, err := ac.GetSchema(int(schemaId))
+func (ac *avroConsumer) ProcessAvroMsg(m *broker.Message) (Message, error) {
+	return ac.ProcessAvroMsgContext(context.Background(), m)
+}
+
+// ProcessAvroMsgContext is like ProcessAvroMsg, the registry requests are
+// cancelled with ctx
+func (ac *avroConsumer) ProcessAvroMsgContext(ctx context.Context, m *broker.Message) (Message, error) {
+	topic := originalTopic(m)
+	value, err := ac.deserializer.Deserialize(ctx, topic, false, m.Value)
 	if err != nil {
 		return Message{}, err
 	}
-	// Convert binary Avro data back to native Go form
-	native, _, err := codec.NativeFromBinary(m.Value[5:])
+	textual, err := value.Textual()
 	if err != nil {
 		return Message{}, err
 	}
+	msg := Message{
+		SchemaId:  value.SchemaId,
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       string(m.Key),
+		Value:     string(textual),
+	}
+	if ac.keyFormat(m) == KeyFormatAvro {
+		key, err := ac.deserializer.DeserializeFramed(ctx, topic, true, m.Key)
+		if err != nil {
+			return Message{}, err
+		}
+		textualKey, err := key.Textual()
+		if err != nil {
+			return Message{}, err
+		}
+		msg.Key = string(textualKey)
+		msg.KeySchemaId = key.SchemaId
+	}
+	return msg, nil
+}
 
-	// Convert native Go form to textual Avro data
-	textual, err := codec.TextualFromNative(nil, native)
+// DecodeValue decodes the message into v, see Payload.Decode
+func (ac *avroConsumer) DecodeValue(m *broker.Message, v interface{}) error {
+	return ac.DecodeValueContext(context.Background(), m, v)
+}
 
+// DecodeValueContext is like DecodeValue, the registry requests are cancelled
+// with ctx
+func (ac *avroConsumer) DecodeValueContext(ctx context.Context, m *broker.Message, v interface{}) error {
+	value, err := ac.deserializer.Deserialize(ctx, originalTopic(m), false, m.Value)
 	if err != nil {
-		return Message{}, err
+		return err
 	}
-	msg := Message{int(schemaId), m.Topic, m.Partition, m.Offset, string(m.Key), string(textual)}
-	return msg, nil
+	return value.Decode(v)
+}
+
+// DecodeKey decodes the key of the message into v, like DecodeValue
+func (ac *avroConsumer) DecodeKey(m *broker.Message, v interface{}) error {
+	return ac.DecodeKeyContext(context.Background(), m, v)
+}
+
+// DecodeKeyContext is like DecodeKey with a context
+func (ac *avroConsumer) DecodeKeyContext(ctx context.Context, m *broker.Message, v interface{}) error {
+	key, err := ac.deserializer.Deserialize(ctx, originalTopic(m), true, m.Key)
+	if err != nil {
+		return err
+	}
+	return key.Decode(v)
+}
+
+// keyFormat returns the key format of the topic the message was published to
+func (ac *avroConsumer) keyFormat(m *broker.Message) string {
+	if t, ok := ac.subscription.topicConfig(originalTopic(m)); ok {
+		return t.KeyFormat
+	}
+	return KeyFormatString
 }
 
 func (ac *avroConsumer) Close() {
+	ac.handler.close()
 	ac.Consumer.Close()
+	ac.closeCluster()
+}
+
+// closeCluster closes the cluster opened by NewAvroConsumer
+func (ac *avroConsumer) closeCluster() {
+	if ac.ownsCluster {
+		ac.cluster.Close()
+	}
 }
@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+const testSchema = `{
+	"type": "record",
+	"name": "Job",
+	"fields": [{"name": "id", "type": "int"}]
+}`
+
+func produceJobs(t *testing.T, producer *AvroProducer, topic string, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		key := []byte(fmt.Sprint(i))
+		if err := producer.Add(topic, testSchema, key, []byte(fmt.Sprintf(`{"id": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func waitJobs(c *mockCluster, service *recordingService, n int) {
+	c.t.Helper()
+	c.waitFor(fmt.Sprintf("%d jobs", n), func() bool {
+		return len(service.ran()) >= n
+	})
+}
+
+func waitCommitted(c *mockCluster, topic string, partition int32, offset int64) {
+	c.t.Helper()
+	c.waitFor(fmt.Sprintf("offset %d committed", offset), func() bool {
+		return c.committed()[topic][partition] == offset
+	})
+}
+
+func TestConsumeAvroMessages(t *testing.T) {
+	c := newMockCluster(t, map[string]int32{"jobs": 1})
+	produceJobs(t, c.producer(), "jobs", 0, 3)
+
+	service := &recordingService{}
+	c.consumer(service, "jobs")
+	waitJobs(c, service, 3)
+	waitCommitted(c, "jobs", 0, 3)
+
+	for i, job := range service.ran() {
+		if want := fmt.Sprintf(`{"id":%d}`, i); job != want {
+			t.Errorf("job %d = %s, want %s", i, job, want)
+		}
+	}
+}
+
+func TestConsumeAfterRebalance(t *testing.T) {
+	c := newMockCluster(t, map[string]int32{"jobs": 2})
+	producer := c.producer()
+	produceJobs(t, producer, "jobs", 0, 2)
+
+	service := &recordingService{}
+	c.consumer(service, "jobs")
+	waitJobs(c, service, 2)
+
+	c.rebalance(map[string][]int32{"jobs": {1}})
+	before := c.logLen("jobs", 1)
+	produceJobs(t, producer, "jobs", 2, 8)
+	// only the new messages of partition 1 are consumed after the rebalance
+	waitJobs(c, service, 2+c.logLen("jobs", 1)-before)
+	waitCommitted(c, "jobs", 1, int64(c.logLen("jobs", 1)))
+	time.Sleep(200 * time.Millisecond)
+	if n, want := len(service.ran()), 2+c.logLen("jobs", 1)-before; n != want {
+		t.Fatalf("%d jobs ran, want %d", n, want)
+	}
+}
+
+func TestReconnectAfterJoinErrors(t *testing.T) {
+	c := newMockCluster(t, map[string]int32{"jobs": 1})
+	produceJobs(t, c.producer(), "jobs", 0, 1)
+
+	c.failJoins(true)
+	service := &recordingService{}
+	c.consumer(service, "jobs")
+	c.waitFor("failed joins", func() bool {
+		return c.count("JoinGroupRequest") >= 2
+	})
+	time.Sleep(300 * time.Millisecond)
+	// a session retries its join a few times, the consumer then waits for
+	// the reconnect backoff: no hot loop
+	if joins := c.count("JoinGroupRequest"); joins > 30 {
+		t.Fatalf("%d joins in 300ms", joins)
+	}
+	if len(service.ran()) != 0 {
+		t.Fatal("jobs ran without a session")
+	}
+
+	c.failJoins(false)
+	waitJobs(c, service, 1)
+	waitCommitted(c, "jobs", 0, 1)
+}
+
+func TestFailedJobIsNotCommitted(t *testing.T) {
+	c := newMockCluster(t, map[string]int32{"jobs": 1})
+	producer := c.producer()
+	produceJobs(t, producer, "jobs", 0, 1)
+
+	service := &recordingService{}
+	c.consumer(service, "jobs")
+	waitJobs(c, service, 1)
+	waitCommitted(c, "jobs", 0, 1)
+
+	service.setFail(errors.BadData("test failure"))
+	produceJobs(t, producer, "jobs", 1, 2)
+	time.Sleep(1500 * time.Millisecond)
+	if offset := c.committed()["jobs"][0]; offset != 1 {
+		t.Fatalf("committed offset %d after a failed job, want 1", offset)
+	}
+
+	// the session restarts and the message is consumed again
+	service.setFail(nil)
+	waitJobs(c, service, 2)
+	waitCommitted(c, "jobs", 0, 2)
+}
+
+func TestProduceError(t *testing.T) {
+	c := newMockCluster(t, map[string]int32{"jobs": 1})
+	producer := c.producer()
+	c.rejectProduce("jobs", 0)
+
+	err := producer.Add("jobs", testSchema, []byte("0"), []byte(`{"id": 0}`))
+	if err == nil {
+		t.Fatal("no error from a rejected message")
+	}
+	if c.logLen("jobs", 0) != 0 {
+		t.Fatal("rejected message recorded")
+	}
+
+	c.acceptProduce()
+	produceJobs(t, producer, "jobs", 0, 1)
+}
@@ -2,42 +2,79 @@ package kafka
 
 import (
 	"encoding/binary"
-	"time"
+	"sync"
 
-	"github.com/Shopify/sarama"
+	"github.com/golang/protobuf/proto"
 	"github.com/linkedin/goavro/v2"
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
 )
 
 type AvroProducer struct {
-	producer             sarama.SyncProducer
+	producer             broker.Producer
 	schemaRegistryClient *CachedSchemaRegistryClient
+	subjects             *subjectNames
 }
 
 // NewAvroProducer is a basic producer to interact with schema registry, avro and kafka
 func NewAvroProducer(kafkaServers []string, schemaRegistryServers []string) (*AvroProducer, error) {
-	config := sarama.NewConfig()
-	config.Version = sarama.MaxVersion
-	config.Producer.Partitioner = sarama.NewHashPartitioner
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Producer.Return.Successes = true
-	config.Producer.Compression = sarama.CompressionNone
-	config.Producer.MaxMessageBytes = 10000000
-	config.Producer.Retry.Max = 10
-	config.Producer.Retry.Backoff = 1000 * time.Millisecond
-	producer, err := sarama.NewSyncProducer(kafkaServers, config)
+	return NewAvroProducerFromCluster(NewSaramaCluster(kafkaServers), schemaRegistryServers)
+}
+
+// NewAvroProducerFromCluster is like NewAvroProducer on the brokers of the
+// cluster, the messages are sent without schema registry when
+// schemaRegistryServers is nil
+func NewAvroProducerFromCluster(cluster broker.Cluster, schemaRegistryServers []string) (*AvroProducer, error) {
+	producer, err := cluster.NewProducer()
+	if err != nil {
+		return nil, err
+	}
+	return newAvroProducer(producer, schemaRegistryServers)
+}
+
+// NewTransactionalAvroProducer is an idempotent producer whose messages are
+// sent within transactions, see BeginTxn. A producer initialized with the same
+// transactional id fences this one off.
+func NewTransactionalAvroProducer(kafkaServers []string, schemaRegistryServers []string, transactionalId string) (*AvroProducer, error) {
+	return NewTransactionalAvroProducerFromCluster(NewSaramaCluster(kafkaServers), schemaRegistryServers, transactionalId)
+}
+
+// NewTransactionalAvroProducerFromCluster is like NewTransactionalAvroProducer
+// on the brokers of the cluster
+func NewTransactionalAvroProducerFromCluster(cluster broker.Cluster, schemaRegistryServers []string, transactionalId string) (*AvroProducer, error) {
+	producer, err := cluster.NewTxnProducer(transactionalId)
 	if err != nil {
 		return nil, err
 	}
+	return newAvroProducer(producer, schemaRegistryServers)
+}
+
+func newAvroProducer(producer broker.Producer, schemaRegistryServers []string) (*AvroProducer, error) {
+	subjects, _ := newSubjectNames(TopicNameStrategy, nil)
 	if schemaRegistryServers == nil {
-		return &AvroProducer{producer, nil}, nil
+		return &AvroProducer{producer, nil, subjects}, nil
+	}
+	schemaRegistryClient, err := newRegistryClient(schemaRegistryServers)
+	if err != nil {
+		producer.Close()
+		return nil, err
 	}
-	schemaRegistryClient := NewCachedSchemaRegistryClient(schemaRegistryServers)
-	return &AvroProducer{producer, schemaRegistryClient}, nil
+	return &AvroProducer{producer, schemaRegistryClient, subjects}, nil
+}
+
+// SetSubjectNameStrategy sets the subject name strategy of the schemas of the
+// topic, the default is TopicNameStrategy
+func (ap *AvroProducer) SetSubjectNameStrategy(topic string, strategy SubjectNameStrategy) {
+	ap.subjects.set(topic, strategy)
 }
 
 //GetSchemaId get schema id from schema-registry service
 func (ap *AvroProducer) GetSchemaId(topic string, avroCodec *goavro.Codec) (int, error) {
-	schemaId, err := ap.schemaRegistryClient.CreateSubject(topic+"-value", avroCodec)
+	subject, err := ap.subjects.avroSubject(topic, false, avroCodec)
+	if err != nil {
+		return 0, err
+	}
+	schemaId, err := ap.schemaRegistryClient.CreateSubject(subject, avroCodec)
 	if err != nil {
 		return 0, err
 	}
@@ -45,36 +82,236 @@ func (ap *AvroProducer) GetSchemaId(topic string, avroCodec *goavro.Codec) (int,
 }
 
 func (ap *AvroProducer) Add(topic string, schema string, key []byte, value []byte) error {
-	avroCodec, err := goavro.NewCodec(schema)
+	binaryMsg, err := encodeAvro(ap.schemaRegistryClient, ap.subjects, topic, false, schema, value)
 	if err != nil {
 		return err
 	}
-	schemaId, err := ap.GetSchemaId(topic, avroCodec)
+	return ap.send(topic, key, binaryMsg)
+}
+
+// AddValue encodes v, a struct mapped to the Avro record through its avro tags
+func (ap *AvroProducer) AddValue(topic string, schema string, key []byte, v interface{}) error {
+	binaryMsg, err := encodeAvroValue(ap.schemaRegistryClient, ap.subjects, topic, false, schema, v)
 	if err != nil {
 		return err
 	}
+	return ap.send(topic, key, binaryMsg)
+}
 
-	native, _, err := avroCodec.NativeFromTextual(value)
+// AddWithKey is like Add for the topics whose keys are registry-backed too:
+// the textual JSON key is encoded with keySchema, registered under the key
+// subject of the topic
+func (ap *AvroProducer) AddWithKey(topic string, keySchema string, key []byte, schema string, value []byte) error {
+	binaryKey, err := encodeAvro(ap.schemaRegistryClient, ap.subjects, topic, true, keySchema, key)
+	if err != nil {
+		return err
+	}
+	binaryMsg, err := encodeAvro(ap.schemaRegistryClient, ap.subjects, topic, false, schema, value)
+	if err != nil {
+		return err
+	}
+	encodedKey, err := binaryKey.Encode()
 	if err != nil {
 		return err
 	}
+	return ap.send(topic, encodedKey, binaryMsg)
+}
+
+// AddValueWithKey is like AddValue with a Go key value encoded with keySchema,
+// registered under the key subject of the topic
+func (ap *AvroProducer) AddValueWithKey(topic string, keySchema string, key interface{}, schema string, v interface{}) error {
+	binaryKey, err := encodeAvroValue(ap.schemaRegistryClient, ap.subjects, topic, true, keySchema, key)
+	if err != nil {
+		return err
+	}
+	binaryMsg, err := encodeAvroValue(ap.schemaRegistryClient, ap.subjects, topic, false, schema, v)
+	if err != nil {
+		return err
+	}
+	encodedKey, err := binaryKey.Encode()
+	if err != nil {
+		return err
+	}
+	return ap.send(topic, encodedKey, binaryMsg)
+}
+
+// AddJSON validates the JSON document against the JSON schema, registered
+// with the JSON schema type, and sends it with the schema id framing
+func (ap *AvroProducer) AddJSON(topic string, schema string, key []byte, doc []byte) error {
+	binaryMsg, err := encodeJSON(ap.schemaRegistryClient, ap.subjects, topic, false, schema, doc)
+	if err != nil {
+		return err
+	}
+	return ap.send(topic, key, binaryMsg)
+}
+
+// AddJSONValue is like AddJSON for v, marshaled with encoding/json
+func (ap *AvroProducer) AddJSONValue(topic string, schema string, key []byte, v interface{}) error {
+	binaryMsg, err := encodeJSONValue(ap.schemaRegistryClient, ap.subjects, topic, false, schema, v)
+	if err != nil {
+		return err
+	}
+	return ap.send(topic, key, binaryMsg)
+}
+
+// AddProto encodes the textual JSON value as the message type of the .proto
+// schema, registered with the PROTOBUF schema type
+func (ap *AvroProducer) AddProto(topic string, schema string, message string, key []byte, value []byte) error {
+	binaryMsg, err := encodeProto(ap.schemaRegistryClient, ap.subjects, topic, false, schema, message, value)
+	if err != nil {
+		return err
+	}
+	return ap.send(topic, key, binaryMsg)
+}
+
+// AddProtoValue is like AddProto for a generated message
+func (ap *AvroProducer) AddProtoValue(topic string, schema string, key []byte, v proto.Message) error {
+	binaryMsg, err := encodeProtoValue(ap.schemaRegistryClient, ap.subjects, topic, false, schema, v)
+	if err != nil {
+		return err
+	}
+	return ap.send(topic, key, binaryMsg)
+}
+
+// encodeAvro registers the schema under the subject of the topic key or value
+// and encodes the textual JSON value with the schema id framing
+func encodeAvro(client *CachedSchemaRegistryClient, subjects *subjectNames, topic string, isKey bool,
+	schema string, value []byte) (*AvroEncoder, error) {
+	avroCodec, schemaId, err := registerAvro(client, subjects, topic, isKey, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	native, _, err := avroCodec.NativeFromTextual(value)
+	if err != nil {
+		return nil, err
+	}
 	// Convert native Go form to binary Avro data
 	binaryValue, err := avroCodec.BinaryFromNative(nil, native)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	binaryMsg := &AvroEncoder{
+	return &AvroEncoder{
 		SchemaID: schemaId,
 		Content:  binaryValue,
+	}, nil
+}
+
+// encodeAvroValue is like encodeAvro for a Go value rather than textual JSON
+func encodeAvroValue(client *CachedSchemaRegistryClient, subjects *subjectNames, topic string, isKey bool,
+	schema string, v interface{}) (*AvroEncoder, error) {
+	avroCodec, schemaId, err := registerAvro(client, subjects, topic, isKey, schema)
+	if err != nil {
+		return nil, err
+	}
+	binaryValue, err := MarshalAvro(avroCodec, v)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroEncoder{
+		SchemaID: schemaId,
+		Content:  binaryValue,
+	}, nil
+}
+
+// avroCodecs caches the codecs of the produced schemas by their text, so that
+// a schema is parsed once rather than for every message
+var avroCodecs sync.Map
+
+// cachedAvroCodec returns the codec of the schema, parsed once
+func cachedAvroCodec(schema string) (*goavro.Codec, error) {
+	if codec, ok := avroCodecs.Load(schema); ok {
+		return codec.(*goavro.Codec), nil
+	}
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, err
+	}
+	avroCodecs.Store(schema, codec)
+	return codec, nil
+}
+
+func registerAvro(client *CachedSchemaRegistryClient, subjects *subjectNames, topic string, isKey bool,
+	schema string) (*goavro.Codec, int, error) {
+	avroCodec, err := cachedAvroCodec(schema)
+	if err != nil {
+		return nil, 0, err
+	}
+	subject, err := subjects.avroSubject(topic, isKey, avroCodec)
+	if err != nil {
+		return nil, 0, err
 	}
-	msg := &sarama.ProducerMessage{
+	schemaId, err := client.CreateSubject(subject, avroCodec)
+	if err != nil {
+		return nil, 0, err
+	}
+	return avroCodec, schemaId, nil
+}
+
+// send sends the encoded value
+func (ap *AvroProducer) send(topic string, key []byte, value *AvroEncoder) error {
+	encoded, err := value.Encode()
+	if err != nil {
+		return err
+	}
+	return ap.producer.Send(&broker.Message{
 		Topic: topic,
-		Key:   sarama.StringEncoder(key),
-		Value: binaryMsg,
+		Key:   key,
+		Value: encoded,
+	})
+}
+
+// Publish sends an already encoded message, the schema id framing of its
+// value is kept as is
+func (ap *AvroProducer) Publish(msg *broker.Message) error {
+	return ap.producer.Send(msg)
+}
+
+// txnProducer returns the producer of the transactions
+func (ap *AvroProducer) txnProducer() (broker.TxnProducer, error) {
+	txn, ok := ap.producer.(broker.TxnProducer)
+	if !ok {
+		return nil, errors.NotSupport("transactions of a non transactional producer")
+	}
+	return txn, nil
+}
+
+// BeginTxn starts a transaction, the messages sent until CommitTxn or
+// AbortTxn belong to it
+func (ap *AvroProducer) BeginTxn() error {
+	txn, err := ap.txnProducer()
+	if err != nil {
+		return err
+	}
+	return txn.BeginTxn()
+}
+
+// CommitTxn atomically commits the messages and offsets of the transaction
+func (ap *AvroProducer) CommitTxn() error {
+	txn, err := ap.txnProducer()
+	if err != nil {
+		return err
+	}
+	return txn.CommitTxn()
+}
+
+// AbortTxn drops the messages and offsets of the transaction
+func (ap *AvroProducer) AbortTxn() error {
+	txn, err := ap.txnProducer()
+	if err != nil {
+		return err
+	}
+	return txn.AbortTxn()
+}
+
+// AddMessageToTxn commits the offset of the consumed message along with the transaction
+func (ap *AvroProducer) AddMessageToTxn(msg *broker.Message, groupId string) error {
+	txn, err := ap.txnProducer()
+	if err != nil {
+		return err
 	}
-	_, _, err = ap.producer.SendMessage(msg)
-	return err
+	return txn.AddMessageToTxn(msg, groupId)
 }
 
 func (ac *AvroProducer) Close() {
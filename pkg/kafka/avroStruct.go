@@ -0,0 +1,642 @@
+package kafka
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+/*
+	Go structs are mapped to Avro records through their `avro:"name"` field tags,
+	the fields without tag use their Go name and `avro:"-"` skips a field.
+	Pointers and interfaces map to the unions with null. The logical types map to:
+		timestamp-millis, timestamp-micros, date	time.Time
+		time-millis, time-micros			time.Duration
+		decimal						*big.Rat, big.Rat, float64 or string
+		uuid						string or [16]byte
+*/
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	ratType      = reflect.TypeOf(big.Rat{})
+	uuidType     = reflect.TypeOf([16]byte{})
+)
+
+// goavro names the union branches of these logical types typeName.logicalType
+var avroLogicalBranches = map[string]bool{
+	"long.timestamp-millis": true,
+	"long.timestamp-micros": true,
+	"int.time-millis":       true,
+	"long.time-micros":      true,
+	"int.date":              true,
+	"bytes.decimal":         true,
+}
+
+// avroNode is a parsed Avro schema, with its named types resolved
+type avroNode struct {
+	kind     string
+	logical  string
+	name     string
+	scale    int
+	fields   []avroField
+	items    *avroNode
+	branches []*avroNode
+}
+
+type avroField struct {
+	name string
+	node *avroNode
+}
+
+// avroSchemas caches the parsed schemas by their canonical text, the codecs
+// of a same schema share its node
+var avroSchemas sync.Map
+
+// schemaOf returns the parsed schema of the codec
+func schemaOf(codec *goavro.Codec) (*avroNode, error) {
+	text := codec.Schema()
+	if node, ok := avroSchemas.Load(text); ok {
+		return node.(*avroNode), nil
+	}
+	var schema interface{}
+	if err := json.Unmarshal([]byte(text), &schema); err != nil {
+		return nil, err
+	}
+	node, err := parseAvroNode(schema, "", make(map[string]*avroNode))
+	if err != nil {
+		return nil, err
+	}
+	avroSchemas.Store(text, node)
+	return node, nil
+}
+
+func parseAvroNode(schema interface{}, namespace string, names map[string]*avroNode) (*avroNode, error) {
+	switch s := schema.(type) {
+	case string:
+		switch s {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroNode{kind: s}, nil
+		}
+		if node, ok := names[fullAvroName(s, namespace)]; ok {
+			return node, nil
+		}
+		if node, ok := names[s]; ok {
+			return node, nil
+		}
+		return nil, errors.InvalidArg("unknown avro type", s)
+	case []interface{}:
+		node := &avroNode{kind: "union"}
+		for _, b := range s {
+			branch, err := parseAvroNode(b, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			node.branches = append(node.branches, branch)
+		}
+		return node, nil
+	case map[string]interface{}:
+		return parseAvroComplex(s, namespace, names)
+	}
+	return nil, errors.InvalidArg("bad avro schema", schema)
+}
+
+func parseAvroComplex(s map[string]interface{}, namespace string, names map[string]*avroNode) (*avroNode, error) {
+	kind, _ := s["type"].(string)
+	logical, _ := s["logicalType"].(string)
+	if _, ok := s["type"].(string); !ok {
+		// {"type": {...}} or {"type": [...]}
+		return parseAvroNode(s["type"], namespace, names)
+	}
+	node := &avroNode{kind: kind, logical: logical}
+	if scale, ok := s["scale"].(float64); ok {
+		node.scale = int(scale)
+	}
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := s["name"].(string)
+		if ns, ok := s["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		node.name = fullAvroName(name, namespace)
+		if i := strings.LastIndex(node.name, "."); i >= 0 {
+			namespace = node.name[:i]
+		}
+		// registered before the fields so that a record can refer to itself
+		names[node.name] = node
+		if kind == "error" {
+			node.kind = "record"
+		}
+		fields, _ := s["fields"].([]interface{})
+		for _, f := range fields {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, errors.InvalidArg("bad avro field", f)
+			}
+			fieldNode, err := parseAvroNode(fm["type"], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			name, _ := fm["name"].(string)
+			node.fields = append(node.fields, avroField{name, fieldNode})
+		}
+	case "array":
+		items, err := parseAvroNode(s["items"], namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		node.items = items
+	case "map":
+		values, err := parseAvroNode(s["values"], namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		node.items = values
+	default:
+		base, err := parseAvroNode(kind, namespace, names)
+		if err != nil {
+			return nil, err
+		}
+		if logical == "" {
+			return base, nil
+		}
+		if base.name != "" {
+			// a logical type over a named type, such as a fixed decimal
+			return &avroNode{kind: base.kind, logical: logical, name: base.name, scale: node.scale}, nil
+		}
+	}
+	return node, nil
+}
+
+func fullAvroName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// branchName is the key goavro uses for the union branch of the node
+func (node *avroNode) branchName() string {
+	if node.name != "" {
+		return node.name
+	}
+	if node.logical != "" && avroLogicalBranches[node.kind+"."+node.logical] {
+		return node.kind + "." + node.logical
+	}
+	return node.kind
+}
+
+// NativeFromStruct converts v, a struct or a pointer to a struct, to the
+// native Go form goavro encodes with the codec
+func NativeFromStruct(codec *goavro.Codec, v interface{}) (interface{}, error) {
+	node, err := schemaOf(codec)
+	if err != nil {
+		return nil, err
+	}
+	return toAvroNative(node, reflect.ValueOf(v))
+}
+
+// StructFromNative fills v, a pointer, with a native Go form decoded by goavro
+func StructFromNative(codec *goavro.Codec, native interface{}, v interface{}) error {
+	node, err := schemaOf(codec)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.InvalidArg("decode avro into a non pointer", reflect.TypeOf(v))
+	}
+	return fromAvroNative(node, native, rv.Elem())
+}
+
+// MarshalAvro encodes v to binary Avro data, without the schema id framing
+func MarshalAvro(codec *goavro.Codec, v interface{}) ([]byte, error) {
+	native, err := NativeFromStruct(codec, v)
+	if err != nil {
+		return nil, err
+	}
+	return codec.BinaryFromNative(nil, native)
+}
+
+// UnmarshalAvro decodes binary Avro data, without the schema id framing, into v
+func UnmarshalAvro(codec *goavro.Codec, b []byte, v interface{}) error {
+	native, _, err := codec.NativeFromBinary(b)
+	if err != nil {
+		return errors.BadData(err)
+	}
+	return StructFromNative(codec, native, v)
+}
+
+func toAvroNative(node *avroNode, v reflect.Value) (interface{}, error) {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			v = reflect.Value{}
+			break
+		}
+		v = v.Elem()
+	}
+	if node.kind == "union" {
+		return unionToAvroNative(node, v)
+	}
+	if node.kind == "null" {
+		return nil, nil
+	}
+	if !v.IsValid() {
+		return nil, errors.InvalidArg("nil value for avro type", node.kind)
+	}
+	t := v.Type()
+	switch node.logical {
+	case "timestamp-millis", "timestamp-micros", "date":
+		if t == timeType {
+			return v.Interface(), nil
+		}
+	case "time-millis", "time-micros":
+		if t == durationType {
+			return time.Duration(v.Int()), nil
+		}
+	case "decimal":
+		return toAvroDecimal(v)
+	case "uuid":
+		if t == uuidType {
+			b := v.Interface().([16]byte)
+			return formatUUID(b[:]), nil
+		}
+	}
+	switch node.kind {
+	case "boolean":
+		if v.Kind() == reflect.Bool {
+			return v.Bool(), nil
+		}
+	case "int", "long":
+		var n int64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = v.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = int64(v.Uint())
+		default:
+			return nil, avroTypeError(node, t)
+		}
+		if node.kind == "int" {
+			return int32(n), nil
+		}
+		return n, nil
+	case "float", "double":
+		var f float64
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			f = v.Float()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f = float64(v.Int())
+		default:
+			return nil, avroTypeError(node, t)
+		}
+		if node.kind == "float" {
+			return float32(f), nil
+		}
+		return f, nil
+	case "string", "enum":
+		if v.Kind() == reflect.String {
+			return v.String(), nil
+		}
+	case "bytes", "fixed":
+		if v.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), nil
+		}
+		if v.Kind() == reflect.Array && t.Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return b, nil
+		}
+	case "array":
+		if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+			items := make([]interface{}, v.Len())
+			for i := range items {
+				item, err := toAvroNative(node.items, v.Index(i))
+				if err != nil {
+					return nil, err
+				}
+				items[i] = item
+			}
+			return items, nil
+		}
+	case "map":
+		if v.Kind() == reflect.Map && t.Key().Kind() == reflect.String {
+			values := make(map[string]interface{}, v.Len())
+			for _, key := range v.MapKeys() {
+				value, err := toAvroNative(node.items, v.MapIndex(key))
+				if err != nil {
+					return nil, err
+				}
+				values[key.String()] = value
+			}
+			return values, nil
+		}
+	case "record":
+		return recordToAvroNative(node, v)
+	}
+	return nil, avroTypeError(node, t)
+}
+
+func unionToAvroNative(node *avroNode, v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		for _, branch := range node.branches {
+			if branch.kind == "null" {
+				return nil, nil
+			}
+		}
+		return nil, errors.InvalidArg("nil value for a union without null")
+	}
+	for _, branch := range node.branches {
+		if branch.kind == "null" {
+			continue
+		}
+		if native, err := toAvroNative(branch, v); err == nil {
+			return map[string]interface{}{branch.branchName(): native}, nil
+		}
+	}
+	return nil, avroTypeError(node, v.Type())
+}
+
+func recordToAvroNative(node *avroNode, v reflect.Value) (interface{}, error) {
+	record := make(map[string]interface{}, len(node.fields))
+	switch v.Kind() {
+	case reflect.Struct:
+		index := avroFieldIndex(v.Type())
+		for _, f := range node.fields {
+			i, ok := index[f.name]
+			var fv reflect.Value
+			if ok {
+				fv = v.Field(i)
+			}
+			native, err := toAvroNative(f.node, fv)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "field %s.%s", node.name, f.name)
+			}
+			record[f.name] = native
+		}
+	case reflect.Map:
+		for _, f := range node.fields {
+			native, err := toAvroNative(f.node, v.MapIndex(reflect.ValueOf(f.name)))
+			if err != nil {
+				return nil, errors.WithMessagef(err, "field %s.%s", node.name, f.name)
+			}
+			record[f.name] = native
+		}
+	default:
+		return nil, avroTypeError(node, v.Type())
+	}
+	return record, nil
+}
+
+func toAvroDecimal(v reflect.Value) (interface{}, error) {
+	switch {
+	case v.Type() == ratType:
+		r := v.Interface().(big.Rat)
+		return &r, nil
+	case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+		return new(big.Rat).SetFloat64(v.Float()), nil
+	case v.Kind() == reflect.String:
+		r, ok := new(big.Rat).SetString(v.String())
+		if !ok {
+			return nil, errors.InvalidArg("bad decimal", v.String())
+		}
+		return r, nil
+	}
+	return nil, errors.InvalidType("decimal from", v.Type())
+}
+
+func fromAvroNative(node *avroNode, native interface{}, v reflect.Value) error {
+	if node.kind == "union" {
+		if native == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		m, ok := native.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return errors.BadData("bad avro union value", native)
+		}
+		for name, value := range m {
+			for _, branch := range node.branches {
+				if branch.branchName() == name {
+					return fromAvroNative(branch, value, v)
+				}
+			}
+			return errors.BadData("unknown avro union branch", name)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if native == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.Type() == reflect.PtrTo(ratType) {
+			if r, ok := native.(*big.Rat); ok {
+				v.Set(reflect.ValueOf(r))
+				return nil
+			}
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return fromAvroNative(node, native, v.Elem())
+	case reflect.Interface:
+		if native == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(native))
+		}
+		return nil
+	}
+	if native == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	t := v.Type()
+	switch n := native.(type) {
+	case time.Time:
+		if t == timeType {
+			v.Set(reflect.ValueOf(n))
+			return nil
+		}
+	case time.Duration:
+		if t == durationType {
+			v.SetInt(int64(n))
+			return nil
+		}
+	case *big.Rat:
+		switch {
+		case t == ratType:
+			v.Set(reflect.ValueOf(*n))
+			return nil
+		case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+			f, _ := n.Float64()
+			v.SetFloat(f)
+			return nil
+		case v.Kind() == reflect.String:
+			v.SetString(n.FloatString(node.scale))
+			return nil
+		}
+	case bool:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(n)
+			return nil
+		}
+	case int32, int64:
+		i := reflect.ValueOf(n).Int()
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			v.SetInt(i)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetUint(uint64(i))
+			return nil
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(i))
+			return nil
+		}
+	case float32, float64:
+		if v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64 {
+			v.SetFloat(reflect.ValueOf(n).Float())
+			return nil
+		}
+	case string:
+		if v.Kind() == reflect.String {
+			v.SetString(n)
+			return nil
+		}
+		if t == uuidType {
+			b, err := parseUUID(n)
+			if err != nil {
+				return err
+			}
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+	case []byte:
+		if v.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), n...))
+			return nil
+		}
+		if v.Kind() == reflect.Array && t.Elem().Kind() == reflect.Uint8 && v.Len() == len(n) {
+			reflect.Copy(v, reflect.ValueOf(n))
+			return nil
+		}
+	case []interface{}:
+		if v.Kind() == reflect.Slice {
+			s := reflect.MakeSlice(t, len(n), len(n))
+			for i, item := range n {
+				if err := fromAvroNative(node.items, item, s.Index(i)); err != nil {
+					return err
+				}
+			}
+			v.Set(s)
+			return nil
+		}
+	case map[string]interface{}:
+		if node.kind == "record" {
+			return recordFromAvroNative(node, n, v)
+		}
+		if v.Kind() == reflect.Map && t.Key().Kind() == reflect.String {
+			m := reflect.MakeMapWithSize(t, len(n))
+			for key, value := range n {
+				item := reflect.New(t.Elem()).Elem()
+				if err := fromAvroNative(node.items, value, item); err != nil {
+					return err
+				}
+				m.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), item)
+			}
+			v.Set(m)
+			return nil
+		}
+	}
+	return errors.InvalidType(fmt.Sprintf("cannot decode avro %s %T into %s", node.kind, native, t))
+}
+
+func recordFromAvroNative(node *avroNode, record map[string]interface{}, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		index := avroFieldIndex(v.Type())
+		for _, f := range node.fields {
+			i, ok := index[f.name]
+			if !ok {
+				continue
+			}
+			if err := fromAvroNative(f.node, record[f.name], v.Field(i)); err != nil {
+				return errors.WithMessagef(err, "field %s.%s", node.name, f.name)
+			}
+		}
+		return nil
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, f := range node.fields {
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := fromAvroNative(f.node, record[f.name], item); err != nil {
+				return errors.WithMessagef(err, "field %s.%s", node.name, f.name)
+			}
+			v.SetMapIndex(reflect.ValueOf(f.name), item)
+		}
+		return nil
+	}
+	return errors.InvalidType("cannot decode avro record into", v.Type())
+}
+
+var avroFieldIndexes sync.Map
+
+// avroFieldIndex maps the avro field names to the struct field indexes
+func avroFieldIndex(t reflect.Type) map[string]int {
+	if index, ok := avroFieldIndexes.Load(t); ok {
+		return index.(map[string]int)
+	}
+	index := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("avro"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag = strings.Split(tag, ",")[0]; tag != "" {
+				name = tag
+			}
+		}
+		index[name] = i
+	}
+	avroFieldIndexes.Store(t, index)
+	return index
+}
+
+func avroTypeError(node *avroNode, t reflect.Type) error {
+	kind := node.kind
+	if node.logical != "" {
+		kind += "." + node.logical
+	}
+	return errors.InvalidType(fmt.Sprintf("cannot encode %s as avro %s", t, kind))
+}
+
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+func parseUUID(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return nil, errors.BadData("bad uuid", s)
+	}
+	return b, nil
+}
@@ -0,0 +1,252 @@
+package kafka
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+const carSchema = `{
+	"type": "record",
+	"name": "Car",
+	"namespace": "test",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "model", "type": "string"},
+		{"name": "owner", "type": ["null", {
+			"type": "record",
+			"name": "Owner",
+			"fields": [
+				{"name": "name", "type": "string"},
+				{"name": "age", "type": "int"}
+			]
+		}]},
+		{"name": "nickname", "type": ["null", "string"]},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "options", "type": {"type": "map", "values": "double"}},
+		{"name": "registered", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "price", "type": {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2}},
+		{"name": "serial", "type": {"type": "string", "logicalType": "uuid"}},
+		{"name": "previous", "type": ["null", "test.Car"]}
+	]
+}`
+
+type testOwner struct {
+	Name string `avro:"name"`
+	Age  int    `avro:"age"`
+}
+
+type testCar struct {
+	ID         int64              `avro:"id"`
+	Model      string             `avro:"model"`
+	Owner      *testOwner         `avro:"owner"`
+	Nickname   *string            `avro:"nickname"`
+	Tags       []string           `avro:"tags"`
+	Options    map[string]float64 `avro:"options"`
+	Registered time.Time          `avro:"registered"`
+	Price      string             `avro:"price"`
+	Serial     [16]byte           `avro:"serial"`
+	Previous   *testCar           `avro:"previous"`
+	// Ignored and unexported are not part of the record
+	Ignored    string `avro:"-"`
+	unexported string
+}
+
+func newTestCodec(t *testing.T, schema string) *goavro.Codec {
+	t.Helper()
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+func roundTrip(t *testing.T, codec *goavro.Codec, in, out interface{}) {
+	t.Helper()
+	b, err := MarshalAvro(codec, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UnmarshalAvro(codec, b, out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAvroStructRoundTrip(t *testing.T) {
+	codec := newTestCodec(t, carSchema)
+	nickname := "bolt"
+	in := testCar{
+		ID:         7,
+		Model:      "roadster",
+		Owner:      &testOwner{Name: "ann", Age: 42},
+		Nickname:   &nickname,
+		Tags:       []string{"red", "fast"},
+		Options:    map[string]float64{"roof": 1.5},
+		Registered: time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC),
+		Price:      "12345.67",
+		Serial:     [16]byte{0x12, 0x34, 15: 0xff},
+		// the empty arrays and maps decode as empty rather than nil
+		Previous: &testCar{ID: 6, Model: "sedan", Tags: []string{}, Options: map[string]float64{},
+			Registered: time.Unix(0, 0).UTC(), Price: "1.00"},
+		Ignored:    "ignored",
+		unexported: "unexported",
+	}
+	var out testCar
+	roundTrip(t, codec, &in, &out)
+
+	if out.Ignored != "" || out.unexported != "" {
+		t.Fatalf("skipped fields decoded: %q %q", out.Ignored, out.unexported)
+	}
+	in.Ignored, in.unexported = "", ""
+	out.Registered = out.Registered.UTC()
+	out.Previous.Registered = out.Previous.Registered.UTC()
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("decoded %+v, want %+v", out, in)
+	}
+}
+
+func TestAvroStructNullUnions(t *testing.T) {
+	codec := newTestCodec(t, carSchema)
+	in := testCar{ID: 1, Model: "van", Price: "0.50"}
+	out := testCar{Owner: &testOwner{Name: "stale"}, Nickname: new(string)}
+	roundTrip(t, codec, in, &out)
+	if out.Owner != nil || out.Nickname != nil || out.Previous != nil {
+		t.Fatalf("null unions decoded as %+v %v %+v", out.Owner, out.Nickname, out.Previous)
+	}
+	if len(out.Tags) != 0 || len(out.Options) != 0 {
+		t.Fatalf("empty collections decoded as %v %v", out.Tags, out.Options)
+	}
+}
+
+func TestAvroStructDecodeIntoMap(t *testing.T) {
+	codec := newTestCodec(t, `{"type": "record", "name": "Point", "fields": [
+		{"name": "x", "type": "int"}, {"name": "y", "type": "int"}]}`)
+	var out map[string]int
+	roundTrip(t, codec, map[string]interface{}{"x": 1, "y": 2}, &out)
+	if out["x"] != 1 || out["y"] != 2 {
+		t.Fatalf("decoded %v", out)
+	}
+}
+
+func TestAvroStructDecimalTypes(t *testing.T) {
+	codec := newTestCodec(t, `{"type": "record", "name": "Amount", "fields": [
+		{"name": "value", "type": {"type": "bytes", "logicalType": "decimal", "precision": 8, "scale": 3}}]}`)
+	var rat struct {
+		Value *big.Rat `avro:"value"`
+	}
+	roundTrip(t, codec, struct {
+		Value float64 `avro:"value"`
+	}{2.5}, &rat)
+	if rat.Value == nil || rat.Value.Cmp(big.NewRat(5, 2)) != 0 {
+		t.Fatalf("decoded %v, want 5/2", rat.Value)
+	}
+}
+
+func TestAvroStructErrors(t *testing.T) {
+	codec := newTestCodec(t, carSchema)
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"string as long", struct {
+			ID string `avro:"id"`
+		}{"seven"}},
+		{"missing field", struct {
+			ID int64 `avro:"id"`
+		}{7}},
+		{"not a record", 42},
+		{"bad decimal", testCar{Model: "m", Price: "twelve"}},
+		{"nil pointer", (*testCar)(nil)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := MarshalAvro(codec, test.v); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestAvroStructDecodeErrors(t *testing.T) {
+	codec := newTestCodec(t, carSchema)
+	b, err := MarshalAvro(codec, testCar{ID: 1, Model: "van", Price: "1.00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var car testCar
+	if err := UnmarshalAvro(codec, b, car); !errors.IsInvalidArg(err) {
+		t.Errorf("decode into a non pointer: %v", err)
+	}
+	var mismatch struct {
+		Model int `avro:"model"`
+	}
+	if err := UnmarshalAvro(codec, b, &mismatch); !errors.IsInvalidType(err) {
+		t.Errorf("decode a string into an int: %v", err)
+	}
+	if err := UnmarshalAvro(codec, b[:3], &car); !errors.IsBadData(err) {
+		t.Errorf("decode truncated data: %v", err)
+	}
+	var serial struct {
+		Serial string `avro:"serial"`
+	}
+	if err := UnmarshalAvro(codec, b, &serial); err != nil {
+		t.Errorf("decode an uuid into a string: %v", err)
+	}
+}
+
+func syncMapLen(m *sync.Map) int {
+	n := 0
+	m.Range(func(interface{}, interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestProducedSchemasAreParsedOnce(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer registry.Close()
+	client := NewCachedSchemaRegistryClient([]string{registry.URL})
+	subjects, err := newSubjectNames(TopicNameStrategy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func() {
+		t.Helper()
+		car := testCar{ID: 1, Model: "van", Price: "1.00"}
+		if _, err := encodeAvroValue(client, subjects, "cars", false, carSchema, car); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encode()
+	codecs, schemas := syncMapLen(&avroCodecs), syncMapLen(&avroSchemas)
+	for i := 0; i < 100; i++ {
+		encode()
+	}
+	if n := syncMapLen(&avroCodecs); n != codecs {
+		t.Errorf("%d cached codecs after 100 messages, want %d", n, codecs)
+	}
+	if n := syncMapLen(&avroSchemas); n != schemas {
+		t.Errorf("%d cached schemas after 100 messages, want %d", n, schemas)
+	}
+
+	// the codecs of a same schema share its parsed node
+	first, err := schemaOf(newTestCodec(t, carSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, err := schemaOf(newTestCodec(t, carSchema)); err != nil || second != first {
+		t.Fatalf("schema of another codec %p, %v, want %p", second, err, first)
+	}
+}
@@ -1,9 +1,12 @@
 package kafka
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/linkedin/goavro/v2"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
 )
 
 // CachedSchemaRegistryClient is a schema registry client that will cache some data to improve performance
@@ -11,29 +14,116 @@ type CachedSchemaRegistryClient struct {
 	SchemaRegistryClient *SchemaRegistryClient
 	schemaCache          map[int]*goavro.Codec
 	schemaCacheLock      sync.RWMutex
+	rawSchemaCache       map[int]*RawSchema
+	rawSchemaCacheLock   sync.RWMutex
 	schemaIdCache        map[string]int
 	schemaIdCacheLock    sync.RWMutex
+	// store writes the fetched schemas through to disk when set
+	store *schemaStore
+
+	// lookups caches the subject lookups and the not found ids
+	lookups     *lookupCache
+	flights     flightGroup
+	counters    cacheCounters
+	latestTTL   time.Duration
+	negativeTTL time.Duration
 }
 
 func NewCachedSchemaRegistryClient(connect []string) *CachedSchemaRegistryClient {
-	SchemaRegistryClient := NewSchemaRegistryClient(connect)
-	return &CachedSchemaRegistryClient{SchemaRegistryClient: SchemaRegistryClient, schemaCache: make(map[int]*goavro.Codec), schemaIdCache: make(map[string]int)}
+	return newCachedClient(NewSchemaRegistryClient(connect))
 }
 
 func NewCachedSchemaRegistryClientWithRetries(connect []string, retries int) *CachedSchemaRegistryClient {
-	SchemaRegistryClient := NewSchemaRegistryClientWithRetries(connect, retries)
-	return &CachedSchemaRegistryClient{SchemaRegistryClient: SchemaRegistryClient, schemaCache: make(map[int]*goavro.Codec), schemaIdCache: make(map[string]int)}
+	return newCachedClient(NewSchemaRegistryClientWithRetries(connect, retries))
+}
+
+// NewCachedSchemaRegistryClientWithOptions creates a cached client with authentication and TLS
+func NewCachedSchemaRegistryClientWithOptions(connect []string, opts SchemaRegistryOptions) *CachedSchemaRegistryClient {
+	client := newCachedClient(NewSchemaRegistryClientWithOptions(connect, opts))
+	if opts.LatestTTL > 0 {
+		client.latestTTL = opts.LatestTTL
+	}
+	if opts.NegativeTTL > 0 {
+		client.negativeTTL = opts.NegativeTTL
+	}
+	return client
+}
+
+func newCachedClient(SchemaRegistryClient *SchemaRegistryClient) *CachedSchemaRegistryClient {
+	return &CachedSchemaRegistryClient{SchemaRegistryClient: SchemaRegistryClient, schemaCache: make(map[int]*goavro.Codec),
+		rawSchemaCache: make(map[int]*RawSchema), schemaIdCache: make(map[string]int),
+		lookups: newLookupCache(), latestTTL: defaultLatestTTL, negativeTTL: defaultNegativeTTL}
+}
+
+// newRegistryClient creates the cached client of the servers with the
+// kafka.schemaRegistry options
+func newRegistryClient(servers []string) (*CachedSchemaRegistryClient, error) {
+	opts, err := LoadSchemaRegistryOptions()
+	if err != nil {
+		return nil, err
+	}
+	client := NewCachedSchemaRegistryClientWithOptions(servers, opts)
+	if opts.CacheDir != "" {
+		if err := client.UseCacheDir(opts.CacheDir); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// UseCacheDir loads the schemas cached in the directory and writes the next
+// fetched schemas through to it, the known schemas are then decoded while the
+// registry is down
+func (client *CachedSchemaRegistryClient) UseCacheDir(dir string) error {
+	store, err := openSchemaStore(dir)
+	if err != nil {
+		return err
+	}
+	schemas, err := store.loadSchemas()
+	if err != nil {
+		return err
+	}
+	ids, err := store.loadSubjects()
+	if err != nil {
+		return err
+	}
+	client.rawSchemaCacheLock.Lock()
+	for id, schema := range schemas {
+		client.rawSchemaCache[id] = schema
+	}
+	client.rawSchemaCacheLock.Unlock()
+	client.schemaIdCacheLock.Lock()
+	for key, id := range ids {
+		client.schemaIdCache[key] = id
+	}
+	client.schemaIdCacheLock.Unlock()
+	client.store = store
+	log.Infof("loaded %d schemas and %d subject schemas from %s", len(schemas), len(ids), dir)
+	return nil
 }
 
 // GetSchema will return and cache the codec with the given id
 func (client *CachedSchemaRegistryClient) GetSchema(id int) (*goavro.Codec, error) {
+	return client.GetSchemaContext(context.Background(), id)
+}
+
+// GetSchemaContext is like GetSchema with a context
+func (client *CachedSchemaRegistryClient) GetSchemaContext(ctx context.Context, id int) (*goavro.Codec, error) {
 	client.schemaCacheLock.RLock()
 	cachedResult := client.schemaCache[id]
 	client.schemaCacheLock.RUnlock()
 	if nil != cachedResult {
+		client.counters.hit()
 		return cachedResult, nil
 	}
-	codec, err := client.SchemaRegistryClient.GetSchema(id)
+	schema, err := client.GetRawSchemaContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if schema.Type() != SchemaTypeAvro {
+		return nil, errors.InvalidType("schema", id, "is a", schema.Type(), "schema")
+	}
+	codec, err := goavro.NewCodec(schema.Schema)
 	if err != nil {
 		return nil, err
 	}
@@ -43,56 +133,292 @@ func (client *CachedSchemaRegistryClient) GetSchema(id int) (*goavro.Codec, erro
 	return codec, nil
 }
 
+// GetRawSchema will return and cache the schema of any type with the given id
+func (client *CachedSchemaRegistryClient) GetRawSchema(id int) (*RawSchema, error) {
+	return client.GetRawSchemaContext(context.Background(), id)
+}
+
+// GetRawSchemaContext is like GetRawSchema with a context
+func (client *CachedSchemaRegistryClient) GetRawSchemaContext(ctx context.Context, id int) (*RawSchema, error) {
+	client.rawSchemaCacheLock.RLock()
+	cachedResult := client.rawSchemaCache[id]
+	client.rawSchemaCacheLock.RUnlock()
+	if nil != cachedResult {
+		client.counters.hit()
+		return cachedResult, nil
+	}
+	schema, err := client.lookup(ctx, lookupKey{kind: lookupId, id: id}, -1, func(ctx context.Context) (interface{}, error) {
+		schema, err := client.SchemaRegistryClient.GetRawSchemaContext(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		client.rawSchemaCacheLock.Lock()
+		client.rawSchemaCache[id] = schema
+		client.rawSchemaCacheLock.Unlock()
+		if client.store != nil {
+			if err := client.store.putSchema(id, schema); err != nil {
+				log.Warnf("cannot cache schema %d: %s", id, err)
+			}
+		}
+		return schema, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schema.(*RawSchema), nil
+}
+
 // GetSubjects returns a list of subjects
 func (client *CachedSchemaRegistryClient) GetSubjects() ([]string, error) {
-	return client.SchemaRegistryClient.GetSubjects()
+	return client.GetSubjectsContext(context.Background())
+}
+
+// GetSubjectsContext is like GetSubjects with a context
+func (client *CachedSchemaRegistryClient) GetSubjectsContext(ctx context.Context) ([]string, error) {
+	return client.SchemaRegistryClient.GetSubjectsContext(ctx)
 }
 
 // GetVersions returns a list of all versions of a subject
 func (client *CachedSchemaRegistryClient) GetVersions(subject string) ([]int, error) {
-	return client.SchemaRegistryClient.GetVersions(subject)
+	return client.GetVersionsContext(context.Background(), subject)
+}
+
+// GetVersionsContext is like GetVersions with a context
+func (client *CachedSchemaRegistryClient) GetVersionsContext(ctx context.Context, subject string) ([]int, error) {
+	versions, err := client.lookup(ctx, lookupKey{kind: lookupVersions, subject: subject}, client.latestTTL, func(ctx context.Context) (interface{}, error) {
+		return client.SchemaRegistryClient.GetVersionsContext(ctx, subject)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions.([]int), nil
 }
 
 // GetSchemaByVersion returns the codec for a specific version of a subject
 func (client *CachedSchemaRegistryClient) GetSchemaByVersion(subject string, version int) (*goavro.Codec, error) {
-	return client.SchemaRegistryClient.GetSchemaByVersion(subject, version)
+	return client.GetSchemaByVersionContext(context.Background(), subject, version)
+}
+
+// GetSchemaByVersionContext is like GetSchemaByVersion with a context
+func (client *CachedSchemaRegistryClient) GetSchemaByVersionContext(ctx context.Context, subject string, version int) (*goavro.Codec, error) {
+	// a version of a subject never changes
+	codec, err := client.lookup(ctx, lookupKey{kind: lookupVersion, subject: subject, id: version}, 0, func(ctx context.Context) (interface{}, error) {
+		return client.SchemaRegistryClient.GetSchemaByVersionContext(ctx, subject, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codec.(*goavro.Codec), nil
 }
 
 // GetLatestSchema returns the highest version schema for a subject
 func (client *CachedSchemaRegistryClient) GetLatestSchema(subject string) (*goavro.Codec, error) {
-	return client.SchemaRegistryClient.GetLatestSchema(subject)
+	return client.GetLatestSchemaContext(context.Background(), subject)
 }
 
-// CreateSubject will return and cache the id with the given codec
+// GetLatestSchemaContext is like GetLatestSchema with a context
+func (client *CachedSchemaRegistryClient) GetLatestSchemaContext(ctx context.Context, subject string) (*goavro.Codec, error) {
+	codec, err := client.lookup(ctx, lookupKey{kind: lookupLatest, subject: subject}, client.latestTTL, func(ctx context.Context) (interface{}, error) {
+		return client.SchemaRegistryClient.GetLatestSchemaContext(ctx, subject)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codec.(*goavro.Codec), nil
+}
+
+// CreateSubject will return and cache the id with the given codec, the schema
+// is registered once per subject
 func (client *CachedSchemaRegistryClient) CreateSubject(subject string, codec *goavro.Codec) (int, error) {
-	schemaJson := codec.Schema()
-	client.schemaIdCacheLock.RLock()
-	cachedResult, found := client.schemaIdCache[schemaJson]
-	client.schemaIdCacheLock.RUnlock()
-	if found {
-		return cachedResult, nil
+	return client.CreateSubjectContext(context.Background(), subject, codec)
+}
+
+// CreateSubjectContext is like CreateSubject with a context
+func (client *CachedSchemaRegistryClient) CreateSubjectContext(ctx context.Context, subject string, codec *goavro.Codec) (int, error) {
+	return client.CreateRawSubjectContext(ctx, subject, &RawSchema{Schema: codec.Schema()})
+}
+
+// CreateRawSubject is like CreateSubject for a schema of any type
+func (client *CachedSchemaRegistryClient) CreateRawSubject(subject string, schema *RawSchema) (int, error) {
+	return client.CreateRawSubjectContext(context.Background(), subject, schema)
+}
+
+// CreateRawSubjectContext is like CreateRawSubject with a context
+func (client *CachedSchemaRegistryClient) CreateRawSubjectContext(ctx context.Context, subject string, schema *RawSchema) (int, error) {
+	if id, found := client.cachedSchemaId(subject, schema); found {
+		client.counters.hit()
+		return id, nil
+	}
+	key := lookupKey{kind: lookupCreate, subject: subject, schema: schemaKey(subject, schema)}
+	id, err, shared := client.flights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		client.counters.miss()
+		id, err := client.SchemaRegistryClient.CreateRawSubjectContext(ctx, subject, schema)
+		if err != nil {
+			return 0, err
+		}
+		// the schema may be a new version of the subject
+		client.lookups.dropSubject(subject)
+		client.cacheSchemaId(subject, schema, id)
+		return id, nil
+	})
+	if shared {
+		client.counters.sharedFlight()
 	}
-	id, err := client.SchemaRegistryClient.CreateSubject(subject, codec)
 	if err != nil {
 		return 0, err
 	}
+	return id.(int), nil
+}
+
+func (client *CachedSchemaRegistryClient) cachedSchemaId(subject string, schema *RawSchema) (int, bool) {
+	client.schemaIdCacheLock.RLock()
+	defer client.schemaIdCacheLock.RUnlock()
+	id, found := client.schemaIdCache[schemaKey(subject, schema)]
+	return id, found
+}
+
+func (client *CachedSchemaRegistryClient) cacheSchemaId(subject string, schema *RawSchema, id int) {
 	client.schemaIdCacheLock.Lock()
-	client.schemaIdCache[schemaJson] = id
+	client.schemaIdCache[schemaKey(subject, schema)] = id
 	client.schemaIdCacheLock.Unlock()
-	return id, nil
+	if client.store != nil {
+		if err := client.store.putSubject(subject, schema, id); err != nil {
+			log.Warnf("cannot cache schema %d of subject %s: %s", id, subject, err)
+		}
+	}
 }
 
 // IsSchemaRegistered checks if a specific codec is already registered to a subject
 func (client *CachedSchemaRegistryClient) IsSchemaRegistered(subject string, codec *goavro.Codec) (int, error) {
-	return client.SchemaRegistryClient.IsSchemaRegistered(subject, codec)
+	return client.IsSchemaRegisteredContext(context.Background(), subject, codec)
+}
+
+// IsSchemaRegisteredContext is like IsSchemaRegistered with a context
+func (client *CachedSchemaRegistryClient) IsSchemaRegisteredContext(ctx context.Context, subject string, codec *goavro.Codec) (int, error) {
+	return client.IsRawSchemaRegisteredContext(ctx, subject, &RawSchema{Schema: codec.Schema()})
+}
+
+// IsRawSchemaRegistered checks if a schema of any type is already registered to a subject,
+// the found ids are cached
+func (client *CachedSchemaRegistryClient) IsRawSchemaRegistered(subject string, schema *RawSchema) (int, error) {
+	return client.IsRawSchemaRegisteredContext(context.Background(), subject, schema)
+}
+
+// IsRawSchemaRegisteredContext is like IsRawSchemaRegistered with a context
+func (client *CachedSchemaRegistryClient) IsRawSchemaRegisteredContext(ctx context.Context, subject string, schema *RawSchema) (int, error) {
+	if id, found := client.cachedSchemaId(subject, schema); found {
+		client.counters.hit()
+		return id, nil
+	}
+	key := lookupKey{kind: lookupRegistered, subject: subject, schema: schemaKey(subject, schema)}
+	id, err := client.lookup(ctx, key, -1, func(ctx context.Context) (interface{}, error) {
+		id, err := client.SchemaRegistryClient.IsRawSchemaRegisteredContext(ctx, subject, schema)
+		if err != nil {
+			return 0, err
+		}
+		client.cacheSchemaId(subject, schema, id)
+		return id, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id.(int), nil
+}
+
+// IsCompatible tests if the codec is compatible with the latest version of the subject
+func (client *CachedSchemaRegistryClient) IsCompatible(subject string, codec *goavro.Codec) (bool, error) {
+	return client.IsCompatibleContext(context.Background(), subject, codec)
+}
+
+// IsCompatibleContext is like IsCompatible with a context
+func (client *CachedSchemaRegistryClient) IsCompatibleContext(ctx context.Context, subject string, codec *goavro.Codec) (bool, error) {
+	return client.SchemaRegistryClient.IsCompatibleContext(ctx, subject, codec)
+}
+
+// IsCompatibleWithVersion tests if the codec is compatible with the version of the subject
+func (client *CachedSchemaRegistryClient) IsCompatibleWithVersion(subject string, version int, codec *goavro.Codec) (bool, error) {
+	return client.IsCompatibleWithVersionContext(context.Background(), subject, version, codec)
+}
+
+// IsCompatibleWithVersionContext is like IsCompatibleWithVersion with a context
+func (client *CachedSchemaRegistryClient) IsCompatibleWithVersionContext(ctx context.Context, subject string, version int, codec *goavro.Codec) (bool, error) {
+	return client.SchemaRegistryClient.IsCompatibleWithVersionContext(ctx, subject, version, codec)
+}
+
+// TestCompatibility tests if the schema of any type is compatible with the version of the subject
+func (client *CachedSchemaRegistryClient) TestCompatibility(subject string, version string, schema *RawSchema) (*CompatibilityResult, error) {
+	return client.TestCompatibilityContext(context.Background(), subject, version, schema)
+}
+
+// TestCompatibilityContext is like TestCompatibility with a context
+func (client *CachedSchemaRegistryClient) TestCompatibilityContext(ctx context.Context, subject string, version string, schema *RawSchema) (*CompatibilityResult, error) {
+	return client.SchemaRegistryClient.TestCompatibilityContext(ctx, subject, version, schema)
+}
+
+// GetCompatibilityLevel returns the global compatibility level
+func (client *CachedSchemaRegistryClient) GetCompatibilityLevel() (string, error) {
+	return client.GetCompatibilityLevelContext(context.Background())
+}
+
+// GetCompatibilityLevelContext is like GetCompatibilityLevel with a context
+func (client *CachedSchemaRegistryClient) GetCompatibilityLevelContext(ctx context.Context) (string, error) {
+	return client.SchemaRegistryClient.GetCompatibilityLevelContext(ctx)
+}
+
+// SetCompatibilityLevel sets the global compatibility level
+func (client *CachedSchemaRegistryClient) SetCompatibilityLevel(level string) error {
+	return client.SetCompatibilityLevelContext(context.Background(), level)
+}
+
+// SetCompatibilityLevelContext is like SetCompatibilityLevel with a context
+func (client *CachedSchemaRegistryClient) SetCompatibilityLevelContext(ctx context.Context, level string) error {
+	return client.SchemaRegistryClient.SetCompatibilityLevelContext(ctx, level)
+}
+
+// GetSubjectCompatibilityLevel returns the compatibility level of the subject
+func (client *CachedSchemaRegistryClient) GetSubjectCompatibilityLevel(subject string) (string, error) {
+	return client.GetSubjectCompatibilityLevelContext(context.Background(), subject)
+}
+
+// GetSubjectCompatibilityLevelContext is like GetSubjectCompatibilityLevel with a context
+func (client *CachedSchemaRegistryClient) GetSubjectCompatibilityLevelContext(ctx context.Context, subject string) (string, error) {
+	return client.SchemaRegistryClient.GetSubjectCompatibilityLevelContext(ctx, subject)
+}
+
+// SetSubjectCompatibilityLevel sets the compatibility level of the subject
+func (client *CachedSchemaRegistryClient) SetSubjectCompatibilityLevel(subject string, level string) error {
+	return client.SetSubjectCompatibilityLevelContext(context.Background(), subject, level)
+}
+
+// SetSubjectCompatibilityLevelContext is like SetSubjectCompatibilityLevel with a context
+func (client *CachedSchemaRegistryClient) SetSubjectCompatibilityLevelContext(ctx context.Context, subject string, level string) error {
+	return client.SchemaRegistryClient.SetSubjectCompatibilityLevelContext(ctx, subject, level)
 }
 
 // DeleteSubject deletes the subject, should only be used in development
 func (client *CachedSchemaRegistryClient) DeleteSubject(subject string) error {
-	return client.SchemaRegistryClient.DeleteSubject(subject)
+	return client.DeleteSubjectContext(context.Background(), subject)
+}
+
+// DeleteSubjectContext is like DeleteSubject with a context
+func (client *CachedSchemaRegistryClient) DeleteSubjectContext(ctx context.Context, subject string) error {
+	if err := client.SchemaRegistryClient.DeleteSubjectContext(ctx, subject); err != nil {
+		return err
+	}
+	client.lookups.dropSubject(subject)
+	return nil
 }
 
 // DeleteVersion deletes the a specific version of a subject, should only be used in development.
 func (client *CachedSchemaRegistryClient) DeleteVersion(subject string, version int) error {
-	return client.SchemaRegistryClient.DeleteVersion(subject, version)
+	return client.DeleteVersionContext(context.Background(), subject, version)
+}
+
+// DeleteVersionContext is like DeleteVersion with a context
+func (client *CachedSchemaRegistryClient) DeleteVersionContext(ctx context.Context, subject string, version int) error {
+	if err := client.SchemaRegistryClient.DeleteVersionContext(ctx, subject, version); err != nil {
+		return err
+	}
+	client.lookups.dropSubject(subject)
+	return nil
 }
@@ -0,0 +1,116 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// CommitMode tells when the consumed offsets are marked and committed
+type CommitMode string
+
+const (
+	// CommitAuto marks a message as soon as it is claimed and lets the
+	// consumer commit in the background, a crash mid-job loses the job
+	CommitAuto CommitMode = "auto"
+	// CommitMarkAfterSuccess marks a message once its job succeeded and lets
+	// consumer commit in the background
+	CommitMarkAfterSuccess CommitMode = "mark-after-success"
+	// CommitSync marks a message once its job succeeded and commits the marked
+	// offsets explicitly every batch of messages or interval, and when the
+	// session ends, giving an at-least-once guarantee
+	CommitSync CommitMode = "sync"
+)
+
+const (
+	defaultCommitBatch    = 100
+	defaultCommitInterval = time.Second
+)
+
+// ParseCommitMode parses the kafka.commit.mode config value, the default is
+// CommitMarkAfterSuccess
+func ParseCommitMode(mode string) (CommitMode, error) {
+	switch CommitMode(mode) {
+	case "":
+		return CommitMarkAfterSuccess, nil
+	case CommitAuto, CommitMarkAfterSuccess, CommitSync:
+		return CommitMode(mode), nil
+	}
+	return "", errors.InvalidArg("unknown commit mode", mode)
+}
+
+// committer commits the offsets marked in a session in CommitSync mode
+type committer struct {
+	session  broker.Session
+	batch    int
+	interval time.Duration
+
+	mu     sync.Mutex
+	marked int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newCommitter(session broker.Session, batch int, interval time.Duration) *committer {
+	if batch <= 0 {
+		batch = defaultCommitBatch
+	}
+	if interval <= 0 {
+		interval = defaultCommitInterval
+	}
+	c := &committer{
+		session:  session,
+		batch:    batch,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.loop()
+	return c
+}
+
+func (c *committer) loop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.commit()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// mark records n newly marked messages, committing once a batch is reached
+func (c *committer) mark(n int) {
+	c.mu.Lock()
+	c.marked += n
+	full := c.marked >= c.batch
+	c.mu.Unlock()
+	if full {
+		c.commit()
+	}
+}
+
+// commit synchronously commits the marked offsets, if any
+func (c *committer) commit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.marked == 0 {
+		return
+	}
+	c.session.Commit()
+	c.marked = 0
+}
+
+// close stops the interval commits and commits the last marked offsets
+func (c *committer) close() {
+	close(c.stop)
+	c.wg.Wait()
+	c.commit()
+}
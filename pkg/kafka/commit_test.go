@@ -0,0 +1,96 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+func TestParseCommitMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		want CommitMode
+	}{
+		{"", CommitMarkAfterSuccess},
+		{"auto", CommitAuto},
+		{"mark-after-success", CommitMarkAfterSuccess},
+		{"sync", CommitSync},
+	}
+	for _, test := range tests {
+		if mode, err := ParseCommitMode(test.mode); err != nil || mode != test.want {
+			t.Errorf("ParseCommitMode(%q) = %q, %v, want %q", test.mode, mode, err, test.want)
+		}
+	}
+	if _, err := ParseCommitMode("manual"); !errors.IsInvalidArg(err) {
+		t.Errorf("unknown commit mode: %v", err)
+	}
+}
+
+func TestCommitAutoMarksClaimedJobs(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	conf.Set("kafka.commit.mode", string(CommitAuto))
+	produceJobs(t, h.producer(), "jobs", 0, 1)
+	service := &recordingService{}
+	started := service.hold()
+	defer service.release()
+	h.consumer(service, "jobs")
+	<-started
+
+	// the offset is committed while the job still runs
+	h.waitCommitted("jobs", 0, 1)
+}
+
+func TestCommitMarkAfterSuccess(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	produceJobs(t, h.producer(), "jobs", 0, 1)
+	service := &recordingService{}
+	started := service.hold()
+	h.consumer(service, "jobs")
+	<-started
+
+	time.Sleep(100 * time.Millisecond)
+	if offset := h.cluster.Committed(testGroup, "jobs", 0); offset != -1 {
+		t.Fatalf("committed offset %d of a running job", offset)
+	}
+	service.release()
+	h.waitCommitted("jobs", 0, 1)
+}
+
+func TestCommitSyncBatches(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	batch, interval := conf.Get("kafka.commit.batch"), conf.Get("kafka.commit.interval")
+	conf.Set("kafka.commit.mode", string(CommitSync))
+	conf.Set("kafka.commit.batch", 2)
+	conf.Set("kafka.commit.interval", time.Hour)
+	t.Cleanup(func() {
+		conf.Set("kafka.commit.batch", batch)
+		conf.Set("kafka.commit.interval", interval)
+	})
+	produceJobs(t, h.producer(), "jobs", 0, 3)
+	service := &recordingService{}
+	ac := h.newConsumer(service, "jobs")
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- ac.ConsumeContext(ctx)
+	}()
+	t.Cleanup(cancel)
+
+	h.waitFor("3 jobs", func() bool { return len(service.ran()) == 3 })
+	// the first batch is committed, the last job waits for the next batch
+	h.waitCommitted("jobs", 0, 2)
+	time.Sleep(100 * time.Millisecond)
+	if offset := h.cluster.Committed(testGroup, "jobs", 0); offset != 2 {
+		t.Fatalf("committed offset %d, want 2 until the session ends", offset)
+	}
+
+	cancel()
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if offset := h.cluster.Committed(testGroup, "jobs", 0); offset != 3 {
+		t.Fatalf("committed offset %d after the shutdown, want 3", offset)
+	}
+}
@@ -0,0 +1,237 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/linkedin/goavro/v2"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// magicByte starts the payloads framed with a schema id
+const magicByte = 0
+
+// frameLength is the length of the magic byte and the schema id
+const frameLength = 5
+
+// Deserializer decodes the keys and values of the messages
+type Deserializer interface {
+	// Deserialize decodes the key or value of a message of the topic, the
+	// schema lookups are cancelled with ctx
+	Deserialize(ctx context.Context, topic string, isKey bool, b []byte) (*Payload, error)
+}
+
+// Payload is a decoded key or value
+type Payload struct {
+	SchemaId int
+	// SchemaType is the type of the schema of the payload, "" for the raw
+	// bytes which are not framed with a schema id
+	SchemaType string
+
+	// value is the goavro native form of the codec, the JSON document, the
+	// *dynamic.Message or the raw bytes
+	value interface{}
+	codec *goavro.Codec
+}
+
+// Textual returns the textual JSON of the payload, the raw bytes as is
+func (p *Payload) Textual() ([]byte, error) {
+	var textual []byte
+	var err error
+	if p.codec != nil {
+		textual, err = p.codec.TextualFromNative(nil, p.value)
+	} else if dm, ok := p.value.(*dynamic.Message); ok {
+		textual, err = dm.MarshalJSON()
+	} else {
+		return p.value.([]byte), nil
+	}
+	if err != nil {
+		return nil, errors.BadData(err)
+	}
+	return textual, nil
+}
+
+// Decode decodes the payload into v. The Avro records are mapped to the
+// structs through their avro tags and the protobuf messages are unmarshaled
+// into v when it is a generated message, the other payloads are unmarshaled
+// with encoding/json. The raw bytes can also be read into a *[]byte or a
+// *string.
+func (p *Payload) Decode(v interface{}) error {
+	if p.codec != nil {
+		if err := StructFromNative(p.codec, p.value, v); err != nil {
+			return errors.BadData(err)
+		}
+		return nil
+	}
+	var err error
+	switch value := p.value.(type) {
+	case *dynamic.Message:
+		if pm, ok := v.(proto.Message); ok {
+			err = value.ConvertTo(pm)
+			break
+		}
+		var doc []byte
+		if doc, err = value.MarshalJSON(); err == nil {
+			err = json.Unmarshal(doc, v)
+		}
+	case []byte:
+		switch out := v.(type) {
+		case *[]byte:
+			*out = value
+		case *string:
+			*out = string(value)
+		default:
+			err = json.Unmarshal(value, v)
+		}
+	}
+	if err != nil {
+		return errors.BadData(err)
+	}
+	return nil
+}
+
+// schemaDecoder decodes the payloads framed with the id of a schema of its
+// type, it returns the record name of the subject name strategies
+type schemaDecoder interface {
+	decode(ctx context.Context, schemaId int, schema *RawSchema, b []byte) (*Payload, string, error)
+}
+
+// RegistryDeserializer inspects the framing of the payloads and decodes them
+// with the decoder of the type of their schema. The payloads which do not
+// start with the magic byte are raw bytes.
+type RegistryDeserializer struct {
+	client   *CachedSchemaRegistryClient
+	subjects *subjectNames
+	decoders map[string]schemaDecoder
+
+	// checked records the subjectCheck found valid
+	checked sync.Map
+}
+
+// subjectCheck is a schema id found in a message of a topic key or value,
+// checked against the subject the topic strategy gives
+type subjectCheck struct {
+	subject  string
+	schemaId int
+}
+
+// NewRegistryDeserializer returns a deserializer checking that the schemas are
+// registered under the subjects of the TopicNameStrategy
+func NewRegistryDeserializer(client *CachedSchemaRegistryClient) *RegistryDeserializer {
+	subjects, _ := newSubjectNames(TopicNameStrategy, nil)
+	return &RegistryDeserializer{
+		client:   client,
+		subjects: subjects,
+		decoders: map[string]schemaDecoder{
+			SchemaTypeAvro:     &avroDecoder{client},
+			SchemaTypeJSON:     jsonSchemaDecoder{},
+			SchemaTypeProtobuf: protobufDecoder{},
+		},
+	}
+}
+
+// SetSubjectNameStrategy sets the subject name strategy of the schemas of the
+// topic
+func (d *RegistryDeserializer) SetSubjectNameStrategy(topic string, strategy SubjectNameStrategy) {
+	d.subjects.set(topic, strategy)
+}
+
+// Deserialize decodes the payload, a truncated frame, an unknown schema type
+// or a payload not matching its schema is bad data
+func (d *RegistryDeserializer) Deserialize(ctx context.Context, topic string, isKey bool, b []byte) (*Payload, error) {
+	if len(b) == 0 || b[0] != magicByte {
+		return &Payload{value: b}, nil
+	}
+	return d.deserializeFramed(ctx, topic, isKey, b)
+}
+
+// DeserializeFramed is like Deserialize for the payloads which must be framed
+// with a schema id, a payload not starting with the magic byte is bad data
+func (d *RegistryDeserializer) DeserializeFramed(ctx context.Context, topic string, isKey bool, b []byte) (*Payload, error) {
+	if len(b) == 0 {
+		return nil, errors.BadData("empty payload is not framed with a schema id")
+	}
+	if b[0] != magicByte {
+		return nil, errors.BadData("unknown magic byte", b[0])
+	}
+	return d.deserializeFramed(ctx, topic, isKey, b)
+}
+
+func (d *RegistryDeserializer) deserializeFramed(ctx context.Context, topic string, isKey bool, b []byte) (*Payload, error) {
+	if len(b) < frameLength {
+		return nil, errors.BadData("payload of", len(b), "bytes is shorter than the schema id framing")
+	}
+	schemaId := int(binary.BigEndian.Uint32(b[1:frameLength]))
+	schema, err := d.client.GetRawSchemaContext(ctx, schemaId)
+	if errors.IsNotFound(err) {
+		return nil, errors.BadData("unknown schema id", schemaId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	decoder, ok := d.decoders[schema.Type()]
+	if !ok {
+		return nil, errors.BadData("unknown schema type", schema.Type(), "of schema id", schemaId)
+	}
+	payload, record, err := decoder.decode(ctx, schemaId, schema, b[frameLength:])
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkSubject(ctx, topic, isKey, schemaId, record, schema); err != nil {
+		return nil, err
+	}
+	payload.SchemaId = schemaId
+	payload.SchemaType = schema.Type()
+	return payload, nil
+}
+
+// checkSubject checks that the schema id is registered under the subject of
+// the topic key or value, a schema of another subject is bad data
+func (d *RegistryDeserializer) checkSubject(ctx context.Context, topic string, isKey bool, schemaId int, record string, schema *RawSchema) error {
+	subject, err := d.subjects.subject(topic, isKey, record)
+	if err != nil {
+		return errors.BadData(err)
+	}
+	check := subjectCheck{subject, schemaId}
+	if _, ok := d.checked.Load(check); ok {
+		return nil
+	}
+	id, err := d.client.IsRawSchemaRegisteredContext(ctx, subject, schema)
+	if errors.IsNotFound(err) {
+		return errors.BadData("schema id", schemaId, "is not registered under subject", subject)
+	}
+	if err != nil {
+		return err
+	}
+	if id != schemaId {
+		return errors.BadData("schema id", schemaId, "is not registered under subject", subject, "found id", id)
+	}
+	d.checked.Store(check, true)
+	return nil
+}
+
+// avroDecoder decodes the Avro binary data
+type avroDecoder struct {
+	client *CachedSchemaRegistryClient
+}
+
+func (d *avroDecoder) decode(ctx context.Context, schemaId int, schema *RawSchema, b []byte) (*Payload, string, error) {
+	codec, err := d.client.GetSchemaContext(ctx, schemaId)
+	if err != nil {
+		return nil, "", errors.BadData(err)
+	}
+	record, err := avroRecordName(codec)
+	if err != nil {
+		return nil, "", errors.BadData(err)
+	}
+	// Convert binary Avro data back to native Go form
+	native, _, err := codec.NativeFromBinary(b)
+	if err != nil {
+		return nil, "", errors.BadData(err)
+	}
+	return &Payload{value: native, codec: codec}, record, nil
+}
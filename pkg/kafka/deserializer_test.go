@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/kafka/registrytest"
+)
+
+func newTestDeserializer(t *testing.T) (*RegistryDeserializer, *CachedSchemaRegistryClient) {
+	registry := registrytest.NewServer()
+	t.Cleanup(registry.Close)
+	client := NewCachedSchemaRegistryClient([]string{registry.URL})
+	return NewRegistryDeserializer(client), client
+}
+
+// frameJob registers the schema of a record with an int id under the subject
+// and returns the framed Avro record
+func frameJob(t *testing.T, client *CachedSchemaRegistryClient, subject, schema string, id int) []byte {
+	t.Helper()
+	codec := newTestCodec(t, schema)
+	schemaId, err := client.CreateSubject(subject, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := codec.BinaryFromNative(nil, map[string]interface{}{"id": id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := (&AvroEncoder{SchemaID: schemaId, Content: content}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDeserialize(t *testing.T) {
+	d, client := newTestDeserializer(t)
+	b := frameJob(t, client, "jobs-value", testSchema, 7)
+
+	payload, err := d.Deserialize(context.Background(), "jobs", false, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textual, err := payload.Textual()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(textual) != `{"id":7}` || payload.SchemaType != SchemaTypeAvro || payload.SchemaId != 1 {
+		t.Fatalf("payload %s of schema %s %d", textual, payload.SchemaType, payload.SchemaId)
+	}
+
+	raw, err := d.Deserialize(context.Background(), "jobs", false, []byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := raw.Decode(&s); err != nil || s != "plain" || raw.SchemaType != "" {
+		t.Fatalf("raw payload %q of schema %q: %v", s, raw.SchemaType, err)
+	}
+}
+
+func TestDeserializeBadData(t *testing.T) {
+	d, client := newTestDeserializer(t)
+	job := frameJob(t, client, "jobs-value", testSchema, 1)
+	other := frameJob(t, client, "other-value", `{
+		"type": "record",
+		"name": "Task",
+		"fields": [{"name": "id", "type": "int"}]
+	}`, 2)
+
+	tests := []struct {
+		name   string
+		framed bool
+		b      []byte
+	}{
+		{"magic byte only", false, []byte{0}},
+		{"truncated schema id", false, []byte{0, 0, 0, 1}},
+		{"empty framed payload", true, nil},
+		{"wrong magic byte", true, append([]byte{1}, job[1:]...)},
+		{"unknown schema id", false, []byte{0, 0, 0, 0, 99, 2}},
+		{"truncated record", false, job[:frameLength]},
+		{"schema of another subject", false, other},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deserialize := d.Deserialize
+			if test.framed {
+				deserialize = d.DeserializeFramed
+			}
+			if _, err := deserialize(context.Background(), "jobs", false, test.b); !errors.IsBadData(err) {
+				t.Fatalf("error %v, want BadData", err)
+			}
+		})
+	}
+}
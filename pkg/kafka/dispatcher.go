@@ -0,0 +1,108 @@
+package kafka
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/services"
+)
+
+// Dispatcher maps consumed messages to the services.Service in charge of them.
+// A message is routed by header first, then by key, then by topic name and
+// finally by topic pattern. The messages of the retry topics are routed by
+// their original topic.
+type Dispatcher struct {
+	mu       sync.RWMutex
+	topics   map[string]services.Service
+	patterns []topicPattern
+	keys     map[string]services.Service
+	headers  map[string]map[string]services.Service
+}
+
+type topicPattern struct {
+	re      *regexp.Regexp
+	service services.Service
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		topics:  make(map[string]services.Service),
+		keys:    make(map[string]services.Service),
+		headers: make(map[string]map[string]services.Service),
+	}
+}
+
+// HandleTopic routes every message of the topic to the service
+func (d *Dispatcher) HandleTopic(topic string, service services.Service) {
+	d.mu.Lock()
+	d.topics[topic] = service
+	d.mu.Unlock()
+}
+
+// HandlePattern routes the messages of the topics matching re to the service,
+// patterns are tried in registration order
+func (d *Dispatcher) HandlePattern(re *regexp.Regexp, service services.Service) {
+	d.mu.Lock()
+	d.patterns = append(d.patterns, topicPattern{re, service})
+	d.mu.Unlock()
+}
+
+// HandleKey routes the messages with the given key to the service
+func (d *Dispatcher) HandleKey(key string, service services.Service) {
+	d.mu.Lock()
+	d.keys[key] = service
+	d.mu.Unlock()
+}
+
+// HandleHeader routes the messages carrying the header key=value to the service
+func (d *Dispatcher) HandleHeader(key, value string, service services.Service) {
+	d.mu.Lock()
+	values, ok := d.headers[key]
+	if !ok {
+		values = make(map[string]services.Service)
+		d.headers[key] = values
+	}
+	values[value] = service
+	d.mu.Unlock()
+}
+
+// Topics returns the sorted list of topics having a service
+func (d *Dispatcher) Topics() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	topics := make([]string, 0, len(d.topics))
+	for topic := range d.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Resolve returns the service which should run the job carried by the message
+func (d *Dispatcher) Resolve(m *broker.Message) (services.Service, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, h := range m.Headers {
+		if values, ok := d.headers[string(h.Key)]; ok {
+			if service, ok := values[string(h.Value)]; ok {
+				return service, nil
+			}
+		}
+	}
+	if service, ok := d.keys[string(m.Key)]; ok && len(m.Key) > 0 {
+		return service, nil
+	}
+	topic := originalTopic(m)
+	if service, ok := d.topics[topic]; ok {
+		return service, nil
+	}
+	for _, p := range d.patterns {
+		if p.re.MatchString(topic) {
+			return p.service, nil
+		}
+	}
+	return nil, errors.NotFound("no service for topic", topic)
+}
@@ -0,0 +1,119 @@
+package kafka
+
+import (
+	"strings"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// DLQFilter selects the dead-lettered messages to inspect or replay, the zero
+// value of a field matches every message
+type DLQFilter struct {
+	// Topic is the original topic of the message
+	Topic string
+	// Since and Until bound the time the message was dead-lettered
+	Since time.Time
+	Until time.Time
+	// Error is a substring of the error which dead-lettered the message
+	Error string
+	Key   string
+}
+
+// Match tells if the dead-lettered message passes the filter
+func (f *DLQFilter) Match(m *broker.Message) bool {
+	if f.Topic != "" && originalTopic(m) != f.Topic {
+		return false
+	}
+	if !f.Since.IsZero() && m.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !m.Timestamp.Before(f.Until) {
+		return false
+	}
+	if f.Error != "" && !strings.Contains(m.Header(HeaderError), f.Error) {
+		return false
+	}
+	if f.Key != "" && string(m.Key) != f.Key {
+		return false
+	}
+	return true
+}
+
+// ReadDLQ reads the messages present in the dead letter topic when it is
+// called and hands the ones matching the filter to fn, partition by partition
+func ReadDLQ(kafkaServers []string, topic string, filter *DLQFilter, fn func(*broker.Message) error) error {
+	cluster := NewSaramaCluster(kafkaServers)
+	defer cluster.Close()
+	return ReadDLQFromCluster(cluster, topic, filter, fn)
+}
+
+// ReadDLQFromCluster is like ReadDLQ on the brokers of the cluster
+func ReadDLQFromCluster(cluster broker.Cluster, topic string, filter *DLQFilter, fn func(*broker.Message) error) error {
+	return cluster.ReadTopic(topic, func(m *broker.Message) error {
+		if filter == nil || filter.Match(m) {
+			return fn(m)
+		}
+		return nil
+	})
+}
+
+// DLQReplayer writes dead-lettered messages back to their original topic.
+// The value bytes are sent as is, so the schema id framing stays intact.
+type DLQReplayer struct {
+	producer *AvroProducer
+	// cluster is the cluster opened by NewDLQReplayer, closed with the replayer
+	cluster broker.Cluster
+}
+
+func NewDLQReplayer(kafkaServers []string) (*DLQReplayer, error) {
+	cluster := NewSaramaCluster(kafkaServers)
+	r, err := NewDLQReplayerFromCluster(cluster)
+	if err != nil {
+		cluster.Close()
+		return nil, err
+	}
+	r.cluster = cluster
+	return r, nil
+}
+
+// NewDLQReplayerFromCluster is like NewDLQReplayer on the brokers of the
+// cluster, the cluster is left open by Close
+func NewDLQReplayerFromCluster(cluster broker.Cluster) (*DLQReplayer, error) {
+	producer, err := NewAvroProducerFromCluster(cluster, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &DLQReplayer{producer: producer}, nil
+}
+
+// Replay republishes the message to the topic recorded by its headers, the
+// retry headers are dropped so that the message gets a fresh set of attempts
+func (r *DLQReplayer) Replay(m *broker.Message) error {
+	topic := m.Header(HeaderOriginalTopic)
+	if topic == "" {
+		return errors.BadData("no original topic header, topic =", m.Topic, "offset =", m.Offset)
+	}
+	var headers []broker.Header
+	for _, h := range m.Headers {
+		switch string(h.Key) {
+		case HeaderOriginalTopic, HeaderOriginalPartition, HeaderOriginalOffset, HeaderError, HeaderAttempt:
+		default:
+			headers = append(headers, h)
+		}
+	}
+	return r.producer.Publish(&broker.Message{
+		Topic:   topic,
+		Key:     m.Key,
+		Value:   m.Value,
+		Headers: headers,
+	})
+}
+
+func (r *DLQReplayer) Close() {
+	r.producer.Close()
+	if r.cluster != nil {
+		r.cluster.Close()
+	}
+}
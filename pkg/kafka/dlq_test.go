@@ -0,0 +1,68 @@
+package kafka
+
+import (
+	"testing"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/broker/memory"
+)
+
+// closeCountingCluster counts the calls to Close
+type closeCountingCluster struct {
+	broker.Cluster
+	closed int
+}
+
+func (c *closeCountingCluster) Close() error {
+	c.closed++
+	return c.Cluster.Close()
+}
+
+func TestReplayLeavesClusterOpen(t *testing.T) {
+	memoryCluster := memory.NewCluster(1)
+	cluster := &closeCountingCluster{Cluster: memoryCluster}
+	replayer, err := NewDLQReplayerFromCluster(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replayer.Replay(&broker.Message{
+		Topic: DLQTopic("jobs"),
+		Key:   []byte("0"),
+		Value: []byte("value"),
+		Headers: []broker.Header{
+			{Key: []byte(HeaderOriginalTopic), Value: []byte("jobs")},
+			{Key: []byte(HeaderAttempt), Value: []byte("3")},
+			{Key: []byte("trace"), Value: []byte("t1")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer.Close()
+	if cluster.closed != 0 {
+		t.Fatal("the replayer closed a cluster it does not own")
+	}
+
+	replayed := memoryCluster.Messages("jobs")
+	if len(replayed) != 1 {
+		t.Fatalf("%d messages replayed, want 1", len(replayed))
+	}
+	m := replayed[0]
+	if string(m.Value) != "value" || m.Header(HeaderAttempt) != "" || m.Header("trace") != "t1" {
+		t.Fatalf("replayed %s with headers %v", m.Value, m.Headers)
+	}
+}
+
+func TestReplayerClosesItsCluster(t *testing.T) {
+	cluster := &closeCountingCluster{Cluster: memory.NewCluster(1)}
+	replayer, err := NewDLQReplayerFromCluster(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as opened by NewDLQReplayer
+	replayer.cluster = cluster
+	replayer.Close()
+	if cluster.closed != 1 {
+		t.Fatalf("cluster closed %d times, want 1", cluster.closed)
+	}
+}
@@ -0,0 +1,112 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/xeipuuv/gojsonschema"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+/*
+	The JSON documents are registered with the JSON schema type and framed like
+	the Avro messages: the magic byte, the 4-byte schema id then the document.
+	They are validated against their schema before being produced and after
+	being consumed.
+*/
+
+// jsonSchemas caches the compiled JSON schemas by their text
+var jsonSchemas sync.Map
+
+// compileJSONSchema returns the compiled JSON schema
+func compileJSONSchema(schema string) (*gojsonschema.Schema, error) {
+	if compiled, ok := jsonSchemas.Load(schema); ok {
+		return compiled.(*gojsonschema.Schema), nil
+	}
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		return nil, errors.InvalidArg("bad json schema", err)
+	}
+	jsonSchemas.Store(schema, compiled)
+	return compiled, nil
+}
+
+// validateJSON validates the document against the schema, an invalid
+// document is bad data
+func validateJSON(schema *gojsonschema.Schema, doc []byte) error {
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(doc))
+	if err != nil {
+		return errors.BadData(err)
+	}
+	if result.Valid() {
+		return nil
+	}
+	var reasons []string
+	for _, e := range result.Errors() {
+		reasons = append(reasons, e.String())
+	}
+	return errors.BadData("invalid json document:", strings.Join(reasons, "; "))
+}
+
+// jsonSchemaTitle returns the title of the schema, the record name of the
+// subject name strategies
+func jsonSchemaTitle(schema string) string {
+	var s struct {
+		Title string `json:"title"`
+	}
+	if err := json.Unmarshal([]byte(schema), &s); err != nil {
+		return ""
+	}
+	return s.Title
+}
+
+// encodeJSON registers the JSON schema under the subject of the topic key or
+// value, validates the document and frames it with the schema id
+func encodeJSON(client *CachedSchemaRegistryClient, subjects *subjectNames, topic string, isKey bool,
+	schema string, doc []byte) (*AvroEncoder, error) {
+	compiled, err := compileJSONSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateJSON(compiled, doc); err != nil {
+		return nil, err
+	}
+	subject, err := subjects.subject(topic, isKey, jsonSchemaTitle(schema))
+	if err != nil {
+		return nil, err
+	}
+	schemaId, err := client.CreateRawSubject(subject, &RawSchema{Schema: schema, SchemaType: SchemaTypeJSON})
+	if err != nil {
+		return nil, err
+	}
+	return &AvroEncoder{
+		SchemaID: schemaId,
+		Content:  doc,
+	}, nil
+}
+
+// encodeJSONValue is like encodeJSON for a Go value marshaled with encoding/json
+func encodeJSONValue(client *CachedSchemaRegistryClient, subjects *subjectNames, topic string, isKey bool,
+	schema string, v interface{}) (*AvroEncoder, error) {
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return encodeJSON(client, subjects, topic, isKey, schema, doc)
+}
+
+// jsonSchemaDecoder validates the JSON documents against their schema
+type jsonSchemaDecoder struct{}
+
+func (jsonSchemaDecoder) decode(ctx context.Context, schemaId int, schema *RawSchema, b []byte) (*Payload, string, error) {
+	compiled, err := compileJSONSchema(schema.Schema)
+	if err != nil {
+		return nil, "", errors.BadData(err)
+	}
+	if err := validateJSON(compiled, b); err != nil {
+		return nil, "", err
+	}
+	return &Payload{value: b}, jsonSchemaTitle(schema.Schema), nil
+}
@@ -0,0 +1,89 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+const carJSONSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "test.Car",
+	"type": "object",
+	"properties": {
+		"model": {"type": "string"},
+		"seats": {"type": "integer", "minimum": 1}
+	},
+	"required": ["model"]
+}`
+
+func TestJSONSchemaRoundTrip(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	producer := h.producer()
+	if err := producer.AddJSONValue("cars", carJSONSchema, nil, map[string]interface{}{"model": "van", "seats": 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewCachedSchemaRegistryClient([]string{h.registry})
+	payload, err := NewRegistryDeserializer(client).Deserialize(context.Background(), "cars", false, h.cluster.Messages("cars")[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.SchemaType != SchemaTypeJSON {
+		t.Fatalf("schema type %q, want JSON", payload.SchemaType)
+	}
+	var car struct {
+		Model string `json:"model"`
+		Seats int    `json:"seats"`
+	}
+	if err := payload.Decode(&car); err != nil || car.Model != "van" || car.Seats != 7 {
+		t.Fatalf("decoded %+v, %v", car, err)
+	}
+}
+
+func TestJSONSchemaValidation(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	producer := h.producer()
+	for _, doc := range []string{`{"seats": 2}`, `{"model": "van", "seats": 0}`, `{"model": 3}`, `not json`} {
+		if err := producer.AddJSON("cars", carJSONSchema, nil, []byte(doc)); !errors.IsBadData(err) {
+			t.Errorf("produce %s: %v, want BadData", doc, err)
+		}
+	}
+	if n := len(h.cluster.Messages("cars")); n != 0 {
+		t.Fatalf("%d invalid documents produced", n)
+	}
+	if err := producer.AddJSON("cars", `{"type": 12}`, nil, []byte(`{}`)); !errors.IsInvalidArg(err) {
+		t.Errorf("produce with a bad schema: %v, want InvalidArg", err)
+	}
+
+	// a document produced by another client is validated when consumed
+	client := NewCachedSchemaRegistryClient([]string{h.registry})
+	schemaId, err := client.CreateRawSubject("cars-value", &RawSchema{Schema: carJSONSchema, SchemaType: SchemaTypeJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := (&AvroEncoder{SchemaID: schemaId, Content: []byte(`{"model": "van", "seats": -1}`)}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRegistryDeserializer(client).Deserialize(context.Background(), "cars", false, b); !errors.IsBadData(err) {
+		t.Fatalf("consume an invalid document: %v, want BadData", err)
+	}
+}
+
+func TestJSONSchemaTitle(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		{carJSONSchema, "test.Car"},
+		{`{"type": "object"}`, ""},
+		{`not json`, ""},
+	}
+	for _, test := range tests {
+		if title := jsonSchemaTitle(test.schema); title != test.want {
+			t.Errorf("title of %s = %q, want %q", test.schema, title, test.want)
+		}
+	}
+}
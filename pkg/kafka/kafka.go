@@ -1,8 +1,18 @@
 package kafka
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
 	"keyayun.com/seal-kafka-runner/pkg/config"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
 	"keyayun.com/seal-kafka-runner/pkg/logger"
+	"keyayun.com/seal-kafka-runner/pkg/registry"
 )
 
 var (
@@ -11,20 +21,173 @@ var (
 	group = "seal-runner-kafka"
 )
 
+const defaultTopicRefresh = time.Minute
+
+// StartUpConsumer consumes every topic of kafka.topics, the topics sharing a
+// group id are consumed by the same consumer group. It returns on SIGINT or
+// SIGTERM once the consumers drained their jobs and the async producers are
+// flushed, ErrDrainTimeout tells that it gave up on running jobs.
 func StartUpConsumer() error {
 	brokers := conf.GetStringSlice("kafka.brokers")
 	schemaRegistries := conf.GetStringSlice("kafka.schemaRegistries")
-	client, err := NewAvroConsumer(brokers, schemaRegistries, "test", group, nil)
+	topics, err := LoadTopicConfigs()
+	if err != nil {
+		return err
+	}
+	dispatcher, err := newTopicsDispatcher(topics)
 	if err != nil {
-		log.Panicf("Error creating consumer group client: %v", err)
 		return err
 	}
-	client.Consume()
+	groups := make(map[string][]TopicConfig)
+	for _, t := range topics {
+		groups[t.Group] = append(groups[t.Group], t)
+	}
+	refresh := conf.GetDuration("kafka.topicRefresh")
+	var consumers []*avroConsumer
+	for groupId, groupTopics := range groups {
+		client, err := NewAvroConsumer(brokers, schemaRegistries, groupTopics, groupId, refresh, dispatcher)
+		if err != nil {
+			log.WithError(err).Error("Error creating consumer group client")
+			for _, c := range consumers {
+				c.Close()
+			}
+			return err
+		}
+		consumers = append(consumers, client)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	wg := &sync.WaitGroup{}
+	errs := make([]error, len(consumers))
+	for i, client := range consumers {
+		wg.Add(1)
+		go func(i int, client *avroConsumer) {
+			defer wg.Done()
+			errs[i] = client.ConsumeContext(ctx)
+		}(i, client)
+	}
+	<-ctx.Done()
+	// the consumers and the producers share the drain timeout
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), drainTimeout())
+	defer cancelFlush()
+	wg.Wait()
+	if err := flushAsyncProducers(flushCtx); err != nil {
+		log.WithError(err).Error("Error flushing the producers")
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// drainTimeout returns kafka.shutdown.drainTimeout
+func drainTimeout() time.Duration {
+	if timeout := conf.GetDuration("kafka.shutdown.drainTimeout"); timeout > 0 {
+		return timeout
+	}
+	return defaultDrainTimeout
+}
+
+// signalContext returns a context done on SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigterm)
+		select {
+		case sig := <-sigterm:
+			log.Printf("terminating: via signal %v", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// newTopicsDispatcher routes each configured topic to its registered service
+func newTopicsDispatcher(topics []TopicConfig) (*Dispatcher, error) {
+	dispatcher := NewDispatcher()
+	for _, t := range topics {
+		service, err := registry.Lookup(t.Service, t.Version)
+		if err != nil {
+			return nil, err
+		}
+		if t.Pattern != "" {
+			dispatcher.HandlePattern(regexp.MustCompile(t.Pattern), service)
+		} else {
+			dispatcher.HandleTopic(t.Name, service)
+		}
+	}
+	return dispatcher, nil
+}
+
+// NewSyncProducer returns a producer using the subject name strategies of
+// kafka.topics and kafka.subjectStrategy
 func NewSyncProducer() (*AvroProducer, error) {
 	brokers := conf.GetStringSlice("kafka.brokers")
 	schemaRegistries := conf.GetStringSlice("kafka.schemaRegistries")
-	return NewAvroProducer(brokers, schemaRegistries)
+	subjects, err := loadSubjectNames()
+	if err != nil {
+		return nil, err
+	}
+	producer, err := NewAvroProducer(brokers, schemaRegistries)
+	if err != nil {
+		return nil, err
+	}
+	producer.subjects = subjects
+	return producer, nil
+}
+
+// NewAsyncProducer returns a batching producer configured by kafka.producer,
+// onDelivery may be nil, the reports are then read from Deliveries()
+func NewAsyncProducer(onDelivery func(*DeliveryReport)) (*AsyncAvroProducer, error) {
+	brokers := conf.GetStringSlice("kafka.brokers")
+	schemaRegistries := conf.GetStringSlice("kafka.schemaRegistries")
+	subjects, err := loadSubjectNames()
+	if err != nil {
+		return nil, err
+	}
+	producer, err := NewAsyncAvroProducer(brokers, schemaRegistries, AsyncProducerOptions{
+		BatchSize:   conf.GetInt("kafka.producer.batchSize"),
+		BatchBytes:  conf.GetInt("kafka.producer.batchBytes"),
+		Linger:      conf.GetDuration("kafka.producer.linger"),
+		Compression: conf.GetString("kafka.producer.compression"),
+		OnDelivery:  onDelivery,
+	})
+	if err != nil {
+		return nil, err
+	}
+	producer.subjects = subjects
+	asyncProducersLock.Lock()
+	asyncProducers[producer] = true
+	asyncProducersLock.Unlock()
+	return producer, nil
+}
+
+// asyncProducers are the open producers of NewAsyncProducer, flushed by
+// StartUpConsumer before it returns
+var (
+	asyncProducersLock sync.Mutex
+	asyncProducers     = make(map[*AsyncAvroProducer]bool)
+)
+
+// flushAsyncProducers waits until the messages queued by the producers of
+// NewAsyncProducer are delivered or ctx is done
+func flushAsyncProducers(ctx context.Context) error {
+	asyncProducersLock.Lock()
+	producers := make([]*AsyncAvroProducer, 0, len(asyncProducers))
+	for p := range asyncProducers {
+		producers = append(producers, p)
+	}
+	asyncProducersLock.Unlock()
+	var errs error
+	for _, p := range producers {
+		errs = errors.Append(errs, p.Flush(ctx))
+	}
+	return errs
 }
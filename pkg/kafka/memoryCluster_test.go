@@ -0,0 +1,309 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker/memory"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/kafka/registrytest"
+)
+
+// memoryHarness runs the consumers and producers of the tests on an in-memory
+// cluster and schema registry
+type memoryHarness struct {
+	t        *testing.T
+	cluster  *memory.Cluster
+	registry string
+}
+
+func newMemoryHarness(t *testing.T, partitions int32) *memoryHarness {
+	conf.Set("kafka.retry.maxAttempts", 0)
+	conf.Set("kafka.transaction.enabled", false)
+	conf.Set("kafka.commit.mode", string(CommitMarkAfterSuccess))
+	registry := registrytest.NewServer()
+	h := &memoryHarness{t: t, cluster: memory.NewCluster(partitions), registry: registry.URL}
+	t.Cleanup(func() {
+		registry.Close()
+		h.cluster.Close()
+	})
+	return h
+}
+
+func (h *memoryHarness) producer() *AvroProducer {
+	producer, err := NewAvroProducerFromCluster(h.cluster, []string{h.registry})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(producer.Close)
+	return producer
+}
+
+// consumer consumes the topics in the test group until the end of the test
+func (h *memoryHarness) consumer(service *recordingService, topics ...string) {
+	ac := h.newConsumer(service, topics...)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ac.ConsumeContext(ctx)
+	}()
+	h.t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func (h *memoryHarness) newConsumer(service *recordingService, topics ...string) *avroConsumer {
+	var configs []TopicConfig
+	dispatcher := NewDispatcher()
+	for _, topic := range topics {
+		configs = append(configs, TopicConfig{Name: topic, Group: testGroup, KeyFormat: KeyFormatString})
+		dispatcher.HandleTopic(topic, service)
+	}
+	ac, err := NewAvroConsumerFromCluster(h.cluster, []string{h.registry}, configs, testGroup, time.Minute, dispatcher)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	ac.reconnectBackoff = 100 * time.Millisecond
+	return ac
+}
+
+func (h *memoryHarness) waitFor(what string, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (h *memoryHarness) waitCommitted(topic string, partition int32, offset int64) {
+	h.t.Helper()
+	h.waitFor(fmt.Sprintf("offset %d committed", offset), func() bool {
+		return h.cluster.Committed(testGroup, topic, partition) == offset
+	})
+}
+
+func TestMemoryConsume(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	produceJobs(t, h.producer(), "jobs", 0, 3)
+
+	service := &recordingService{}
+	h.consumer(service, "jobs")
+	h.waitFor("3 jobs", func() bool { return len(service.ran()) == 3 })
+	h.waitCommitted("jobs", 0, 3)
+
+	for i, job := range service.ran() {
+		if want := fmt.Sprintf(`{"id":%d}`, i); job != want {
+			t.Errorf("job %d = %s, want %s", i, job, want)
+		}
+	}
+}
+
+func TestMemoryMembersSharePartitions(t *testing.T) {
+	h := newMemoryHarness(t, 4)
+	producer := h.producer()
+	produceJobs(t, producer, "jobs", 0, 20)
+
+	first, second := &recordingService{}, &recordingService{}
+	h.consumer(first, "jobs")
+	h.consumer(second, "jobs")
+	h.waitFor("20 jobs", func() bool { return len(first.ran())+len(second.ran()) >= 20 })
+	for p := int32(0); p < 4; p++ {
+		n := int64(0)
+		for _, m := range h.cluster.Messages("jobs") {
+			if m.Partition == p {
+				n++
+			}
+		}
+		h.waitCommitted("jobs", p, n)
+	}
+	if n := len(first.ran()) + len(second.ran()); n != 20 {
+		t.Fatalf("%d jobs ran, want 20", n)
+	}
+}
+
+func TestMemoryFailedJobIsNotCommitted(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	producer := h.producer()
+	service := &recordingService{}
+	service.setFail(errors.BadData("test failure"))
+	produceJobs(t, producer, "jobs", 0, 1)
+	h.consumer(service, "jobs")
+
+	time.Sleep(300 * time.Millisecond)
+	if offset := h.cluster.Committed(testGroup, "jobs", 0); offset != -1 {
+		t.Fatalf("committed offset %d after a failed job", offset)
+	}
+	service.setFail(nil)
+	h.waitFor("the job", func() bool { return len(service.ran()) == 1 })
+	h.waitCommitted("jobs", 0, 1)
+}
+
+func TestFailedJobSkipsItsKey(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	producer := h.producer()
+	for i := 0; i < 2; i++ {
+		if err := producer.Add("jobs", testSchema, []byte("key"), []byte(fmt.Sprintf(`{"id": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := &recordingService{}
+	started := service.hold()
+	h.consumer(service, "jobs")
+	<-started
+	// the second job waits in the queue of the worker while the first fails
+	time.Sleep(100 * time.Millisecond)
+	service.setFailOnce(errors.Unavailable("test failure"))
+	service.release()
+
+	h.waitCommitted("jobs", 0, 2)
+	ran := service.ran()
+	if len(ran) != 2 || ran[0] != `{"id":0}` || ran[1] != `{"id":1}` {
+		t.Fatalf("jobs ran %v, want the two jobs in order", ran)
+	}
+}
+
+func TestMemoryDeadLetter(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	conf.Set("kafka.retry.maxAttempts", 1)
+	defer conf.Set("kafka.retry.maxAttempts", 0)
+	service := &recordingService{}
+	service.setFail(errors.BadData("test failure"))
+	produceJobs(t, h.producer(), "jobs", 0, 1)
+	h.consumer(service, "jobs")
+
+	h.waitFor("the dead letter", func() bool { return len(h.cluster.Messages(DLQTopic("jobs"))) == 1 })
+	h.waitCommitted("jobs", 0, 1)
+	if origin := h.cluster.Messages(DLQTopic("jobs"))[0].Header(HeaderOriginalTopic); origin != "jobs" {
+		t.Fatalf("dead letter of topic %q, want jobs", origin)
+	}
+}
+
+// shutdown starts consuming with ac, waits for a job to start then cancels the
+// consumer, the result of ConsumeContext is sent to the returned channel
+func shutdown(t *testing.T, ac *avroConsumer, started chan struct{}) <-chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- ac.ConsumeContext(ctx)
+	}()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a job")
+	}
+	cancel()
+	return result
+}
+
+func TestShutdownDrainsRunningJobs(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	// the jobs share a key, the second one waits in the queue of the worker
+	producer := h.producer()
+	for i := 0; i < 2; i++ {
+		if err := producer.Add("jobs", testSchema, []byte("key"), []byte(fmt.Sprintf(`{"id": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service := &recordingService{}
+	started := service.hold()
+	ac := h.newConsumer(service, "jobs")
+	result := shutdown(t, ac, started)
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-result:
+		t.Fatalf("consumer stopped with a running job: %v", err)
+	default:
+	}
+	service.release()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the shutdown")
+	}
+	// the queued job is left for the next consumer
+	if n := len(service.ran()); n != 1 {
+		t.Fatalf("%d jobs ran, want 1", n)
+	}
+	if offset := h.cluster.Committed(testGroup, "jobs", 0); offset != 1 {
+		t.Fatalf("committed offset %d, want 1", offset)
+	}
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	produceJobs(t, h.producer(), "jobs", 0, 1)
+	service := &recordingService{}
+	started := service.hold()
+	defer service.release()
+	ac := h.newConsumer(service, "jobs")
+	ac.drainTimeout = 100 * time.Millisecond
+	result := shutdown(t, ac, started)
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrDrainTimeout) {
+			t.Fatalf("error %v, want ErrDrainTimeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("consumer waited past the drain timeout")
+	}
+	if offset := h.cluster.Committed(testGroup, "jobs", 0); offset != -1 {
+		t.Fatalf("committed offset %d of an unfinished job", offset)
+	}
+	h.waitFor("the job cancellation", func() bool { return service.cancellations() == 1 })
+}
+
+func TestRebalanceCancelsRunningJobs(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	produceJobs(t, h.producer(), "jobs", 0, 1)
+	service := &recordingService{}
+	started := service.hold()
+	h.consumer(service, "jobs")
+	<-started
+
+	// the partition is revoked when a second member joins
+	h.consumer(service, "jobs")
+	h.waitFor("the job cancellation", func() bool { return service.cancellations() >= 1 })
+	service.release()
+	h.waitCommitted("jobs", 0, 1)
+	if n := len(service.ran()); n != 1 {
+		t.Fatalf("%d jobs ran, want 1", n)
+	}
+}
+
+func TestJobInfo(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	delays := conf.Get("kafka.retry.delays")
+	conf.Set("kafka.retry.maxAttempts", 2)
+	conf.Set("kafka.retry.delays", []string{"10ms"})
+	t.Cleanup(func() {
+		conf.Set("kafka.retry.maxAttempts", 0)
+		conf.Set("kafka.retry.delays", delays)
+	})
+	service := &recordingService{}
+	// only the first attempt fails
+	service.setFailOnce(errors.Unavailable("test failure"))
+	produceJobs(t, h.producer(), "jobs", 0, 1)
+	h.consumer(service, "jobs")
+
+	retryTopic := RetryTopic("jobs", 10*time.Millisecond)
+	h.waitFor("the retried job", func() bool { return len(service.ran()) == 1 })
+	info := service.jobInfos()[0]
+	if info.Topic != retryTopic || info.Offset != 0 || string(info.Key) != "0" {
+		t.Fatalf("job of %s/%d/%d key %s, want %s/0/0 key 0", info.Topic, info.Partition, info.Offset, info.Key, retryTopic)
+	}
+	if info.Attempt != 2 || info.Headers[HeaderOriginalTopic] != "jobs" {
+		t.Fatalf("attempt %d of topic %q, want attempt 2 of jobs", info.Attempt, info.Headers[HeaderOriginalTopic])
+	}
+}
@@ -0,0 +1,442 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/client"
+	"keyayun.com/seal-kafka-runner/pkg/kafka/registrytest"
+	"keyayun.com/seal-kafka-runner/pkg/services"
+	"keyayun.com/seal-kafka-runner/pkg/utils"
+)
+
+/*
+	mockCluster is a single sarama MockBroker serving a consumer group and an
+	in-memory log per partition. The MockBroker answers with static responses,
+	so the cluster installs new ones whenever its state changes: a produced
+	message, a rebalance or an injected error. The MockBroker does not expose
+	the records of the produce requests, the producers of the cluster record
+	the messages they sent successfully into the log instead.
+*/
+
+const testGroup = "test-group"
+
+type mockRecord struct {
+	key, value []byte
+}
+
+type mockCluster struct {
+	t        *testing.T
+	broker   *sarama.MockBroker
+	registry string
+
+	mu         sync.Mutex
+	partitions map[string]int32
+	logs       map[string]map[int32][]mockRecord
+	// assignment is the assignment of the member after the next join
+	assignment map[string][]int32
+	// overrides replace the responses of the request types
+	overrides map[string]sarama.MockResponse
+}
+
+// newMockCluster starts a broker with the topics and their partition count,
+// and an in-memory schema registry, both closed at the end of the test
+func newMockCluster(t *testing.T, partitions map[string]int32) *mockCluster {
+	// the mock responses of the group and produce requests only encode the
+	// first versions
+	conf.Set("kafka.version", "0.10.2.0")
+	// a failed job blocks its partition rather than being retried
+	conf.Set("kafka.retry.maxAttempts", 0)
+	conf.Set("kafka.transaction.enabled", false)
+	conf.Set("kafka.commit.mode", string(CommitMarkAfterSuccess))
+	c := &mockCluster{
+		t:          t,
+		broker:     sarama.NewMockBroker(t, 1),
+		partitions: partitions,
+		logs:       make(map[string]map[int32][]mockRecord),
+		overrides:  make(map[string]sarama.MockResponse),
+	}
+	c.assignment = c.allPartitions()
+	registry := registrytest.NewServer()
+	c.registry = registry.URL
+	t.Cleanup(func() {
+		registry.Close()
+		c.broker.Close()
+	})
+	c.mu.Lock()
+	c.install()
+	c.mu.Unlock()
+	return c
+}
+
+func (c *mockCluster) brokers() []string {
+	return []string{c.broker.Addr()}
+}
+
+func (c *mockCluster) registries() []string {
+	return []string{c.registry}
+}
+
+func (c *mockCluster) allPartitions() map[string][]int32 {
+	assignment := make(map[string][]int32)
+	for topic, n := range c.partitions {
+		for p := int32(0); p < n; p++ {
+			assignment[topic] = append(assignment[topic], p)
+		}
+	}
+	return assignment
+}
+
+// install sets the responses of the broker from the state of the cluster,
+// c.mu is held
+func (c *mockCluster) install() {
+	t, broker := c.t, c.broker
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	offsets := sarama.NewMockOffsetResponse(t)
+	fetch := sarama.NewMockFetchResponse(t, 10)
+	for topic, n := range c.partitions {
+		for p := int32(0); p < n; p++ {
+			metadata.SetLeader(topic, p, broker.BrokerID())
+			log := c.logs[topic][p]
+			offsets.SetOffset(topic, p, sarama.OffsetOldest, 0)
+			offsets.SetOffset(topic, p, sarama.OffsetNewest, int64(len(log)))
+			for offset, r := range log {
+				fetch.SetMessageWithKey(topic, p, int64(offset), sarama.ByteEncoder(r.key), sarama.ByteEncoder(r.value))
+			}
+			fetch.SetHighWaterMark(topic, p, int64(len(log)))
+		}
+	}
+	// the partitions without committed offset answer -1
+	committed := c.committed()
+	offsetFetch := sarama.NewMockOffsetFetchResponse(t).SetError(sarama.ErrNoError)
+	for topic, n := range c.partitions {
+		for p := int32(0); p < n; p++ {
+			offset, ok := committed[topic][p]
+			if !ok {
+				offset = -1
+			}
+			offsetFetch.SetOffset(testGroup, topic, p, offset, "", sarama.ErrNoError)
+		}
+	}
+	handlers := map[string]sarama.MockResponse{
+		"ApiVersionsRequest":     sarama.NewMockApiVersionsResponse(t),
+		"MetadataRequest":        metadata,
+		"OffsetRequest":          offsets,
+		"FetchRequest":           fetch,
+		"ProduceRequest":         sarama.NewMockProduceResponse(t).SetVersion(2),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).SetCoordinator(sarama.CoordinatorGroup, testGroup, broker),
+		"JoinGroupRequest":       sarama.NewMockJoinGroupResponse(t).SetGroupProtocol(sarama.StickyBalanceStrategyName),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{
+			Topics: c.assignment,
+		}),
+		"HeartbeatRequest":    sarama.NewMockHeartbeatResponse(t),
+		"OffsetFetchRequest":  offsetFetch,
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+	}
+	for name, response := range c.overrides {
+		handlers[name] = response
+	}
+	broker.SetHandlerByMap(handlers)
+}
+
+// produce appends the message to the log of the partition
+func (c *mockCluster) produce(topic string, partition int32, key, value []byte) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.logs[topic] == nil {
+		c.logs[topic] = make(map[int32][]mockRecord)
+	}
+	c.logs[topic][partition] = append(c.logs[topic][partition], mockRecord{key, value})
+	c.install()
+	return int64(len(c.logs[topic][partition]) - 1)
+}
+
+// logLen returns the number of messages of the partition
+func (c *mockCluster) logLen(topic string, partition int32) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.logs[topic][partition])
+}
+
+// inject replaces the responses of the request type, nil restores them
+func (c *mockCluster) inject(request string, response sarama.MockResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if response == nil {
+		delete(c.overrides, request)
+	} else {
+		c.overrides[request] = response
+	}
+	c.install()
+}
+
+// failJoins makes the group joins fail until it is called with false
+func (c *mockCluster) failJoins(fail bool) {
+	var response sarama.MockResponse
+	if fail {
+		response = sarama.NewMockJoinGroupResponse(c.t).SetError(sarama.ErrNotCoordinatorForConsumer)
+	}
+	c.inject("JoinGroupRequest", response)
+}
+
+// rejectProduce makes the messages sent to the partition fail as too large
+// until acceptProduce is called
+func (c *mockCluster) rejectProduce(topic string, partition int32) {
+	c.inject("ProduceRequest", sarama.NewMockProduceResponse(c.t).SetError(topic, partition, sarama.ErrMessageSizeTooLarge))
+}
+
+func (c *mockCluster) acceptProduce() {
+	c.inject("ProduceRequest", nil)
+}
+
+// rebalance makes the heartbeats fail until the member joins again, it is then
+// assigned the partitions
+func (c *mockCluster) rebalance(assignment map[string][]int32) {
+	joins := c.count("JoinGroupRequest")
+	c.mu.Lock()
+	c.assignment = assignment
+	c.mu.Unlock()
+	c.inject("HeartbeatRequest", sarama.NewMockWrapper(&sarama.HeartbeatResponse{Err: sarama.ErrRebalanceInProgress}))
+	c.waitFor("the member to join again", func() bool {
+		return c.count("JoinGroupRequest") > joins
+	})
+	c.inject("HeartbeatRequest", nil)
+}
+
+// count returns the number of requests of the type the broker received
+func (c *mockCluster) count(request string) int {
+	n := 0
+	for _, rr := range c.broker.History() {
+		if requestName(rr.Request) == request {
+			n++
+		}
+	}
+	return n
+}
+
+func requestName(body interface{}) string {
+	switch body.(type) {
+	case *sarama.JoinGroupRequest:
+		return "JoinGroupRequest"
+	case *sarama.SyncGroupRequest:
+		return "SyncGroupRequest"
+	case *sarama.OffsetCommitRequest:
+		return "OffsetCommitRequest"
+	case *sarama.FetchRequest:
+		return "FetchRequest"
+	case *sarama.ProduceRequest:
+		return "ProduceRequest"
+	case *sarama.HeartbeatRequest:
+		return "HeartbeatRequest"
+	}
+	return ""
+}
+
+// committed returns the last offsets committed by the group
+func (c *mockCluster) committed() map[string]map[int32]int64 {
+	committed := make(map[string]map[int32]int64)
+	for _, rr := range c.broker.History() {
+		req, ok := rr.Request.(*sarama.OffsetCommitRequest)
+		if !ok || req.ConsumerGroup != testGroup {
+			continue
+		}
+		for topic, n := range c.partitions {
+			for p := int32(0); p < n; p++ {
+				if offset, _, err := req.Offset(topic, p); err == nil {
+					if committed[topic] == nil {
+						committed[topic] = make(map[int32]int64)
+					}
+					committed[topic][p] = offset
+				}
+			}
+		}
+	}
+	return committed
+}
+
+// waitFor fails the test unless cond holds within 10 seconds
+func (c *mockCluster) waitFor(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recordingProducer records the messages sent successfully into the log of
+// the cluster
+type recordingProducer struct {
+	broker.Producer
+	cluster *mockCluster
+}
+
+func (p *recordingProducer) Send(msgs ...*broker.Message) error {
+	for _, m := range msgs {
+		if err := p.Producer.Send(m); err != nil {
+			return err
+		}
+		m.Offset = p.cluster.produce(m.Topic, m.Partition, m.Key, m.Value)
+	}
+	return nil
+}
+
+// producer returns an AvroProducer of the cluster
+func (c *mockCluster) producer() *AvroProducer {
+	cluster := &saramaCluster{
+		servers:        c.brokers(),
+		consumerConfig: NewConsumerConfig,
+		producerConfig: func() *sarama.Config {
+			config := NewProducerConfig()
+			config.Producer.Retry.Max = 0
+			return config
+		},
+	}
+	producer, err := NewAvroProducerFromCluster(cluster, c.registries())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	producer.producer = &recordingProducer{producer.producer, c}
+	c.t.Cleanup(func() {
+		producer.Close()
+		cluster.Close()
+	})
+	return producer
+}
+
+// consumer returns a consumer of the topics in the test group, routing them
+// to the service, it consumes until the end of the test
+func (c *mockCluster) consumer(service *recordingService, topics ...string) *avroConsumer {
+	var configs []TopicConfig
+	dispatcher := NewDispatcher()
+	for _, topic := range topics {
+		configs = append(configs, TopicConfig{Name: topic, Group: testGroup, KeyFormat: KeyFormatString})
+		dispatcher.HandleTopic(topic, service)
+	}
+	ac, err := NewAvroConsumer(c.brokers(), c.registries(), configs, testGroup, time.Minute, dispatcher)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	ac.reconnectBackoff = 100 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ac.ConsumeContext(ctx)
+	}()
+	c.t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ac
+}
+
+// recordingService records the jobs it runs and their JobInfo, the jobs fail
+// while fail is set, the next job fails with failOnce, and the jobs wait for
+// the release of the gate while it is set
+type recordingService struct {
+	mu        sync.Mutex
+	jobs      []string
+	infos     []*services.JobInfo
+	cancelled int
+	fail      error
+	failOnce  error
+	gate      chan struct{}
+	started   chan struct{}
+}
+
+func (s *recordingService) Name() string                      { return "recording" }
+func (s *recordingService) Scope() []string                   { return nil }
+func (s *recordingService) Categories() []string              { return nil }
+func (s *recordingService) Version() string                   { return "v0.1.0" }
+func (s *recordingService) Params() map[string][]client.Param { return nil }
+func (s *recordingService) DocTypes() client.DocDefs          { return nil }
+func (s *recordingService) RootDir() string                   { return "" }
+func (s *recordingService) Triggers() utils.Dict              { return nil }
+
+func (s *recordingService) RunJob(ctx context.Context, b []byte) error {
+	s.mu.Lock()
+	gate, started := s.gate, s.started
+	s.mu.Unlock()
+	if gate != nil {
+		started <- struct{}{}
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.cancelled++
+			s.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return s.fail
+	}
+	if err := s.failOnce; err != nil {
+		s.failOnce = nil
+		return err
+	}
+	info, _ := services.JobInfoFromContext(ctx)
+	s.jobs = append(s.jobs, string(b))
+	s.infos = append(s.infos, info)
+	return nil
+}
+
+// hold makes the jobs wait until release or their cancellation, each job
+// reports its start on started
+func (s *recordingService) hold() (started chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gate, s.started = make(chan struct{}), make(chan struct{}, 100)
+	return s.started
+}
+
+func (s *recordingService) setFail(err error) {
+	s.mu.Lock()
+	s.fail = err
+	s.mu.Unlock()
+}
+
+// setFailOnce makes the next job fail with err
+func (s *recordingService) setFailOnce(err error) {
+	s.mu.Lock()
+	s.failOnce = err
+	s.mu.Unlock()
+}
+
+// release lets the held and next jobs run
+func (s *recordingService) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gate != nil {
+		close(s.gate)
+		s.gate = nil
+	}
+}
+
+func (s *recordingService) cancellations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cancelled
+}
+
+func (s *recordingService) jobInfos() []*services.JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*services.JobInfo(nil), s.infos...)
+}
+
+func (s *recordingService) ran() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.jobs...)
+}
@@ -0,0 +1,221 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+/*
+	The protobuf messages are registered with the PROTOBUF schema type, the
+	schema is the text of a .proto file. After the magic byte and the 4-byte
+	schema id, the message indexes give the path of the message type in the
+	file: their zigzag varint count then each index as a zigzag varint, a
+	single 0 standing for the first message of the file.
+	Ref: https://docs.confluent.io/platform/current/schema-registry/serdes-develop/index.html#wire-format
+*/
+
+const protoSchemaFile = "schema.proto"
+
+// protoSchemas caches the parsed .proto files by their text
+var protoSchemas sync.Map
+
+// parseProtoSchema returns the descriptor of the .proto file, the well-known
+// types can be imported
+func parseProtoSchema(schema string) (*desc.FileDescriptor, error) {
+	if fd, ok := protoSchemas.Load(schema); ok {
+		return fd.(*desc.FileDescriptor), nil
+	}
+	parser := protoparse.Parser{
+		Accessor: protoparse.FileContentsFromMap(map[string]string{protoSchemaFile: schema}),
+	}
+	fds, err := parser.ParseFiles(protoSchemaFile)
+	if err != nil {
+		return nil, errors.InvalidArg("bad proto schema", err)
+	}
+	protoSchemas.Store(schema, fds[0])
+	return fds[0], nil
+}
+
+// protoMessageByName returns the descriptor of the message type of the file
+// and its message indexes, name is fully qualified or relative to the package
+func protoMessageByName(fd *desc.FileDescriptor, name string) (*desc.MessageDescriptor, []int, error) {
+	if pkg := fd.GetPackage(); pkg != "" && !strings.HasPrefix(name, pkg+".") {
+		name = pkg + "." + name
+	}
+	md := fd.FindMessage(name)
+	if md == nil {
+		return nil, nil, errors.NotFound("no message type", name, "in proto schema")
+	}
+	var indexes []int
+	for d := desc.Descriptor(md); d != fd; d = d.GetParent() {
+		indexes = append([]int{protoIndexOf(d)}, indexes...)
+	}
+	return md, indexes, nil
+}
+
+// protoIndexOf returns the index of the message type among its siblings
+func protoIndexOf(d desc.Descriptor) int {
+	var siblings []*desc.MessageDescriptor
+	switch parent := d.GetParent().(type) {
+	case *desc.FileDescriptor:
+		siblings = parent.GetMessageTypes()
+	case *desc.MessageDescriptor:
+		siblings = parent.GetNestedMessageTypes()
+	}
+	for i, md := range siblings {
+		if md == d {
+			return i
+		}
+	}
+	return 0
+}
+
+// protoMessageByIndexes returns the descriptor of the message type at the
+// message indexes of the file
+func protoMessageByIndexes(fd *desc.FileDescriptor, indexes []int) (*desc.MessageDescriptor, error) {
+	siblings := fd.GetMessageTypes()
+	var md *desc.MessageDescriptor
+	for _, i := range indexes {
+		if i < 0 || i >= len(siblings) {
+			return nil, errors.BadData("bad message indexes", indexes)
+		}
+		md = siblings[i]
+		siblings = md.GetNestedMessageTypes()
+	}
+	if md == nil {
+		return nil, errors.BadData("no message indexes")
+	}
+	return md, nil
+}
+
+// appendMessageIndexes appends the encoded message indexes to b
+func appendMessageIndexes(b []byte, indexes []int) []byte {
+	if len(indexes) == 1 && indexes[0] == 0 {
+		return append(b, 0)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	b = append(b, buf[:binary.PutVarint(buf, int64(len(indexes)))]...)
+	for _, i := range indexes {
+		b = append(b, buf[:binary.PutVarint(buf, int64(i))]...)
+	}
+	return b
+}
+
+// readMessageIndexes reads the message indexes at the start of b and returns
+// the rest of b
+func readMessageIndexes(b []byte) ([]int, []byte, error) {
+	count, n := binary.Varint(b)
+	if n <= 0 || count < 0 || count > int64(len(b)) {
+		return nil, nil, errors.BadData("bad message indexes")
+	}
+	b = b[n:]
+	if count == 0 {
+		return []int{0}, b, nil
+	}
+	indexes := make([]int, count)
+	for i := range indexes {
+		index, n := binary.Varint(b)
+		if n <= 0 {
+			return nil, nil, errors.BadData("bad message indexes")
+		}
+		indexes[i] = int(index)
+		b = b[n:]
+	}
+	return indexes, b, nil
+}
+
+// registerProto registers the .proto file under the subject of the topic key
+// or value, the record name of the subject name strategies is the fully
+// qualified name of the message type
+func registerProto(client *CachedSchemaRegistryClient, subjects *subjectNames, topic string, isKey bool,
+	schema string, message string) (*desc.MessageDescriptor, []int, int, error) {
+	fd, err := parseProtoSchema(schema)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	md, indexes, err := protoMessageByName(fd, message)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	subject, err := subjects.subject(topic, isKey, md.GetFullyQualifiedName())
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	schemaId, err := client.CreateRawSubject(subject, &RawSchema{Schema: schema, SchemaType: SchemaTypeProtobuf})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return md, indexes, schemaId, nil
+}
+
+// encodeProto encodes the textual JSON value as the message type of the
+// .proto file with the schema id and message indexes framing
+func encodeProto(client *CachedSchemaRegistryClient, subjects *subjectNames, topic string, isKey bool,
+	schema string, message string, value []byte) (*AvroEncoder, error) {
+	md, indexes, schemaId, err := registerProto(client, subjects, topic, isKey, schema, message)
+	if err != nil {
+		return nil, err
+	}
+	dm := dynamic.NewMessage(md)
+	if err := dm.UnmarshalJSON(value); err != nil {
+		return nil, errors.BadData(err)
+	}
+	binaryValue, err := dm.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return &AvroEncoder{
+		SchemaID: schemaId,
+		Content:  append(appendMessageIndexes(nil, indexes), binaryValue...),
+	}, nil
+}
+
+// encodeProtoValue is like encodeProto for a generated message, whose type
+// must be declared by the .proto file
+func encodeProtoValue(client *CachedSchemaRegistryClient, subjects *subjectNames, topic string, isKey bool,
+	schema string, v proto.Message) (*AvroEncoder, error) {
+	_, indexes, schemaId, err := registerProto(client, subjects, topic, isKey, schema, proto.MessageName(v))
+	if err != nil {
+		return nil, err
+	}
+	binaryValue, err := proto.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroEncoder{
+		SchemaID: schemaId,
+		Content:  append(appendMessageIndexes(nil, indexes), binaryValue...),
+	}, nil
+}
+
+// protobufDecoder decodes the protobuf messages as the message type their
+// message indexes point to in the .proto schema
+type protobufDecoder struct{}
+
+func (protobufDecoder) decode(ctx context.Context, schemaId int, schema *RawSchema, b []byte) (*Payload, string, error) {
+	fd, err := parseProtoSchema(schema.Schema)
+	if err != nil {
+		return nil, "", errors.BadData(err)
+	}
+	indexes, b, err := readMessageIndexes(b)
+	if err != nil {
+		return nil, "", err
+	}
+	md, err := protoMessageByIndexes(fd, indexes)
+	if err != nil {
+		return nil, "", err
+	}
+	dm := dynamic.NewMessage(md)
+	if err := dm.Unmarshal(b); err != nil {
+		return nil, "", errors.BadData(err)
+	}
+	return &Payload{value: dm}, md.GetFullyQualifiedName(), nil
+}
@@ -0,0 +1,128 @@
+package kafka
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+const testProtoSchema = `
+syntax = "proto3";
+package test;
+
+message Car {
+	string model = 1;
+}
+
+message Garage {
+	message Slot {
+		message Lock {
+			bool closed = 1;
+		}
+		int32 number = 1;
+	}
+	message Owner {
+		string name = 1;
+	}
+	repeated Slot slots = 1;
+}
+`
+
+func TestMessageIndexesEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		indexes []int
+		encoded []byte
+	}{
+		{"first message shortcut", []int{0}, []byte{0x00}},
+		{"second message", []int{1}, []byte{0x02, 0x02}},
+		{"nested message", []int{1, 0}, []byte{0x04, 0x02, 0x00}},
+		{"deeply nested message", []int{1, 0, 0}, []byte{0x06, 0x02, 0x00, 0x00}},
+		{"large index", []int{64}, []byte{0x02, 0x80, 0x01}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := appendMessageIndexes(nil, test.indexes)
+			if !bytes.Equal(encoded, test.encoded) {
+				t.Fatalf("encoded % x, want % x", encoded, test.encoded)
+			}
+			indexes, rest, err := readMessageIndexes(append(encoded, 0xaa))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(indexes, test.indexes) {
+				t.Fatalf("decoded %v, want %v", indexes, test.indexes)
+			}
+			if !bytes.Equal(rest, []byte{0xaa}) {
+				t.Fatalf("rest % x, want aa", rest)
+			}
+		})
+	}
+}
+
+func TestReadMessageIndexesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"truncated count", []byte{0x80}},
+		{"negative count", []byte{0x01}},
+		{"count past the data", []byte{0x7e, 0x00}},
+		{"truncated indexes", []byte{0x04, 0x02}},
+		{"truncated index", []byte{0x02, 0x80}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := readMessageIndexes(test.b); !errors.IsBadData(err) {
+				t.Fatalf("error %v, want BadData", err)
+			}
+		})
+	}
+}
+
+func TestProtoMessageIndexes(t *testing.T) {
+	fd, err := parseProtoSchema(testProtoSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		message string
+		indexes []int
+	}{
+		{"Car", []int{0}},
+		{"test.Garage", []int{1}},
+		{"Garage.Slot", []int{1, 0}},
+		{"Garage.Owner", []int{1, 1}},
+		{"Garage.Slot.Lock", []int{1, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.message, func(t *testing.T) {
+			md, indexes, err := protoMessageByName(fd, test.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(indexes, test.indexes) {
+				t.Fatalf("indexes %v, want %v", indexes, test.indexes)
+			}
+			found, err := protoMessageByIndexes(fd, indexes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != md {
+				t.Fatalf("indexes %v point to %s, want %s", indexes, found.GetFullyQualifiedName(), md.GetFullyQualifiedName())
+			}
+		})
+	}
+
+	if _, _, err := protoMessageByName(fd, "Truck"); !errors.IsNotFound(err) {
+		t.Errorf("unknown message type: %v", err)
+	}
+	for _, indexes := range [][]int{{2}, {-1}, {0, 0}, {1, 2}, {1, 0, 1}, nil} {
+		if _, err := protoMessageByIndexes(fd, indexes); !errors.IsBadData(err) {
+			t.Errorf("indexes %v: error %v, want BadData", indexes, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package kafka
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+const (
+	// defaultLatestTTL is how long the latest version and the versions of a
+	// subject are cached, a new version is seen at most that late
+	defaultLatestTTL = 30 * time.Second
+	// defaultNegativeTTL is how long the not found ids and subjects are cached
+	defaultNegativeTTL = 10 * time.Second
+)
+
+// registryCacheVars publishes the counters of all the cached clients under
+// /debug/vars
+var registryCacheVars = expvar.NewMap("schemaRegistryCache")
+
+// CacheStats counts the lookups of a CachedSchemaRegistryClient
+type CacheStats struct {
+	// Hits are the lookups answered from the cache
+	Hits int64
+	// Misses are the lookups sent to the registry
+	Misses int64
+	// NegativeHits are the lookups answered with a cached not found
+	NegativeHits int64
+	// SharedFlights are the lookups which waited for the same concurrent
+	// request rather than sending their own
+	SharedFlights int64
+}
+
+// cacheCounters are the atomic counters of CacheStats
+type cacheCounters struct {
+	hits, misses, negativeHits, sharedFlights int64
+}
+
+func (c *cacheCounters) hit() {
+	atomic.AddInt64(&c.hits, 1)
+	registryCacheVars.Add("hits", 1)
+}
+
+func (c *cacheCounters) miss() {
+	atomic.AddInt64(&c.misses, 1)
+	registryCacheVars.Add("misses", 1)
+}
+
+func (c *cacheCounters) negativeHit() {
+	atomic.AddInt64(&c.negativeHits, 1)
+	registryCacheVars.Add("negativeHits", 1)
+}
+
+func (c *cacheCounters) sharedFlight() {
+	atomic.AddInt64(&c.sharedFlights, 1)
+	registryCacheVars.Add("sharedFlights", 1)
+}
+
+func (c *cacheCounters) stats() CacheStats {
+	return CacheStats{
+		Hits:          atomic.LoadInt64(&c.hits),
+		Misses:        atomic.LoadInt64(&c.misses),
+		NegativeHits:  atomic.LoadInt64(&c.negativeHits),
+		SharedFlights: atomic.LoadInt64(&c.sharedFlights),
+	}
+}
+
+// Kinds of the lookups
+const (
+	lookupId         = "id"
+	lookupVersions   = "versions"
+	lookupVersion    = "version"
+	lookupLatest     = "latest"
+	lookupRegistered = "registered"
+	lookupCreate     = "create"
+)
+
+// lookupKey identifies a registry lookup, schema is the schemaKey of the
+// registered and create lookups
+type lookupKey struct {
+	kind    string
+	subject string
+	id      int
+	schema  string
+}
+
+// lookupEntry is a cached result or not found error, it never expires when
+// expires is zero
+type lookupEntry struct {
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// lookupCache caches the results of the lookups with their ttl
+type lookupCache struct {
+	mu      sync.RWMutex
+	entries map[lookupKey]lookupEntry
+}
+
+func newLookupCache() *lookupCache {
+	return &lookupCache{entries: make(map[lookupKey]lookupEntry)}
+}
+
+func (c *lookupCache) get(key lookupKey) (lookupEntry, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		return lookupEntry{}, false
+	}
+	return entry, true
+}
+
+// set caches the entry for ttl, forever when ttl is 0
+func (c *lookupCache) set(key lookupKey, value interface{}, err error, ttl time.Duration) {
+	entry := lookupEntry{value: value, err: err}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+}
+
+// dropSubject forgets the lookups of the subject
+func (c *lookupCache) dropSubject(subject string) {
+	c.mu.Lock()
+	for key := range c.entries {
+		if key.subject == subject {
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// flightCall is a lookup in flight, done is closed once it has its result
+type flightCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// flightGroup runs a single request for the concurrent identical lookups,
+// like golang.org/x/sync/singleflight
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[lookupKey]*flightCall
+}
+
+// do runs fetch unless a call of the key is in flight, in which case it waits
+// for its result, shared tells that the result comes from another call. The
+// fetch runs on a context of its own, bounded by the timeout of the client,
+// so that a caller giving up does not fail the others: it returns the error
+// of its ctx while the fetch goes on for them.
+func (g *flightGroup) do(ctx context.Context, key lookupKey,
+	fetch func(ctx context.Context) (interface{}, error)) (value interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[lookupKey]*flightCall)
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			call.value, call.err = fetch(context.Background())
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err, shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), shared
+	}
+}
+
+// lookup answers the lookup from the cache or sends a single request for the
+// concurrent misses, the results are cached for ttl and the not found errors
+// for the negative ttl. A negative ttl keeps the not found errors only, for
+// the results cached by the caller.
+func (client *CachedSchemaRegistryClient) lookup(ctx context.Context, key lookupKey, ttl time.Duration,
+	fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if entry, ok := client.lookups.get(key); ok {
+		if entry.err != nil {
+			client.counters.negativeHit()
+		} else {
+			client.counters.hit()
+		}
+		return entry.value, entry.err
+	}
+	value, err, shared := client.flights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		client.counters.miss()
+		value, err := fetch(ctx)
+		if err == nil {
+			if ttl >= 0 {
+				client.lookups.set(key, value, nil, ttl)
+			}
+		} else if errors.IsNotFound(err) {
+			client.lookups.set(key, nil, err, client.negativeTTL)
+		}
+		return value, err
+	})
+	if shared {
+		client.counters.sharedFlight()
+	}
+	return value, err
+}
+
+// Stats returns the counters of the lookups of the client
+func (client *CachedSchemaRegistryClient) Stats() CacheStats {
+	return client.counters.stats()
+}
@@ -0,0 +1,251 @@
+package kafka
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/kafka/registrytest"
+)
+
+// countingRegistry counts the requests of each path, the requests wait for
+// the gate when it is set
+type countingRegistry struct {
+	registry *registrytest.Registry
+	url      string
+
+	mu     sync.Mutex
+	counts map[string]int
+	gate   chan struct{}
+}
+
+func newCountingRegistry(t *testing.T) *countingRegistry {
+	c := &countingRegistry{registry: registrytest.New(), counts: make(map[string]int)}
+	server := httptest.NewServer(c)
+	t.Cleanup(server.Close)
+	c.url = server.URL
+	return c
+}
+
+func (c *countingRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.counts[r.Method+" "+r.URL.Path]++
+	gate := c.gate
+	c.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	c.registry.ServeHTTP(w, r)
+}
+
+func (c *countingRegistry) count(method, path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[method+" "+path]
+}
+
+func (c *countingRegistry) hold() {
+	c.mu.Lock()
+	c.gate = make(chan struct{})
+	c.mu.Unlock()
+}
+
+func (c *countingRegistry) release() {
+	c.mu.Lock()
+	close(c.gate)
+	c.gate = nil
+	c.mu.Unlock()
+}
+
+func (c *countingRegistry) client(opts SchemaRegistryOptions) *CachedSchemaRegistryClient {
+	return NewCachedSchemaRegistryClientWithOptions([]string{c.url}, opts)
+}
+
+const jobSchemaV2 = `{"type": "record", "name": "Job", "fields": [
+	{"name": "id", "type": "int"}, {"name": "priority", "type": "int", "default": 0}]}`
+
+func TestLatestSchemaTTL(t *testing.T) {
+	registry := newCountingRegistry(t)
+	// the schemas are registered by another client
+	other := NewSchemaRegistryClient([]string{registry.url})
+	if _, err := other.CreateSubject("jobs-value", newTestCodec(t, testSchema)); err != nil {
+		t.Fatal(err)
+	}
+	client := registry.client(SchemaRegistryOptions{LatestTTL: 500 * time.Millisecond})
+	const latest = "/subjects/jobs-value/versions/latest"
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetLatestSchema("jobs-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := registry.count("GET", latest); n != 1 {
+		t.Fatalf("%d latest requests, want 1", n)
+	}
+	if _, err := other.CreateSubject("jobs-value", newTestCodec(t, jobSchemaV2)); err != nil {
+		t.Fatal(err)
+	}
+	// the new version is seen once the ttl expired
+	codec, err := client.GetLatestSchema("jobs-value")
+	if err != nil || codec.Schema() != newTestCodec(t, testSchema).Schema() {
+		t.Fatalf("cached latest schema %v, %v, want the first version", codec, err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	codec, err = client.GetLatestSchema("jobs-value")
+	if err != nil || codec.Schema() != newTestCodec(t, jobSchemaV2).Schema() {
+		t.Fatalf("latest schema %v, %v, want the second version", codec, err)
+	}
+	if n := registry.count("GET", latest); n != 2 {
+		t.Fatalf("%d latest requests, want 2", n)
+	}
+	if stats := client.Stats(); stats.Hits != 3 || stats.Misses != 2 {
+		t.Fatalf("stats %+v, want 3 hits and 2 misses", stats)
+	}
+}
+
+func TestCreateSubjectDropsItsLookups(t *testing.T) {
+	registry := newCountingRegistry(t)
+	client := registry.client(SchemaRegistryOptions{LatestTTL: time.Hour})
+	if _, err := client.CreateSubject("jobs-value", newTestCodec(t, testSchema)); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := client.GetVersions("jobs-value"); err != nil || len(versions) != 1 {
+		t.Fatalf("versions %v, %v", versions, err)
+	}
+	if _, err := client.CreateSubject("jobs-value", newTestCodec(t, jobSchemaV2)); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := client.GetVersions("jobs-value"); err != nil || len(versions) != 2 {
+		t.Fatalf("versions %v, %v after a new version", versions, err)
+	}
+	// the schema is registered once per subject
+	if _, err := client.CreateSubject("jobs-value", newTestCodec(t, jobSchemaV2)); err != nil {
+		t.Fatal(err)
+	}
+	if n := registry.count("POST", "/subjects/jobs-value/versions"); n != 2 {
+		t.Fatalf("%d register requests, want 2", n)
+	}
+	// a version never changes
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetSchemaByVersion("jobs-value", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := registry.count("GET", "/subjects/jobs-value/versions/1"); n != 1 {
+		t.Fatalf("%d version requests, want 1", n)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	registry := newCountingRegistry(t)
+	client := registry.client(SchemaRegistryOptions{NegativeTTL: 500 * time.Millisecond})
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetRawSchema(42); !errors.IsNotFound(err) {
+			t.Fatalf("unknown schema id: %v, want NotFound", err)
+		}
+	}
+	if n := registry.count("GET", "/schemas/ids/42"); n != 1 {
+		t.Fatalf("%d requests of a not found id, want 1", n)
+	}
+	if stats := client.Stats(); stats.NegativeHits != 2 || stats.Misses != 1 {
+		t.Fatalf("stats %+v, want 2 negative hits and 1 miss", stats)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if _, err := client.GetRawSchema(42); !errors.IsNotFound(err) {
+		t.Fatalf("unknown schema id: %v, want NotFound", err)
+	}
+	if n := registry.count("GET", "/schemas/ids/42"); n != 2 {
+		t.Fatalf("%d requests once the negative ttl expired, want 2", n)
+	}
+
+	// the other errors are not cached
+	failing := NewCachedSchemaRegistryClientWithRetries([]string{"http://127.0.0.1:1"}, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := failing.GetRawSchema(1); err == nil || errors.IsNotFound(err) {
+			t.Fatalf("unreachable registry: %v", err)
+		}
+	}
+	if stats := failing.Stats(); stats.Misses != 2 || stats.NegativeHits != 0 {
+		t.Fatalf("stats %+v, want 2 misses", stats)
+	}
+}
+
+func TestConcurrentMissesShareARequest(t *testing.T) {
+	registry := newCountingRegistry(t)
+	other := NewSchemaRegistryClient([]string{registry.url})
+	if _, err := other.CreateSubject("jobs-value", newTestCodec(t, testSchema)); err != nil {
+		t.Fatal(err)
+	}
+	client := registry.client(SchemaRegistryOptions{})
+	registry.hold()
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.GetLatestSchema("jobs-value")
+			errs <- err
+		}()
+	}
+	// let the lookups pile up on the request in flight
+	time.Sleep(100 * time.Millisecond)
+	registry.release()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := registry.count("GET", "/subjects/jobs-value/versions/latest"); count != 1 {
+		t.Fatalf("%d requests of concurrent lookups, want 1", count)
+	}
+	stats := client.Stats()
+	if stats.Misses != 1 || stats.SharedFlights == 0 || stats.SharedFlights+stats.Hits != n-1 {
+		t.Fatalf("stats %+v, want 1 miss and the other lookups shared", stats)
+	}
+}
+
+func TestCancelledLookupDoesNotFailTheOthers(t *testing.T) {
+	registry := newCountingRegistry(t)
+	other := NewSchemaRegistryClient([]string{registry.url})
+	if _, err := other.CreateSubject("jobs-value", newTestCodec(t, testSchema)); err != nil {
+		t.Fatal(err)
+	}
+	client := registry.client(SchemaRegistryOptions{})
+	registry.hold()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := client.GetLatestSchemaContext(ctx, "jobs-value")
+		first <- err
+	}()
+	// the second lookup shares the request of the first one
+	time.Sleep(50 * time.Millisecond)
+	second := make(chan error, 1)
+	go func() {
+		_, err := client.GetLatestSchemaContext(context.Background(), "jobs-value")
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("cancelled lookup: %v, want context.Canceled", err)
+	}
+	registry.release()
+	if err := <-second; err != nil {
+		t.Fatalf("lookup sharing a cancelled request: %v", err)
+	}
+	if n := registry.count("GET", "/subjects/jobs-value/versions/latest"); n != 1 {
+		t.Fatalf("%d latest requests, want 1", n)
+	}
+}
@@ -0,0 +1,174 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+/*
+	The failed registry requests are retried on the next server after a
+	backoff: the transport errors and the 5xx responses only, a 4xx response is
+	the answer of the registry and is returned at once as a *RegistryError.
+*/
+
+// maxErrorBodyLength bounds the error responses read from the registry
+const maxErrorBodyLength = 64 * 1024
+
+// defaultRegistryBackoff waits 100ms, 200ms, 400ms... up to 2s between retries
+var defaultRegistryBackoff = registryBackoff{initial: 100 * time.Millisecond, max: 2 * time.Second}
+
+// RegistryError is an error response of the schema registry
+type RegistryError struct {
+	StatusCode int `json:"-"`
+	// ErrorCode is the error code of the registry, such as 40401 for an
+	// unknown subject or 409 for an incompatible schema
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+
+	// kind is the error of pkg/errors the status code stands for
+	kind error
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("schema registry error %d: %s", e.ErrorCode, e.Message)
+}
+
+// Unwrap gives the kind of the error, so that errors.IsNotFound holds for a
+// 404 response, errors.IsConflict for a 409 and errors.IsBadService otherwise
+func (e *RegistryError) Unwrap() error {
+	return e.kind
+}
+
+// newRegistryError reads the error response, the error code is the status
+// code when the body is not the JSON error of the registry
+func newRegistryError(method, uri string, resp *http.Response) *RegistryError {
+	e := &RegistryError{StatusCode: resp.StatusCode}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLength))
+	if err := json.Unmarshal(body, e); err != nil || e.ErrorCode == 0 {
+		e.ErrorCode = resp.StatusCode
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		e.kind = errors.NotFound(method, uri)
+	case http.StatusConflict:
+		e.kind = errors.Conflict(method, uri)
+	default:
+		e.kind = errors.BadService(method, uri)
+	}
+	return e
+}
+
+// registryBackoff is an exponential backoff with jitter
+type registryBackoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+// delay returns the delay before the retry, a random duration between the
+// half and the whole of the exponential delay so that the clients do not
+// retry in step
+func (b registryBackoff) delay(retry int) time.Duration {
+	d := b.initial
+	for i := 0; i < retry && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// httpCall sends the request to the servers in turn until one answers, the
+// payload is buffered to be sent again on each retry
+func (client *SchemaRegistryClient) httpCall(ctx context.Context, method, uri string, payload io.Reader) ([]byte, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = ioutil.ReadAll(payload); err != nil {
+			return nil, err
+		}
+	}
+	nServers := len(client.SchemaRegistryConnect)
+	offset := rand.Intn(nServers)
+	for i := 0; ; i++ {
+		url := fmt.Sprintf("%s%s", client.SchemaRegistryConnect[(i+offset)%nServers], uri)
+		resp, err := client.do(ctx, method, url, body)
+		if err == nil {
+			return resp, nil
+		}
+		if i >= client.retries || !retriable(ctx, err) {
+			return nil, err
+		}
+		log.Debugf("schema registry %s %s failed, retrying: %s", method, url, err)
+		if err := sleepContext(ctx, client.backoff.delay(i)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// do sends a single request and reads the response
+func (client *SchemaRegistryClient) do(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	var payload io.Reader
+	if body != nil {
+		payload = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if client.authorizer != nil {
+		req.Header.Set("Authorization", client.authorizer.AuthHeader())
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if !okStatus(resp) {
+		return nil, newRegistryError(method, req.URL.RequestURI(), resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// retriable tells if the failed request can be sent again: the transport
+// errors and the 5xx responses, unless ctx is done
+func retriable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var registryErr *RegistryError
+	if errors.As(err, &registryErr) {
+		return registryErr.StatusCode >= 500 && registryErr.StatusCode < 600
+	}
+	return true
+}
+
+func okStatus(resp *http.Response) bool {
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -0,0 +1,185 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/kafka/registrytest"
+)
+
+// flakyRegistry answers the first requests with the statuses then serves the
+// registry, it records the body of every request
+type flakyRegistry struct {
+	registry *registrytest.Registry
+
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func newFlakyRegistry(t *testing.T, statuses ...int) (*flakyRegistry, string) {
+	f := &flakyRegistry{registry: registrytest.New(), statuses: statuses}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func (f *flakyRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	f.bodies = append(f.bodies, string(body))
+	var status int
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+	f.mu.Unlock()
+	switch status {
+	case 0:
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		f.registry.ServeHTTP(w, r)
+	case http.StatusUnprocessableEntity:
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error_code": 42201, "message": "Invalid schema"}`))
+	default:
+		w.WriteHeader(status)
+	}
+}
+
+func (f *flakyRegistry) requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.bodies...)
+}
+
+func newRetryingClient(url string) *SchemaRegistryClient {
+	return NewSchemaRegistryClientWithOptions([]string{url}, SchemaRegistryOptions{
+		Retries:    3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+	})
+}
+
+func TestRegistryRetriesReplayTheBody(t *testing.T) {
+	registry, url := newFlakyRegistry(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+	id, err := newRetryingClient(url).CreateRawSubject("jobs-value", &RawSchema{Schema: testSchema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Fatalf("schema id %d, want 1", id)
+	}
+	bodies := registry.requests()
+	if len(bodies) != 3 {
+		t.Fatalf("%d requests, want 2 failures and the retry", len(bodies))
+	}
+	for i, body := range bodies {
+		if body == "" || body != bodies[0] {
+			t.Fatalf("request %d sent the body %q, want %q", i, body, bodies[0])
+		}
+	}
+}
+
+func TestRegistryRetriesAreBounded(t *testing.T) {
+	registry, url := newFlakyRegistry(t, 500, 500, 500, 500, 500)
+	_, err := newRetryingClient(url).GetSubjects()
+	if !errors.IsBadService(err) {
+		t.Fatalf("error %v, want BadService", err)
+	}
+	if n := len(registry.requests()); n != 4 {
+		t.Fatalf("%d requests, want the request and 3 retries", n)
+	}
+}
+
+func TestRegistryClientErrorsAreNotRetried(t *testing.T) {
+	registry, url := newFlakyRegistry(t, http.StatusUnprocessableEntity)
+	_, err := newRetryingClient(url).CreateRawSubject("jobs-value", &RawSchema{Schema: testSchema})
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) {
+		t.Fatalf("error %v, want a RegistryError", err)
+	}
+	if registryErr.StatusCode != 422 || registryErr.ErrorCode != 42201 || registryErr.Message != "Invalid schema" {
+		t.Fatalf("registry error %+v", registryErr)
+	}
+	if n := len(registry.requests()); n != 1 {
+		t.Fatalf("%d requests of a 4xx, want 1", n)
+	}
+}
+
+func TestRegistryErrorKinds(t *testing.T) {
+	_, url := newFlakyRegistry(t)
+	client := newRetryingClient(url)
+	if _, err := client.GetSchema(42); !errors.IsNotFound(err) {
+		t.Errorf("unknown schema id: %v, want NotFound", err)
+	}
+	if _, err := client.GetLatestSchema("cars-value"); !errors.IsNotFound(err) {
+		t.Errorf("unknown subject: %v, want NotFound", err)
+	}
+	var registryErr *RegistryError
+	if _, err := client.GetSchema(42); !errors.As(err, &registryErr) || registryErr.ErrorCode != 40403 {
+		t.Errorf("unknown schema id error code: %v", err)
+	}
+
+	if _, err := client.CreateSubject("jobs-value", newTestCodec(t, testSchema)); err != nil {
+		t.Fatal(err)
+	}
+	incompatible := newTestCodec(t, `{"type": "record", "name": "Job", "fields": [{"name": "id", "type": "string"}]}`)
+	_, err := client.CreateSubject("jobs-value", incompatible)
+	if !errors.IsConflict(err) {
+		t.Errorf("incompatible schema: %v, want Conflict", err)
+	}
+	if !errors.As(err, &registryErr) || registryErr.ErrorCode != 409 {
+		t.Errorf("incompatible schema error code: %v", err)
+	}
+}
+
+func TestRegistryRetryStopsWithContext(t *testing.T) {
+	registry, url := newFlakyRegistry(t, 500, 500, 500, 500)
+	client := NewSchemaRegistryClientWithOptions([]string{url}, SchemaRegistryOptions{
+		Retries: 3,
+		Backoff: time.Minute,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.GetSubjectsContext(ctx); err == nil {
+		t.Fatal("no error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("retry backoff ended after %s", elapsed)
+	}
+	if n := len(registry.requests()); n != 1 {
+		t.Fatalf("%d requests, want 1 before the context is done", n)
+	}
+}
+
+func TestRegistryBackoff(t *testing.T) {
+	b := registryBackoff{initial: 100 * time.Millisecond, max: time.Second}
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{10, time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			if d := b.delay(test.retry); d < test.max/2 || d > test.max {
+				t.Fatalf("delay of retry %d = %s, want between %s and %s", test.retry, d, test.max/2, test.max)
+			}
+		}
+	}
+	if d := (registryBackoff{}).delay(3); d != 0 {
+		t.Errorf("delay without backoff = %s", d)
+	}
+}
@@ -0,0 +1,248 @@
+package registrytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/*
+	The compatibility of the Avro schemas follows the schema resolution of the
+	Avro specification: a backward compatible schema reads the data written
+	with the previous one, a forward compatible one writes data the previous
+	one reads. The JSON and protobuf schemas are always compatible.
+*/
+
+var levels = []string{
+	"NONE",
+	"BACKWARD", "BACKWARD_TRANSITIVE",
+	"FORWARD", "FORWARD_TRANSITIVE",
+	"FULL", "FULL_TRANSITIVE",
+}
+
+func validLevel(level string) bool {
+	for _, l := range levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// avroPromotions gives the writer types each reader type reads
+var avroPromotions = map[string][]string{
+	"long":   {"int"},
+	"float":  {"int", "long"},
+	"double": {"int", "long", "float"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// compatible returns the incompatibilities of the new schema with the old one
+// under the compatibility level
+func compatible(level string, new, old schema) []string {
+	if level == "NONE" {
+		return nil
+	}
+	if new.schemaType() != old.schemaType() {
+		return []string{fmt.Sprintf("schema type %s differs from %s", new.schemaType(), old.schemaType())}
+	}
+	if new.schemaType() != schemaTypeAvro {
+		return nil
+	}
+	var newSchema, oldSchema interface{}
+	if err := json.Unmarshal([]byte(new.Schema), &newSchema); err != nil {
+		return []string{err.Error()}
+	}
+	if err := json.Unmarshal([]byte(old.Schema), &oldSchema); err != nil {
+		return []string{err.Error()}
+	}
+	var messages []string
+	if !strings.HasPrefix(level, "FORWARD") {
+		messages = append(messages, avroCanRead(newSchema, oldSchema, "")...)
+	}
+	if !strings.HasPrefix(level, "BACKWARD") {
+		messages = append(messages, avroCanRead(oldSchema, newSchema, "")...)
+	}
+	return messages
+}
+
+// avroType returns the type name of the schema, the name of a named type
+// reference, "union" for a union
+func avroType(s interface{}) string {
+	switch s := s.(type) {
+	case string:
+		return s
+	case []interface{}:
+		return "union"
+	case map[string]interface{}:
+		if t, ok := s["type"].(string); ok {
+			return t
+		}
+		return avroType(s["type"])
+	}
+	return ""
+}
+
+// avroCanRead returns why the reader schema cannot read the data of the writer
+// schema, path locates the field in the messages
+func avroCanRead(reader, writer interface{}, path string) []string {
+	reader, writer = unwrap(reader), unwrap(writer)
+	readerType, writerType := avroType(reader), avroType(writer)
+	if avroName(reader) != "" && avroName(reader) == avroName(writer) &&
+		(!isMap(reader) || !isMap(writer)) {
+		// a reference to a named type already checked
+		return nil
+	}
+	if writerType == "union" {
+		var messages []string
+		for _, branch := range writer.([]interface{}) {
+			messages = append(messages, avroCanRead(reader, branch, path)...)
+		}
+		return messages
+	}
+	if readerType == "union" {
+		for _, branch := range reader.([]interface{}) {
+			if len(avroCanRead(branch, writer, path)) == 0 {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("%s: reader union lacks writer type %s", at(path), writerType)}
+	}
+	if m, ok := reader.(map[string]interface{}); ok && !avroPrimitives[readerType] {
+		if m2, ok := writer.(map[string]interface{}); ok {
+			return avroCanReadComplex(readerType, m, writerType, m2, path)
+		}
+	}
+	if readerType == writerType {
+		return nil
+	}
+	for _, t := range avroPromotions[readerType] {
+		if t == writerType {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("%s: reader type %s does not read writer type %s", at(path), readerType, writerType)}
+}
+
+func avroCanReadComplex(readerType string, reader map[string]interface{}, writerType string,
+	writer map[string]interface{}, path string) []string {
+	if readerType != writerType {
+		return []string{fmt.Sprintf("%s: reader type %s does not read writer type %s", at(path), readerType, writerType)}
+	}
+	switch readerType {
+	case "record":
+		return avroCanReadRecord(reader, writer, path)
+	case "array":
+		return avroCanRead(reader["items"], writer["items"], path+"[]")
+	case "map":
+		return avroCanRead(reader["values"], writer["values"], path+"{}")
+	case "enum":
+		if _, ok := reader["default"]; ok {
+			return nil
+		}
+		symbols := make(map[interface{}]bool)
+		for _, s := range reader["symbols"].([]interface{}) {
+			symbols[s] = true
+		}
+		var messages []string
+		for _, s := range writer["symbols"].([]interface{}) {
+			if !symbols[s] {
+				messages = append(messages, fmt.Sprintf("%s: reader enum lacks symbol %v", at(path), s))
+			}
+		}
+		return messages
+	case "fixed":
+		if reader["size"] != writer["size"] {
+			return []string{fmt.Sprintf("%s: fixed size %v differs from %v", at(path), reader["size"], writer["size"])}
+		}
+	}
+	return nil
+}
+
+func avroCanReadRecord(reader, writer map[string]interface{}, path string) []string {
+	writerFields := make(map[string]map[string]interface{})
+	for _, f := range fields(writer) {
+		writerFields[f["name"].(string)] = f
+	}
+	var messages []string
+	for _, f := range fields(reader) {
+		name := f["name"].(string)
+		w, ok := writerFields[name]
+		if !ok {
+			if _, ok := f["default"]; !ok {
+				messages = append(messages, fmt.Sprintf("%s: reader field has no default and is missing from the writer", at(join(path, name))))
+			}
+			continue
+		}
+		messages = append(messages, avroCanRead(f["type"], w["type"], join(path, name))...)
+	}
+	return messages
+}
+
+// unwrap returns the type of {"type": {...}}
+func unwrap(s interface{}) interface{} {
+	if m, ok := s.(map[string]interface{}); ok {
+		if t, ok := m["type"]; ok && !isString(t) {
+			return unwrap(t)
+		}
+	}
+	return s
+}
+
+// avroName returns the name of a named type or of a reference to it
+func avroName(s interface{}) string {
+	switch s := s.(type) {
+	case string:
+		if !avroPrimitives[s] {
+			return s
+		}
+	case map[string]interface{}:
+		name, _ := s["name"].(string)
+		if ns, ok := s["namespace"].(string); ok && ns != "" && !strings.Contains(name, ".") {
+			return ns + "." + name
+		}
+		return name
+	}
+	return ""
+}
+
+func isMap(s interface{}) bool {
+	_, ok := s.(map[string]interface{})
+	return ok
+}
+
+func isString(s interface{}) bool {
+	_, ok := s.(string)
+	return ok
+}
+
+func fields(record map[string]interface{}) []map[string]interface{} {
+	list, _ := record["fields"].([]interface{})
+	fields := make([]map[string]interface{}, 0, len(list))
+	for _, f := range list {
+		if f, ok := f.(map[string]interface{}); ok {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func at(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
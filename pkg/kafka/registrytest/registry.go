@@ -0,0 +1,396 @@
+// Package registrytest is an in-memory fake of the schema registry REST API
+// used by kafka.SchemaRegistryClient, for the tests and the local development
+// without the Confluent registry.
+package registrytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// Schema types of the registry
+const (
+	schemaTypeAvro     = "AVRO"
+	schemaTypeJSON     = "JSON"
+	schemaTypeProtobuf = "PROTOBUF"
+)
+
+// Error codes of the registry
+const (
+	errSubjectNotFound       = 40401
+	errVersionNotFound       = 40402
+	errSchemaNotFound        = 40403
+	errIncompatibleSchema    = 409
+	errInvalidSchema         = 42201
+	errInvalidVersion        = 42202
+	errInvalidCompatibility  = 42203
+	errSubjectConfigNotFound = 40408
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// schema is a registered schema, the type of the Avro schemas is omitted
+type schema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+func (s schema) schemaType() string {
+	if s.SchemaType == "" {
+		return schemaTypeAvro
+	}
+	return s.SchemaType
+}
+
+// version is a version of a subject
+type version struct {
+	version int
+	id      int
+}
+
+// Registry keeps the schemas and the subjects in memory, it serves the REST
+// API of the schema registry
+type Registry struct {
+	mu       sync.Mutex
+	schemas  []schema
+	ids      map[schema]int
+	subjects map[string][]version
+	// next is the next version of each subject, the versions of the deleted
+	// subjects are not reused
+	next    map[string]int
+	global  string
+	configs map[string]string
+}
+
+// New returns an empty registry with the BACKWARD compatibility level
+func New() *Registry {
+	return &Registry{
+		ids:      make(map[schema]int),
+		subjects: make(map[string][]version),
+		next:     make(map[string]int),
+		global:   "BACKWARD",
+		configs:  make(map[string]string),
+	}
+}
+
+// NewServer starts a server of an empty registry, it is closed by the caller
+func NewServer() *httptest.Server {
+	return httptest.NewServer(New())
+}
+
+// registryError is the error response of the registry
+type registryError struct {
+	status    int
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func newError(status, code int, format string, args ...interface{}) *registryError {
+	return &registryError{status: status, ErrorCode: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// ServeHTTP implements http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	resp, err := r.route(req)
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", contentType)
+	if err != nil {
+		w.WriteHeader(err.status)
+		resp = err
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (r *Registry) route(req *http.Request) (interface{}, *registryError) {
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	method := req.Method
+	switch {
+	case len(path) == 3 && path[0] == "schemas" && path[1] == "ids" && method == http.MethodGet:
+		return r.getSchema(path[2])
+	case len(path) == 1 && path[0] == "subjects" && method == http.MethodGet:
+		return r.getSubjects(), nil
+	case len(path) == 2 && path[0] == "subjects" && method == http.MethodPost:
+		return r.lookupSchema(path[1], req)
+	case len(path) == 2 && path[0] == "subjects" && method == http.MethodDelete:
+		return r.deleteSubject(path[1])
+	case len(path) == 3 && path[0] == "subjects" && path[2] == "versions" && method == http.MethodGet:
+		return r.getVersions(path[1])
+	case len(path) == 3 && path[0] == "subjects" && path[2] == "versions" && method == http.MethodPost:
+		return r.register(path[1], req)
+	case len(path) == 4 && path[0] == "subjects" && path[2] == "versions" && method == http.MethodGet:
+		return r.getVersion(path[1], path[3])
+	case len(path) == 4 && path[0] == "subjects" && path[2] == "versions" && method == http.MethodDelete:
+		return r.deleteVersion(path[1], path[3])
+	case len(path) == 5 && path[0] == "compatibility" && path[1] == "subjects" && path[3] == "versions" && method == http.MethodPost:
+		return r.testCompatibility(path[2], path[4], req)
+	case len(path) == 1 && path[0] == "config" && method == http.MethodGet:
+		return map[string]string{"compatibilityLevel": r.global}, nil
+	case len(path) == 1 && path[0] == "config" && method == http.MethodPut:
+		return r.setConfig("", req)
+	case len(path) == 2 && path[0] == "config" && method == http.MethodGet:
+		return r.getConfig(path[1], req.URL.Query().Get("defaultToGlobal") == "true")
+	case len(path) == 2 && path[0] == "config" && method == http.MethodPut:
+		return r.setConfig(path[1], req)
+	}
+	return nil, newError(http.StatusNotFound, http.StatusNotFound, "HTTP 404 Not Found")
+}
+
+func (r *Registry) getSchema(param string) (interface{}, *registryError) {
+	id, err := strconv.Atoi(param)
+	if err != nil || id <= 0 || id > len(r.schemas) {
+		return nil, newError(http.StatusNotFound, errSchemaNotFound, "Schema %s not found", param)
+	}
+	return r.schemas[id-1], nil
+}
+
+func (r *Registry) getSubjects() []string {
+	subjects := make([]string, 0, len(r.subjects))
+	for subject := range r.subjects {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+func (r *Registry) getVersions(subject string) (interface{}, *registryError) {
+	versions, err := r.versions(subject)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int, len(versions))
+	for i, v := range versions {
+		numbers[i] = v.version
+	}
+	return numbers, nil
+}
+
+func (r *Registry) versions(subject string) ([]version, *registryError) {
+	versions, ok := r.subjects[subject]
+	if !ok {
+		return nil, newError(http.StatusNotFound, errSubjectNotFound, "Subject '%s' not found.", subject)
+	}
+	return versions, nil
+}
+
+// version returns the index of the version of the subject, a number or latest
+func (r *Registry) version(subject string, param string) ([]version, int, *registryError) {
+	versions, err := r.versions(subject)
+	if err != nil {
+		return nil, 0, err
+	}
+	if param == "latest" {
+		return versions, len(versions) - 1, nil
+	}
+	number, perr := strconv.Atoi(param)
+	if perr != nil || number <= 0 {
+		return nil, 0, newError(http.StatusUnprocessableEntity, errInvalidVersion,
+			"The specified version '%s' is not a valid version id.", param)
+	}
+	for i, v := range versions {
+		if v.version == number {
+			return versions, i, nil
+		}
+	}
+	return nil, 0, newError(http.StatusNotFound, errVersionNotFound, "Version %d not found.", number)
+}
+
+// subjectVersion is the response of the version lookups
+type subjectVersion struct {
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+	Id      int    `json:"id"`
+	schema
+}
+
+func (r *Registry) subjectVersion(subject string, v version) subjectVersion {
+	return subjectVersion{Subject: subject, Version: v.version, Id: v.id, schema: r.schemas[v.id-1]}
+}
+
+func (r *Registry) getVersion(subject string, param string) (interface{}, *registryError) {
+	versions, i, err := r.version(subject, param)
+	if err != nil {
+		return nil, err
+	}
+	return r.subjectVersion(subject, versions[i]), nil
+}
+
+func (r *Registry) deleteSubject(subject string) (interface{}, *registryError) {
+	numbers, err := r.getVersions(subject)
+	if err != nil {
+		return nil, err
+	}
+	delete(r.subjects, subject)
+	delete(r.configs, subject)
+	return numbers, nil
+}
+
+func (r *Registry) deleteVersion(subject string, param string) (interface{}, *registryError) {
+	versions, i, err := r.version(subject, param)
+	if err != nil {
+		return nil, err
+	}
+	deleted := versions[i].version
+	versions = append(versions[:i:i], versions[i+1:]...)
+	if len(versions) == 0 {
+		delete(r.subjects, subject)
+	} else {
+		r.subjects[subject] = versions
+	}
+	return deleted, nil
+}
+
+// readSchema reads and validates the schema of the request body
+func readSchema(req *http.Request) (schema, *registryError) {
+	var s schema
+	if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+		return s, newError(http.StatusUnprocessableEntity, errInvalidSchema, "Invalid schema: %s", err)
+	}
+	if s.SchemaType == schemaTypeAvro {
+		s.SchemaType = ""
+	}
+	var err error
+	switch s.schemaType() {
+	case schemaTypeAvro:
+		_, err = goavro.NewCodec(s.Schema)
+	case schemaTypeJSON:
+		var doc interface{}
+		err = json.Unmarshal([]byte(s.Schema), &doc)
+	case schemaTypeProtobuf:
+		// the .proto files are not parsed
+	default:
+		err = fmt.Errorf("unknown schema type %s", s.SchemaType)
+	}
+	if err != nil {
+		return s, newError(http.StatusUnprocessableEntity, errInvalidSchema, "Invalid schema: %s", err)
+	}
+	return s, nil
+}
+
+// find returns the version of the subject the schema is registered as
+func (r *Registry) find(subject string, s schema) (version, bool) {
+	id, ok := r.ids[s]
+	if !ok {
+		return version{}, false
+	}
+	for _, v := range r.subjects[subject] {
+		if v.id == id {
+			return v, true
+		}
+	}
+	return version{}, false
+}
+
+func (r *Registry) lookupSchema(subject string, req *http.Request) (interface{}, *registryError) {
+	s, err := readSchema(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.versions(subject); err != nil {
+		return nil, err
+	}
+	v, ok := r.find(subject, s)
+	if !ok {
+		return nil, newError(http.StatusNotFound, errSchemaNotFound, "Schema not found")
+	}
+	return r.subjectVersion(subject, v), nil
+}
+
+// register adds the schema as the next version of the subject unless it is
+// already registered, the ids are shared by the subjects of a same schema
+func (r *Registry) register(subject string, req *http.Request) (interface{}, *registryError) {
+	s, err := readSchema(req)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := r.find(subject, s); ok {
+		return map[string]int{"id": v.id}, nil
+	}
+	if messages := r.check(subject, s, r.subjects[subject], true); len(messages) > 0 {
+		return nil, newError(http.StatusConflict, errIncompatibleSchema,
+			"Schema being registered is incompatible with an earlier schema for subject \"%s\", details: %s",
+			subject, strings.Join(messages, "; "))
+	}
+	id, ok := r.ids[s]
+	if !ok {
+		r.schemas = append(r.schemas, s)
+		id = len(r.schemas)
+		r.ids[s] = id
+	}
+	r.next[subject]++
+	r.subjects[subject] = append(r.subjects[subject], version{version: r.next[subject], id: id})
+	return map[string]int{"id": id}, nil
+}
+
+func (r *Registry) testCompatibility(subject string, param string, req *http.Request) (interface{}, *registryError) {
+	s, err := readSchema(req)
+	if err != nil {
+		return nil, err
+	}
+	versions, i, err := r.version(subject, param)
+	if err != nil {
+		return nil, err
+	}
+	messages := r.check(subject, s, versions[i:i+1], false)
+	return map[string]interface{}{"is_compatible": len(messages) == 0, "messages": messages}, nil
+}
+
+// check returns the incompatibilities of the schema with the versions under
+// the compatibility level of the subject, the non transitive levels only
+// check the latest version when all is set
+func (r *Registry) check(subject string, s schema, versions []version, all bool) []string {
+	level := r.level(subject)
+	if all && !strings.HasSuffix(level, "_TRANSITIVE") && len(versions) > 0 {
+		versions = versions[len(versions)-1:]
+	}
+	var messages []string
+	for _, v := range versions {
+		messages = append(messages, compatible(level, s, r.schemas[v.id-1])...)
+	}
+	return messages
+}
+
+func (r *Registry) level(subject string) string {
+	if level, ok := r.configs[subject]; ok {
+		return level
+	}
+	return r.global
+}
+
+func (r *Registry) getConfig(subject string, defaultToGlobal bool) (interface{}, *registryError) {
+	level, ok := r.configs[subject]
+	if !ok && !defaultToGlobal {
+		return nil, newError(http.StatusNotFound, errSubjectConfigNotFound,
+			"Subject '%s' does not have subject-level compatibility configured", subject)
+	}
+	if !ok {
+		level = r.global
+	}
+	return map[string]string{"compatibilityLevel": level}, nil
+}
+
+// setConfig sets the compatibility level of the subject, the global level when
+// subject is ""
+func (r *Registry) setConfig(subject string, req *http.Request) (interface{}, *registryError) {
+	var config struct {
+		Compatibility string `json:"compatibility"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&config); err != nil || !validLevel(config.Compatibility) {
+		return nil, newError(http.StatusUnprocessableEntity, errInvalidCompatibility,
+			"Invalid compatibility level. Valid values are none, backward, forward, full, backward_transitive, forward_transitive, and full_transitive")
+	}
+	if subject == "" {
+		r.global = config.Compatibility
+	} else {
+		r.configs[subject] = config.Compatibility
+	}
+	return config, nil
+}
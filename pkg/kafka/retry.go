@@ -0,0 +1,221 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// Headers recording where a retried or dead-lettered message comes from
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderError             = "x-error"
+	HeaderAttempt           = "x-attempt"
+)
+
+const (
+	retryTopicInfix = ".retry."
+	dlqTopicSuffix  = ".dlq"
+
+	maxErrorHeaderLength = 1024
+)
+
+// retryPolicy describes the retry tiers of the failed jobs: a failed message
+// is republished to <topic>.retry.<delay> and consumed again once the delay
+// is elapsed, after maxAttempts it is parked in <topic>.dlq
+type retryPolicy struct {
+	delays      []time.Duration
+	maxAttempts int
+}
+
+// loadRetryPolicy reads kafka.retry, it returns nil when retries are disabled,
+// the failed jobs then block their partition until they succeed
+func loadRetryPolicy() (*retryPolicy, error) {
+	maxAttempts := conf.GetInt("kafka.retry.maxAttempts")
+	if maxAttempts <= 0 {
+		return nil, nil
+	}
+	policy := &retryPolicy{maxAttempts: maxAttempts}
+	for _, d := range conf.GetStringSlice("kafka.retry.delays") {
+		delay, err := time.ParseDuration(d)
+		if err != nil || delay <= 0 {
+			return nil, errors.InvalidArg("bad retry delay", d)
+		}
+		policy.delays = append(policy.delays, delay)
+	}
+	return policy, nil
+}
+
+// RetryTopic returns the retry topic of the tier
+func RetryTopic(topic string, delay time.Duration) string {
+	return topic + retryTopicInfix + formatDelay(delay)
+}
+
+// DLQTopic returns the dead letter topic of the topic
+func DLQTopic(topic string) string {
+	return topic + dlqTopicSuffix
+}
+
+// isRetryOrDLQTopic tells if the topic is a retry or dead letter topic
+func isRetryOrDLQTopic(topic string) bool {
+	return strings.Contains(topic, retryTopicInfix) || strings.HasSuffix(topic, dlqTopicSuffix)
+}
+
+// formatDelay formats the delay with its largest exact unit, 1m rather than 1m0s
+func formatDelay(delay time.Duration) string {
+	switch {
+	case delay%time.Hour == 0:
+		return fmt.Sprintf("%dh", delay/time.Hour)
+	case delay%time.Minute == 0:
+		return fmt.Sprintf("%dm", delay/time.Minute)
+	case delay%time.Second == 0:
+		return fmt.Sprintf("%ds", delay/time.Second)
+	}
+	return fmt.Sprintf("%dms", delay/time.Millisecond)
+}
+
+// retryTopics returns the retry topics of the topic
+func (policy *retryPolicy) retryTopics(topic string) []string {
+	topics := make([]string, 0, len(policy.delays))
+	for _, delay := range policy.delays {
+		topics = append(topics, RetryTopic(topic, delay))
+	}
+	return topics
+}
+
+// delayOf returns the delay of a retry topic
+func (policy *retryPolicy) delayOf(topic string) (time.Duration, bool) {
+	i := strings.LastIndex(topic, retryTopicInfix)
+	if i < 0 {
+		return 0, false
+	}
+	for _, delay := range policy.delays {
+		if topic[i+len(retryTopicInfix):] == formatDelay(delay) {
+			return delay, true
+		}
+	}
+	return 0, false
+}
+
+// next returns the topic a message failed for the attempts-th time goes to
+func (policy *retryPolicy) next(topic string, attempts int, err error) string {
+	if attempts >= policy.maxAttempts || len(policy.delays) == 0 || errors.IsBadData(err) {
+		return DLQTopic(topic)
+	}
+	tier := attempts - 1
+	if tier >= len(policy.delays) {
+		tier = len(policy.delays) - 1
+	}
+	return RetryTopic(topic, policy.delays[tier])
+}
+
+// retrier republishes the failed messages to the retry and dead letter topics
+type retrier struct {
+	policy   *retryPolicy
+	producer *AvroProducer
+}
+
+func newRetrier(cluster broker.Cluster, policy *retryPolicy) (*retrier, error) {
+	producer, err := NewAvroProducerFromCluster(cluster, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &retrier{policy, producer}, nil
+}
+
+// wait blocks until the message of a retry topic is due
+func (r *retrier) wait(ctx context.Context, m *broker.Message) error {
+	delay, ok := r.policy.delayOf(m.Topic)
+	if !ok {
+		return nil
+	}
+	wait := time.Until(m.Timestamp.Add(delay))
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retry republishes the failed message with the headers recording its origin,
+// the message is parked so nil is returned unless the republish fails
+func (r *retrier) retry(m *broker.Message, jobErr error) error {
+	return r.retryWith(r.producer, m, jobErr)
+}
+
+// retryWith is like retry but republishes with the given producer, so that
+// a transactional producer parks the message within its transaction
+func (r *retrier) retryWith(producer *AvroProducer, m *broker.Message, jobErr error) error {
+	headers := make(map[string]string)
+	var kept []broker.Header
+	for _, h := range m.Headers {
+		switch key := string(h.Key); key {
+		case HeaderOriginalTopic, HeaderOriginalPartition, HeaderOriginalOffset, HeaderError, HeaderAttempt:
+			headers[key] = string(h.Value)
+		default:
+			kept = append(kept, h)
+		}
+	}
+	if _, ok := headers[HeaderOriginalTopic]; !ok {
+		headers[HeaderOriginalTopic] = m.Topic
+		headers[HeaderOriginalPartition] = strconv.Itoa(int(m.Partition))
+		headers[HeaderOriginalOffset] = strconv.FormatInt(m.Offset, 10)
+	}
+	attempts, _ := strconv.Atoi(headers[HeaderAttempt])
+	attempts++
+	headers[HeaderAttempt] = strconv.Itoa(attempts)
+	errText := jobErr.Error()
+	if len(errText) > maxErrorHeaderLength {
+		errText = errText[:maxErrorHeaderLength]
+	}
+	headers[HeaderError] = errText
+	for _, key := range []string{HeaderOriginalTopic, HeaderOriginalPartition, HeaderOriginalOffset, HeaderError, HeaderAttempt} {
+		kept = append(kept, broker.Header{Key: []byte(key), Value: []byte(headers[key])})
+	}
+
+	topic := r.policy.next(headers[HeaderOriginalTopic], attempts, jobErr)
+	msg := &broker.Message{
+		Topic:   topic,
+		Key:     m.Key,
+		Value:   m.Value,
+		Headers: kept,
+	}
+	if err := producer.Publish(msg); err != nil {
+		return errors.Append(jobErr, err)
+	}
+	log.WithError(jobErr).Warnf("job failed, attempt = %d, topic = %s, partition = %d, offset = %d, moved to %s",
+		attempts, m.Topic, m.Partition, m.Offset, topic)
+	return nil
+}
+
+func (r *retrier) close() {
+	r.producer.Close()
+}
+
+// attempt returns the number of the run of the message, 1 unless it is
+// consumed from a retry topic
+func attempt(m *broker.Message) int {
+	failed, _ := strconv.Atoi(m.Header(HeaderAttempt))
+	return failed + 1
+}
+
+// originalTopic returns the topic a message was first published to
+func originalTopic(m *broker.Message) string {
+	if topic := m.Header(HeaderOriginalTopic); topic != "" {
+		return topic
+	}
+	return m.Topic
+}
@@ -0,0 +1,496 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+/*
+	The sarama adapter of the broker interfaces, the only code of the runner
+	bound to sarama. Every consumer and producer has its own sarama client,
+	the cluster only opens one for the metadata and the topic reads.
+*/
+
+// kafkaVersion returns the kafka.version config, the protocol version spoken
+// to the brokers, sarama.MaxVersion when it is unset or invalid
+func kafkaVersion() sarama.KafkaVersion {
+	v := conf.GetString("kafka.version")
+	if v == "" {
+		return sarama.MaxVersion
+	}
+	version, err := sarama.ParseKafkaVersion(v)
+	if err != nil {
+		log.WithError(err).Warnf("bad kafka.version %q, using %s", v, sarama.MaxVersion)
+		return sarama.MaxVersion
+	}
+	return version
+}
+
+func NewConsumerConfig() (conf *sarama.Config) {
+	conf = sarama.NewConfig()
+	conf.Version = kafkaVersion()
+	conf.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
+	conf.Consumer.Offsets.AutoCommit.Enable = true
+	conf.Consumer.Offsets.Initial = sarama.OffsetOldest
+	conf.Consumer.Fetch.Min = 1
+	conf.Consumer.Fetch.Default = 1024
+	conf.Consumer.MaxWaitTime = time.Millisecond * 100
+
+	// FIXME: For consumer it's per-partition/channel value. It's default value is 256.
+	//  May cause huge memory usage (partition_count*buffer_size*message_size).
+	conf.ChannelBufferSize = 10
+	return
+}
+
+func NewProducerConfig() (config *sarama.Config) {
+	config = sarama.NewConfig()
+	config.Version = kafkaVersion()
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Compression = sarama.CompressionNone
+	config.Producer.MaxMessageBytes = 10000000
+	config.Producer.Retry.Max = 10
+	config.Producer.Retry.Backoff = 1000 * time.Millisecond
+	return
+}
+
+// defaultReadIdle is how long ReadTopic waits for the next message of a
+// partition whose tail is not delivered: transaction markers, aborted or
+// compacted records
+const defaultReadIdle = 2 * time.Second
+
+// saramaCluster is the broker.Cluster of the kafka brokers
+type saramaCluster struct {
+	servers        []string
+	consumerConfig func() *sarama.Config
+	producerConfig func() *sarama.Config
+	// readIdle is defaultReadIdle when 0
+	readIdle time.Duration
+
+	mu     sync.Mutex
+	client sarama.Client
+}
+
+// NewSaramaCluster returns the cluster of the kafka brokers, configured by
+// NewConsumerConfig and NewProducerConfig
+func NewSaramaCluster(kafkaServers []string) broker.Cluster {
+	return &saramaCluster{
+		servers:        kafkaServers,
+		consumerConfig: NewConsumerConfig,
+		producerConfig: NewProducerConfig,
+	}
+}
+
+// metadataClient returns the client of the metadata, opened on first use
+func (c *saramaCluster) metadataClient() (sarama.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		client, err := sarama.NewClient(c.servers, c.consumerConfig())
+		if err != nil {
+			return nil, err
+		}
+		c.client = client
+	}
+	return c.client, nil
+}
+
+func (c *saramaCluster) Topics() ([]string, error) {
+	client, err := c.metadataClient()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.RefreshMetadata(); err != nil {
+		return nil, err
+	}
+	return client.Topics()
+}
+
+// ReadTopic reads the committed messages only, the records of the aborted
+// transactions are skipped
+func (c *saramaCluster) ReadTopic(topic string, fn func(*broker.Message) error) error {
+	config := c.consumerConfig()
+	config.Consumer.IsolationLevel = sarama.ReadCommitted
+	client, err := sarama.NewClient(c.servers, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	idle := c.readIdle
+	if idle <= 0 {
+		idle = defaultReadIdle
+	}
+	for _, partition := range partitions {
+		if err := readPartition(client, consumer, topic, partition, idle, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPartition hands the messages below the high water mark of the partition
+// to fn. The offsets of the transaction markers and of the aborted or
+// compacted records are never delivered, the read ends once no message came
+// for idle.
+func readPartition(client sarama.Client, consumer sarama.Consumer, topic string, partition int32,
+	idle time.Duration, fn func(*broker.Message) error) error {
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return err
+	}
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	if oldest >= newest {
+		return nil
+	}
+	pc, err := consumer.ConsumePartition(topic, partition, oldest)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-pc.Messages():
+			if err := fn(fromConsumerMessage(m)); err != nil {
+				return err
+			}
+			if m.Offset+1 >= newest {
+				return nil
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(idle)
+		case err := <-pc.Errors():
+			return err
+		case <-timer.C:
+			log.Debugf("no message for %v, the offsets of %s/%d up to %d are not delivered",
+				idle, topic, partition, newest-1)
+			return nil
+		}
+	}
+}
+
+func (c *saramaCluster) NewConsumer(group string, opts broker.ConsumerOptions) (broker.Consumer, error) {
+	config := c.consumerConfig()
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Enable = opts.AutoCommit
+	if opts.ReadCommitted {
+		config.Consumer.IsolationLevel = sarama.ReadCommitted
+	}
+	client, err := sarama.NewClient(c.servers, config)
+	if err != nil {
+		return nil, err
+	}
+	consumerGroup, err := sarama.NewConsumerGroupFromClient(group, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	go func() {
+		// the errors are returned by Close unless drained
+		for err := range consumerGroup.Errors() {
+			log.WithError(err).Warn("kafka consumer error")
+		}
+	}()
+	return &saramaConsumer{client, consumerGroup}, nil
+}
+
+func (c *saramaCluster) NewProducer() (broker.Producer, error) {
+	producer, err := sarama.NewSyncProducer(c.servers, c.producerConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &saramaProducer{producer}, nil
+}
+
+func (c *saramaCluster) NewTxnProducer(transactionalId string) (broker.TxnProducer, error) {
+	config := c.producerConfig()
+	config.Producer.Idempotent = true
+	config.Producer.Transaction.ID = transactionalId
+	config.Net.MaxOpenRequests = 1
+	producer, err := sarama.NewSyncProducer(c.servers, config)
+	if err != nil {
+		return nil, err
+	}
+	return &saramaProducer{producer}, nil
+}
+
+func (c *saramaCluster) NewAsyncProducer(opts broker.BatchOptions) (broker.AsyncProducer, error) {
+	config := c.producerConfig()
+	config.Producer.Return.Errors = true
+	config.Producer.Flush.Messages = opts.Size
+	config.Producer.Flush.Bytes = opts.Bytes
+	config.Producer.Flush.Frequency = opts.Linger
+	if opts.Compression != "" {
+		if err := config.Producer.Compression.UnmarshalText([]byte(opts.Compression)); err != nil {
+			return nil, errors.InvalidArg("compression", err)
+		}
+	}
+	producer, err := sarama.NewAsyncProducer(c.servers, config)
+	if err != nil {
+		return nil, err
+	}
+	p := &saramaAsyncProducer{producer: producer}
+	p.wg.Add(2)
+	go p.dispatchSuccesses()
+	go p.dispatchErrors()
+	return p, nil
+}
+
+func (c *saramaCluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+// saramaConsumer is the broker.Consumer of a sarama consumer group
+type saramaConsumer struct {
+	client sarama.Client
+	group  sarama.ConsumerGroup
+}
+
+func (c *saramaConsumer) Consume(ctx context.Context, topics []string, handler broker.Handler) error {
+	h := &saramaHandler{handler: handler}
+	if err := c.group.Consume(ctx, topics, h); err != nil {
+		return err
+	}
+	// sarama reports the failed claims on the errors channel, the session
+	// itself ends without error
+	return h.failure()
+}
+
+func (c *saramaConsumer) Close() error {
+	err := c.group.Close()
+	return errors.Append(err, c.client.Close())
+}
+
+// saramaHandler adapts the broker.Handler to sarama, it keeps the first
+// error of the claims
+type saramaHandler struct {
+	handler broker.Handler
+
+	mu  sync.Mutex
+	err error
+}
+
+func (h *saramaHandler) Setup(session sarama.ConsumerGroupSession) error {
+	return h.handler.Setup(saramaSession{session})
+}
+
+func (h *saramaHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	return h.handler.Cleanup(saramaSession{session})
+}
+
+func (h *saramaHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	messages := make(chan *broker.Message)
+	go func() {
+		defer close(messages)
+		for m := range claim.Messages() {
+			select {
+			case messages <- fromConsumerMessage(m):
+			case <-session.Context().Done():
+				return
+			}
+		}
+	}()
+	err := h.handler.ConsumeClaim(saramaSession{session}, &saramaClaim{claim, messages})
+	if err != nil {
+		h.mu.Lock()
+		if h.err == nil {
+			h.err = err
+		}
+		h.mu.Unlock()
+	}
+	return err
+}
+
+func (h *saramaHandler) failure() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+type saramaSession struct {
+	session sarama.ConsumerGroupSession
+}
+
+func (s saramaSession) Context() context.Context {
+	return s.session.Context()
+}
+
+func (s saramaSession) MarkOffset(topic string, partition int32, offset int64) {
+	s.session.MarkOffset(topic, partition, offset, "")
+}
+
+func (s saramaSession) Commit() {
+	s.session.Commit()
+}
+
+type saramaClaim struct {
+	claim    sarama.ConsumerGroupClaim
+	messages chan *broker.Message
+}
+
+func (c *saramaClaim) Topic() string {
+	return c.claim.Topic()
+}
+
+func (c *saramaClaim) Partition() int32 {
+	return c.claim.Partition()
+}
+
+func (c *saramaClaim) Messages() <-chan *broker.Message {
+	return c.messages
+}
+
+// saramaProducer is the broker.TxnProducer of a sarama sync producer, the
+// transactions fail unless it has a transactional id
+type saramaProducer struct {
+	producer sarama.SyncProducer
+}
+
+func (p *saramaProducer) Send(msgs ...*broker.Message) error {
+	if len(msgs) == 1 {
+		msg := toProducerMessage(msgs[0])
+		partition, offset, err := p.producer.SendMessage(msg)
+		if err != nil {
+			return err
+		}
+		msgs[0].Partition, msgs[0].Offset = partition, offset
+		return nil
+	}
+	batch := make([]*sarama.ProducerMessage, len(msgs))
+	for i, m := range msgs {
+		batch[i] = toProducerMessage(m)
+	}
+	err := p.producer.SendMessages(batch)
+	for i, msg := range batch {
+		msgs[i].Partition, msgs[i].Offset = msg.Partition, msg.Offset
+	}
+	return err
+}
+
+func (p *saramaProducer) BeginTxn() error {
+	return p.producer.BeginTxn()
+}
+
+func (p *saramaProducer) CommitTxn() error {
+	return p.producer.CommitTxn()
+}
+
+func (p *saramaProducer) AbortTxn() error {
+	return p.producer.AbortTxn()
+}
+
+func (p *saramaProducer) AddMessageToTxn(m *broker.Message, group string) error {
+	return p.producer.AddMessageToTxn(&sarama.ConsumerMessage{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+	}, group, nil)
+}
+
+func (p *saramaProducer) Close() error {
+	return p.producer.Close()
+}
+
+// saramaAsyncProducer is the broker.AsyncProducer of a sarama async producer
+type saramaAsyncProducer struct {
+	producer sarama.AsyncProducer
+	wg       sync.WaitGroup
+}
+
+// asyncDelivery is the metadata of the messages of the saramaAsyncProducer
+type asyncDelivery struct {
+	message *broker.Message
+	done    func(*broker.Message, error)
+}
+
+func (p *saramaAsyncProducer) Send(m *broker.Message, done func(*broker.Message, error)) {
+	msg := toProducerMessage(m)
+	msg.Metadata = &asyncDelivery{m, done}
+	p.producer.Input() <- msg
+}
+
+func (p *saramaAsyncProducer) Close() error {
+	p.producer.AsyncClose()
+	p.wg.Wait()
+	return nil
+}
+
+func (p *saramaAsyncProducer) dispatchSuccesses() {
+	defer p.wg.Done()
+	for msg := range p.producer.Successes() {
+		p.report(msg, nil)
+	}
+}
+
+func (p *saramaAsyncProducer) dispatchErrors() {
+	defer p.wg.Done()
+	for err := range p.producer.Errors() {
+		p.report(err.Msg, err.Err)
+	}
+}
+
+func (p *saramaAsyncProducer) report(msg *sarama.ProducerMessage, err error) {
+	delivery := msg.Metadata.(*asyncDelivery)
+	delivery.message.Partition, delivery.message.Offset = msg.Partition, msg.Offset
+	delivery.done(delivery.message, err)
+}
+
+func fromConsumerMessage(m *sarama.ConsumerMessage) *broker.Message {
+	msg := &broker.Message{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+		Timestamp: m.Timestamp,
+	}
+	for _, h := range m.Headers {
+		if h != nil {
+			msg.Headers = append(msg.Headers, broker.Header{Key: h.Key, Value: h.Value})
+		}
+	}
+	return msg
+}
+
+func toProducerMessage(m *broker.Message) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic:     m.Topic,
+		Value:     sarama.ByteEncoder(m.Value),
+		Timestamp: m.Timestamp,
+	}
+	if m.Key != nil {
+		msg.Key = sarama.ByteEncoder(m.Key)
+	}
+	for _, h := range m.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	return msg
+}
@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+)
+
+// readMockTopic reads the jobs.dlq topic of a mock broker answering the fetch,
+// newest is the high water mark of its partition
+func readMockTopic(t *testing.T, fetch *sarama.FetchResponse, newest int64) []string {
+	t.Helper()
+	mock := sarama.NewMockBroker(t, 1)
+	defer mock.Close()
+	fetch.GetBlock("jobs.dlq", 0).HighWaterMarkOffset = newest
+	mock.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(mock.Addr(), mock.BrokerID()).
+			SetLeader("jobs.dlq", 0, mock.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("jobs.dlq", 0, sarama.OffsetOldest, 0).
+			SetOffset("jobs.dlq", 0, sarama.OffsetNewest, newest),
+		"FetchRequest": sarama.NewMockWrapper(fetch),
+	})
+
+	cluster := &saramaCluster{
+		servers: []string{mock.Addr()},
+		consumerConfig: func() *sarama.Config {
+			config := NewConsumerConfig()
+			config.Version = sarama.V0_11_0_0
+			return config
+		},
+		producerConfig: NewProducerConfig,
+		readIdle:       200 * time.Millisecond,
+	}
+	defer cluster.Close()
+
+	var values []string
+	done := make(chan error, 1)
+	go func() {
+		done <- cluster.ReadTopic("jobs.dlq", func(m *broker.Message) error {
+			values = append(values, string(m.Value))
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ReadTopic waits for the transaction marker")
+	}
+	return values
+}
+
+// TestReadTopicTransactionalTail reads a partition whose last offset is a
+// transaction commit marker, it is never delivered
+func TestReadTopicTransactionalTail(t *testing.T) {
+	fetch := &sarama.FetchResponse{Version: 4}
+	fetch.AddRecord("jobs.dlq", 0, nil, sarama.StringEncoder("a"), 0)
+	fetch.AddRecord("jobs.dlq", 0, nil, sarama.StringEncoder("b"), 1)
+	fetch.AddControlRecord("jobs.dlq", 0, 2, 1, sarama.ControlRecordCommit)
+	if values := readMockTopic(t, fetch, 3); len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Fatalf("read %v, want [a b]", values)
+	}
+}
+
+// TestReadTopicSkipsAbortedRecords reads a partition with the dead letter of
+// an aborted transaction
+func TestReadTopicSkipsAbortedRecords(t *testing.T) {
+	fetch := &sarama.FetchResponse{Version: 4}
+	fetch.AddRecordBatch("jobs.dlq", 0, nil, sarama.StringEncoder("a"), 0, 1, false)
+	fetch.AddRecordBatch("jobs.dlq", 0, nil, sarama.StringEncoder("aborted"), 1, 7, true)
+	fetch.AddControlRecord("jobs.dlq", 0, 2, 7, sarama.ControlRecordAbort)
+	fetch.AddRecordBatch("jobs.dlq", 0, nil, sarama.StringEncoder("c"), 3, 1, false)
+	block := fetch.GetBlock("jobs.dlq", 0)
+	block.AbortedTransactions = []*sarama.AbortedTransaction{{ProducerID: 7, FirstOffset: 1}}
+	if values := readMockTopic(t, fetch, 4); len(values) != 2 || values[0] != "a" || values[1] != "c" {
+		t.Fatalf("read %v, want [a c]", values)
+	}
+}
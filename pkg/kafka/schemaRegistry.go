@@ -2,14 +2,16 @@ package kafka
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"time"
 
+	"keyayun.com/seal-kafka-runner/pkg/client"
 	"keyayun.com/seal-kafka-runner/pkg/errors"
 
 	"github.com/linkedin/goavro/v2"
@@ -28,8 +30,37 @@ type SchemaRegistryClientInterface interface {
 	GetLatestSchema(string) (*goavro.Codec, error)
 	CreateSubject(string, *goavro.Codec) (int, error)
 	IsSchemaRegistered(string, *goavro.Codec) (int, error)
+	GetRawSchema(int) (*RawSchema, error)
+	CreateRawSubject(string, *RawSchema) (int, error)
+	IsRawSchemaRegistered(string, *RawSchema) (int, error)
+	IsCompatible(string, *goavro.Codec) (bool, error)
+	IsCompatibleWithVersion(string, int, *goavro.Codec) (bool, error)
+	TestCompatibility(string, string, *RawSchema) (*CompatibilityResult, error)
+	GetCompatibilityLevel() (string, error)
+	SetCompatibilityLevel(string) error
+	GetSubjectCompatibilityLevel(string) (string, error)
+	SetSubjectCompatibilityLevel(string, string) error
 	DeleteSubject(string) error
 	DeleteVersion(string, int) error
+	GetSchemaContext(context.Context, int) (*goavro.Codec, error)
+	GetSubjectsContext(context.Context) ([]string, error)
+	GetVersionsContext(context.Context, string) ([]int, error)
+	GetSchemaByVersionContext(context.Context, string, int) (*goavro.Codec, error)
+	GetLatestSchemaContext(context.Context, string) (*goavro.Codec, error)
+	CreateSubjectContext(context.Context, string, *goavro.Codec) (int, error)
+	IsSchemaRegisteredContext(context.Context, string, *goavro.Codec) (int, error)
+	GetRawSchemaContext(context.Context, int) (*RawSchema, error)
+	CreateRawSubjectContext(context.Context, string, *RawSchema) (int, error)
+	IsRawSchemaRegisteredContext(context.Context, string, *RawSchema) (int, error)
+	IsCompatibleContext(context.Context, string, *goavro.Codec) (bool, error)
+	IsCompatibleWithVersionContext(context.Context, string, int, *goavro.Codec) (bool, error)
+	TestCompatibilityContext(context.Context, string, string, *RawSchema) (*CompatibilityResult, error)
+	GetCompatibilityLevelContext(context.Context) (string, error)
+	SetCompatibilityLevelContext(context.Context, string) error
+	GetSubjectCompatibilityLevelContext(context.Context, string) (string, error)
+	SetSubjectCompatibilityLevelContext(context.Context, string, string) error
+	DeleteSubjectContext(context.Context, string) error
+	DeleteVersionContext(context.Context, string, int) error
 }
 
 // SchemaRegistryClient is a basic http client to interact with schema registry
@@ -37,10 +68,53 @@ type SchemaRegistryClient struct {
 	SchemaRegistryConnect []string
 	httpClient            *http.Client
 	retries               int
+	backoff               registryBackoff
+	authorizer            client.Authorizer
 }
 
-type schemaResponse struct {
-	Schema string `json:"schema"`
+// SchemaRegistryOptions configures the http client of the schema registry
+type SchemaRegistryOptions struct {
+	// Retries of the failed requests, len(connect) when 0
+	Retries int
+	// Backoff is the delay before the first retry, doubled up to MaxBackoff
+	// for the next ones
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+	// Authorizer sets the Authorization header of the requests, such as a
+	// client.BasicAuthorizer or a client.BearerAuthorizer
+	Authorizer client.Authorizer
+	// TLSConfig holds the CA and the client certificate of mTLS
+	TLSConfig *tls.Config
+	// CacheDir is the directory the cached client keeps the fetched schemas
+	// in across restarts, see CachedSchemaRegistryClient.UseCacheDir
+	CacheDir string
+	// LatestTTL is how long the cached client keeps the latest version and
+	// the versions of a subject, NegativeTTL the not found ids and subjects
+	LatestTTL   time.Duration
+	NegativeTTL time.Duration
+}
+
+// Schema types of the registry
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeJSON     = "JSON"
+	SchemaTypeProtobuf = "PROTOBUF"
+)
+
+// RawSchema is a schema of any type, the registry omits the type of the Avro
+// schemas
+type RawSchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+// Type returns the schema type, SchemaTypeAvro when it is omitted
+func (rs *RawSchema) Type() string {
+	if rs.SchemaType == "" {
+		return SchemaTypeAvro
+	}
+	return rs.SchemaType
 }
 
 type schemaVersionResponse struct {
@@ -54,6 +128,32 @@ type idResponse struct {
 	ID int `json:"id"`
 }
 
+// CompatibilityResult is the result of a compatibility test, the messages
+// explain the incompatibilities
+type CompatibilityResult struct {
+	IsCompatible bool     `json:"is_compatible"`
+	Messages     []string `json:"messages"`
+}
+
+type configRequest struct {
+	Compatibility string `json:"compatibility"`
+}
+
+type configResponse struct {
+	CompatibilityLevel string `json:"compatibilityLevel"`
+}
+
+// Compatibility levels of the registry
+const (
+	CompatibilityNone               = "NONE"
+	CompatibilityBackward           = "BACKWARD"
+	CompatibilityBackwardTransitive = "BACKWARD_TRANSITIVE"
+	CompatibilityForward            = "FORWARD"
+	CompatibilityForwardTransitive  = "FORWARD_TRANSITIVE"
+	CompatibilityFull               = "FULL"
+	CompatibilityFullTransitive     = "FULL_TRANSITIVE"
+)
+
 const (
 	schemaByID       = "/schemas/ids/%d"
 	subjects         = "/subjects"
@@ -61,6 +161,10 @@ const (
 	deleteSubject    = "/subjects/%s"
 	subjectByVersion = "/subjects/%s/versions/%s"
 
+	compatibilityByVersion = "/compatibility/subjects/%s/versions/%s?verbose=true"
+	globalConfig           = "/config"
+	subjectConfig          = "/config/%s"
+
 	latestVersion = "latest"
 
 	contentType = "application/vnd.schemaregistry.v1+json"
@@ -74,7 +178,12 @@ func NewSchemaRegistryClient(connect []string) *SchemaRegistryClient {
 	client := &http.Client{
 		Timeout: timeout,
 	}
-	return &SchemaRegistryClient{connect, client, len(connect)}
+	return &SchemaRegistryClient{
+		SchemaRegistryConnect: connect,
+		httpClient:            client,
+		retries:               len(connect),
+		backoff:               defaultRegistryBackoff,
+	}
 }
 
 // NewSchemaRegistryClientWithRetries creates an http client with a configurable amount of retries on 5XX responses
@@ -82,25 +191,143 @@ func NewSchemaRegistryClientWithRetries(connect []string, retries int) *SchemaRe
 	client := &http.Client{
 		Timeout: timeout,
 	}
-	return &SchemaRegistryClient{connect, client, retries}
+	return &SchemaRegistryClient{
+		SchemaRegistryConnect: connect,
+		httpClient:            client,
+		retries:               retries,
+		backoff:               defaultRegistryBackoff,
+	}
+}
+
+// NewSchemaRegistryClientWithOptions creates a client with authentication and TLS
+func NewSchemaRegistryClientWithOptions(connect []string, opts SchemaRegistryOptions) *SchemaRegistryClient {
+	if opts.Retries == 0 {
+		opts.Retries = len(connect)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = timeout
+	}
+	client := &http.Client{
+		Timeout: opts.Timeout,
+	}
+	if opts.TLSConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = opts.TLSConfig
+		client.Transport = transport
+	}
+	backoff := defaultRegistryBackoff
+	if opts.Backoff > 0 {
+		backoff.initial = opts.Backoff
+	}
+	if opts.MaxBackoff > 0 {
+		backoff.max = opts.MaxBackoff
+	}
+	return &SchemaRegistryClient{
+		SchemaRegistryConnect: connect,
+		httpClient:            client,
+		retries:               opts.Retries,
+		backoff:               backoff,
+		authorizer:            opts.Authorizer,
+	}
+}
+
+// LoadSchemaRegistryOptions reads kafka.schemaRegistry: the retries, the
+// backoff, the timeout, the basic auth username and password or the bearer
+// token, the tls files and the cache options
+func LoadSchemaRegistryOptions() (SchemaRegistryOptions, error) {
+	opts := SchemaRegistryOptions{
+		Retries:     conf.GetInt("kafka.schemaRegistry.retries"),
+		Backoff:     conf.GetDuration("kafka.schemaRegistry.backoff"),
+		MaxBackoff:  conf.GetDuration("kafka.schemaRegistry.maxBackoff"),
+		Timeout:     conf.GetDuration("kafka.schemaRegistry.timeout"),
+		CacheDir:    conf.GetString("kafka.schemaRegistry.cacheDir"),
+		LatestTTL:   conf.GetDuration("kafka.schemaRegistry.latestTTL"),
+		NegativeTTL: conf.GetDuration("kafka.schemaRegistry.negativeTTL"),
+	}
+	if token := conf.GetString("kafka.schemaRegistry.token"); token != "" {
+		opts.Authorizer = &client.BearerAuthorizer{Token: token}
+	} else if username := conf.GetString("kafka.schemaRegistry.username"); username != "" {
+		opts.Authorizer = &client.BasicAuthorizer{
+			Username: username,
+			Password: conf.GetString("kafka.schemaRegistry.password"),
+		}
+	}
+	tlsConfig, err := loadRegistryTLSConfig()
+	if err != nil {
+		return opts, err
+	}
+	opts.TLSConfig = tlsConfig
+	return opts, nil
+}
+
+// loadRegistryTLSConfig reads kafka.schemaRegistry.tls, it returns nil when
+// no tls option is set
+func loadRegistryTLSConfig() (*tls.Config, error) {
+	ca := conf.GetString("kafka.schemaRegistry.tls.ca")
+	cert := conf.GetString("kafka.schemaRegistry.tls.cert")
+	key := conf.GetString("kafka.schemaRegistry.tls.key")
+	insecure := conf.GetBool("kafka.schemaRegistry.tls.insecureSkipVerify")
+	if ca == "" && cert == "" && !insecure {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.InvalidArg("no certificate in", ca)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.InvalidArg("bad client certificate", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
 }
 
 // GetSchema returns a goavro.Codec by unique id
 func (client *SchemaRegistryClient) GetSchema(id int) (*goavro.Codec, error) {
-	resp, err := client.httpCall("GET", fmt.Sprintf(schemaByID, id), nil)
+	return client.GetSchemaContext(context.Background(), id)
+}
+
+// GetSchemaContext is like GetSchema with a context
+func (client *SchemaRegistryClient) GetSchemaContext(ctx context.Context, id int) (*goavro.Codec, error) {
+	schema, err := client.GetRawSchemaContext(ctx, id)
 	if nil != err {
 		return nil, err
 	}
-	schema, err := parseSchema(resp)
+	return goavro.NewCodec(schema.Schema)
+}
+
+// GetRawSchema returns the schema of any type by unique id
+func (client *SchemaRegistryClient) GetRawSchema(id int) (*RawSchema, error) {
+	return client.GetRawSchemaContext(context.Background(), id)
+}
+
+// GetRawSchemaContext is like GetRawSchema with a context
+func (client *SchemaRegistryClient) GetRawSchemaContext(ctx context.Context, id int) (*RawSchema, error) {
+	resp, err := client.httpCall(ctx, "GET", fmt.Sprintf(schemaByID, id), nil)
 	if nil != err {
 		return nil, err
 	}
-	return goavro.NewCodec(schema.Schema)
+	return parseSchema(resp)
 }
 
 // GetSubjects returns a list of all subjects in the schema registry
 func (client *SchemaRegistryClient) GetSubjects() ([]string, error) {
-	resp, err := client.httpCall("GET", subjects, nil)
+	return client.GetSubjectsContext(context.Background())
+}
+
+// GetSubjectsContext is like GetSubjects with a context
+func (client *SchemaRegistryClient) GetSubjectsContext(ctx context.Context) ([]string, error) {
+	resp, err := client.httpCall(ctx, "GET", subjects, nil)
 	if nil != err {
 		return []string{}, err
 	}
@@ -111,7 +338,12 @@ func (client *SchemaRegistryClient) GetSubjects() ([]string, error) {
 
 // GetVersions returns a list of the versions of a subject
 func (client *SchemaRegistryClient) GetVersions(subject string) ([]int, error) {
-	resp, err := client.httpCall("GET", fmt.Sprintf(subjectVersions, subject), nil)
+	return client.GetVersionsContext(context.Background(), subject)
+}
+
+// GetVersionsContext is like GetVersions with a context
+func (client *SchemaRegistryClient) GetVersionsContext(ctx context.Context, subject string) ([]int, error) {
+	resp, err := client.httpCall(ctx, "GET", fmt.Sprintf(subjectVersions, subject), nil)
 	if nil != err {
 		return []int{}, err
 	}
@@ -120,8 +352,8 @@ func (client *SchemaRegistryClient) GetVersions(subject string) ([]int, error) {
 	return result, err
 }
 
-func (client *SchemaRegistryClient) getSchemaByVersionInternal(subject string, version string) (*goavro.Codec, error) {
-	resp, err := client.httpCall("GET", fmt.Sprintf(subjectByVersion, subject, version), nil)
+func (client *SchemaRegistryClient) getSchemaByVersionInternal(ctx context.Context, subject string, version string) (*goavro.Codec, error) {
+	resp, err := client.httpCall(ctx, "GET", fmt.Sprintf(subjectByVersion, subject, version), nil)
 	if nil != err {
 		return nil, err
 	}
@@ -136,23 +368,47 @@ func (client *SchemaRegistryClient) getSchemaByVersionInternal(subject string, v
 
 // GetSchemaByVersion returns a goavro.Codec for the version of the subject
 func (client *SchemaRegistryClient) GetSchemaByVersion(subject string, version int) (*goavro.Codec, error) {
-	return client.getSchemaByVersionInternal(subject, fmt.Sprintf("%d", version))
+	return client.GetSchemaByVersionContext(context.Background(), subject, version)
+}
+
+// GetSchemaByVersionContext is like GetSchemaByVersion with a context
+func (client *SchemaRegistryClient) GetSchemaByVersionContext(ctx context.Context, subject string, version int) (*goavro.Codec, error) {
+	return client.getSchemaByVersionInternal(ctx, subject, fmt.Sprintf("%d", version))
 }
 
 // GetLatestSchema returns a goavro.Codec for the latest version of the subject
 func (client *SchemaRegistryClient) GetLatestSchema(subject string) (*goavro.Codec, error) {
-	return client.getSchemaByVersionInternal(subject, latestVersion)
+	return client.GetLatestSchemaContext(context.Background(), subject)
+}
+
+// GetLatestSchemaContext is like GetLatestSchema with a context
+func (client *SchemaRegistryClient) GetLatestSchemaContext(ctx context.Context, subject string) (*goavro.Codec, error) {
+	return client.getSchemaByVersionInternal(ctx, subject, latestVersion)
 }
 
 // CreateSubject adds a schema to the subject
 func (client *SchemaRegistryClient) CreateSubject(subject string, codec *goavro.Codec) (int, error) {
-	schema := schemaResponse{codec.Schema()}
+	return client.CreateSubjectContext(context.Background(), subject, codec)
+}
+
+// CreateSubjectContext is like CreateSubject with a context
+func (client *SchemaRegistryClient) CreateSubjectContext(ctx context.Context, subject string, codec *goavro.Codec) (int, error) {
+	return client.CreateRawSubjectContext(ctx, subject, &RawSchema{Schema: codec.Schema()})
+}
+
+// CreateRawSubject adds a schema of any type to the subject
+func (client *SchemaRegistryClient) CreateRawSubject(subject string, schema *RawSchema) (int, error) {
+	return client.CreateRawSubjectContext(context.Background(), subject, schema)
+}
+
+// CreateRawSubjectContext is like CreateRawSubject with a context
+func (client *SchemaRegistryClient) CreateRawSubjectContext(ctx context.Context, subject string, schema *RawSchema) (int, error) {
 	json, err := json.Marshal(schema)
 	if err != nil {
 		return 0, err
 	}
 	payload := bytes.NewBuffer(json)
-	resp, err := client.httpCall("POST", fmt.Sprintf(subjectVersions, subject), payload)
+	resp, err := client.httpCall(ctx, "POST", fmt.Sprintf(subjectVersions, subject), payload)
 	if err != nil {
 		return 0, err
 	}
@@ -161,33 +417,181 @@ func (client *SchemaRegistryClient) CreateSubject(subject string, codec *goavro.
 
 // IsSchemaRegistered tests if the schema is registered, if so it returns the unique id of that schema
 func (client *SchemaRegistryClient) IsSchemaRegistered(subject string, codec *goavro.Codec) (int, error) {
-	schema := schemaResponse{codec.Schema()}
+	return client.IsSchemaRegisteredContext(context.Background(), subject, codec)
+}
+
+// IsSchemaRegisteredContext is like IsSchemaRegistered with a context
+func (client *SchemaRegistryClient) IsSchemaRegisteredContext(ctx context.Context, subject string, codec *goavro.Codec) (int, error) {
+	return client.IsRawSchemaRegisteredContext(ctx, subject, &RawSchema{Schema: codec.Schema()})
+}
+
+// IsRawSchemaRegistered is like IsSchemaRegistered for a schema of any type
+func (client *SchemaRegistryClient) IsRawSchemaRegistered(subject string, schema *RawSchema) (int, error) {
+	return client.IsRawSchemaRegisteredContext(context.Background(), subject, schema)
+}
+
+// IsRawSchemaRegisteredContext is like IsRawSchemaRegistered with a context
+func (client *SchemaRegistryClient) IsRawSchemaRegisteredContext(ctx context.Context, subject string, schema *RawSchema) (int, error) {
 	json, err := json.Marshal(schema)
 	if err != nil {
 		return 0, err
 	}
 	payload := bytes.NewBuffer(json)
-	resp, err := client.httpCall("POST", fmt.Sprintf(deleteSubject, subject), payload)
+	resp, err := client.httpCall(ctx, "POST", fmt.Sprintf(deleteSubject, subject), payload)
 	if err != nil {
 		return 0, err
 	}
 	return parseID(resp)
 }
 
+// IsCompatible tests if the schema is compatible with the latest version of the subject
+func (client *SchemaRegistryClient) IsCompatible(subject string, codec *goavro.Codec) (bool, error) {
+	return client.IsCompatibleContext(context.Background(), subject, codec)
+}
+
+// IsCompatibleContext is like IsCompatible with a context
+func (client *SchemaRegistryClient) IsCompatibleContext(ctx context.Context, subject string, codec *goavro.Codec) (bool, error) {
+	result, err := client.TestCompatibilityContext(ctx, subject, latestVersion, &RawSchema{Schema: codec.Schema()})
+	if err != nil {
+		return false, err
+	}
+	return result.IsCompatible, nil
+}
+
+// IsCompatibleWithVersion tests if the schema is compatible with the version of the subject
+func (client *SchemaRegistryClient) IsCompatibleWithVersion(subject string, version int, codec *goavro.Codec) (bool, error) {
+	return client.IsCompatibleWithVersionContext(context.Background(), subject, version, codec)
+}
+
+// IsCompatibleWithVersionContext is like IsCompatibleWithVersion with a context
+func (client *SchemaRegistryClient) IsCompatibleWithVersionContext(ctx context.Context, subject string, version int, codec *goavro.Codec) (bool, error) {
+	result, err := client.TestCompatibilityContext(ctx, subject, fmt.Sprintf("%d", version), &RawSchema{Schema: codec.Schema()})
+	if err != nil {
+		return false, err
+	}
+	return result.IsCompatible, nil
+}
+
+// TestCompatibility tests if the schema of any type is compatible with the
+// version of the subject, "latest" or "" for the latest version
+func (client *SchemaRegistryClient) TestCompatibility(subject string, version string, schema *RawSchema) (*CompatibilityResult, error) {
+	return client.TestCompatibilityContext(context.Background(), subject, version, schema)
+}
+
+// TestCompatibilityContext is like TestCompatibility with a context
+func (client *SchemaRegistryClient) TestCompatibilityContext(ctx context.Context, subject string, version string, schema *RawSchema) (*CompatibilityResult, error) {
+	if version == "" {
+		version = latestVersion
+	}
+	body, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.httpCall(ctx, "POST", fmt.Sprintf(compatibilityByVersion, subject, version), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	var result = new(CompatibilityResult)
+	err = json.Unmarshal(resp, result)
+	return result, err
+}
+
+// GetCompatibilityLevel returns the global compatibility level
+func (client *SchemaRegistryClient) GetCompatibilityLevel() (string, error) {
+	return client.GetCompatibilityLevelContext(context.Background())
+}
+
+// GetCompatibilityLevelContext is like GetCompatibilityLevel with a context
+func (client *SchemaRegistryClient) GetCompatibilityLevelContext(ctx context.Context) (string, error) {
+	return client.getConfig(ctx, globalConfig)
+}
+
+// SetCompatibilityLevel sets the global compatibility level
+func (client *SchemaRegistryClient) SetCompatibilityLevel(level string) error {
+	return client.SetCompatibilityLevelContext(context.Background(), level)
+}
+
+// SetCompatibilityLevelContext is like SetCompatibilityLevel with a context
+func (client *SchemaRegistryClient) SetCompatibilityLevelContext(ctx context.Context, level string) error {
+	return client.setConfig(ctx, globalConfig, level)
+}
+
+// GetSubjectCompatibilityLevel returns the compatibility level of the subject,
+// the global level when the subject has none
+func (client *SchemaRegistryClient) GetSubjectCompatibilityLevel(subject string) (string, error) {
+	return client.GetSubjectCompatibilityLevelContext(context.Background(), subject)
+}
+
+// GetSubjectCompatibilityLevelContext is like GetSubjectCompatibilityLevel with a context
+func (client *SchemaRegistryClient) GetSubjectCompatibilityLevelContext(ctx context.Context, subject string) (string, error) {
+	return client.getConfig(ctx, fmt.Sprintf(subjectConfig, subject)+"?defaultToGlobal=true")
+}
+
+// SetSubjectCompatibilityLevel sets the compatibility level of the subject
+func (client *SchemaRegistryClient) SetSubjectCompatibilityLevel(subject string, level string) error {
+	return client.SetSubjectCompatibilityLevelContext(context.Background(), subject, level)
+}
+
+// SetSubjectCompatibilityLevelContext is like SetSubjectCompatibilityLevel with a context
+func (client *SchemaRegistryClient) SetSubjectCompatibilityLevelContext(ctx context.Context, subject string, level string) error {
+	return client.setConfig(ctx, fmt.Sprintf(subjectConfig, subject), level)
+}
+
+func (client *SchemaRegistryClient) getConfig(ctx context.Context, uri string) (string, error) {
+	resp, err := client.httpCall(ctx, "GET", uri, nil)
+	if err != nil {
+		return "", err
+	}
+	var config = new(configResponse)
+	err = json.Unmarshal(resp, config)
+	return config.CompatibilityLevel, err
+}
+
+func (client *SchemaRegistryClient) setConfig(ctx context.Context, uri string, level string) error {
+	if err := validCompatibilityLevel(level); err != nil {
+		return err
+	}
+	body, err := json.Marshal(configRequest{level})
+	if err != nil {
+		return err
+	}
+	_, err = client.httpCall(ctx, "PUT", uri, bytes.NewBuffer(body))
+	return err
+}
+
+func validCompatibilityLevel(level string) error {
+	switch level {
+	case CompatibilityNone, CompatibilityBackward, CompatibilityBackwardTransitive,
+		CompatibilityForward, CompatibilityForwardTransitive, CompatibilityFull, CompatibilityFullTransitive:
+		return nil
+	}
+	return errors.InvalidArg("unknown compatibility level", level)
+}
+
 // DeleteSubject deletes a subject. It should only be used in development
 func (client *SchemaRegistryClient) DeleteSubject(subject string) error {
-	_, err := client.httpCall("DELETE", fmt.Sprintf(deleteSubject, subject), nil)
+	return client.DeleteSubjectContext(context.Background(), subject)
+}
+
+// DeleteSubjectContext is like DeleteSubject with a context
+func (client *SchemaRegistryClient) DeleteSubjectContext(ctx context.Context, subject string) error {
+	_, err := client.httpCall(ctx, "DELETE", fmt.Sprintf(deleteSubject, subject), nil)
 	return err
 }
 
 // DeleteVersion deletes a subject. It should only be used in development
 func (client *SchemaRegistryClient) DeleteVersion(subject string, version int) error {
-	_, err := client.httpCall("DELETE", fmt.Sprintf(subjectByVersion, subject, fmt.Sprintf("%d", version)), nil)
+	return client.DeleteVersionContext(context.Background(), subject, version)
+}
+
+// DeleteVersionContext is like DeleteVersion with a context
+func (client *SchemaRegistryClient) DeleteVersionContext(ctx context.Context, subject string, version int) error {
+	_, err := client.httpCall(ctx, "DELETE", fmt.Sprintf(subjectByVersion, subject, fmt.Sprintf("%d", version)), nil)
 	return err
 }
 
-func parseSchema(str []byte) (*schemaResponse, error) {
-	var schema = new(schemaResponse)
+func parseSchema(str []byte) (*RawSchema, error) {
+	var schema = new(RawSchema)
 	err := json.Unmarshal(str, &schema)
 	return schema, err
 }
@@ -197,38 +601,3 @@ func parseID(str []byte) (int, error) {
 	err := json.Unmarshal(str, &id)
 	return id.ID, err
 }
-
-func (client *SchemaRegistryClient) httpCall(method, uri string, payload io.Reader) ([]byte, error) {
-	nServers := len(client.SchemaRegistryConnect)
-	offset := rand.Intn(nServers)
-	for i := 0; ; i++ {
-		url := fmt.Sprintf("%s%s", client.SchemaRegistryConnect[(i+offset)%nServers], uri)
-		req, err := http.NewRequest(method, url, payload)
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Set("Content-Type", contentType)
-		resp, err := client.httpClient.Do(req)
-		if resp != nil {
-			defer resp.Body.Close()
-		}
-		if i < client.retries && (err != nil || retriable(resp)) {
-			continue
-		}
-		if err != nil {
-			return nil, err
-		}
-		if !okStatus(resp) {
-			return nil, errors.BadService()
-		}
-		return ioutil.ReadAll(resp.Body)
-	}
-}
-
-func retriable(resp *http.Response) bool {
-	return resp.StatusCode >= 500 && resp.StatusCode < 600
-}
-
-func okStatus(resp *http.Response) bool {
-	return resp.StatusCode >= 200 && resp.StatusCode < 400
-}
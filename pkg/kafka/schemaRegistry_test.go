@@ -0,0 +1,175 @@
+package kafka
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/client"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/kafka/registrytest"
+)
+
+func newTestRegistryClient(t *testing.T) *SchemaRegistryClient {
+	registry := registrytest.NewServer()
+	t.Cleanup(registry.Close)
+	return NewSchemaRegistryClient([]string{registry.URL})
+}
+
+func TestCompatibility(t *testing.T) {
+	client := newTestRegistryClient(t)
+	if _, err := client.CreateSubject("jobs-value", newTestCodec(t, testSchema)); err != nil {
+		t.Fatal(err)
+	}
+
+	withDefault := newTestCodec(t, `{"type": "record", "name": "Job", "fields": [
+		{"name": "id", "type": "int"}, {"name": "priority", "type": "int", "default": 0}]}`)
+	if ok, err := client.IsCompatible("jobs-value", withDefault); err != nil || !ok {
+		t.Errorf("field with a default is compatible = %v, %v", ok, err)
+	}
+	withoutDefault := newTestCodec(t, `{"type": "record", "name": "Job", "fields": [
+		{"name": "id", "type": "int"}, {"name": "priority", "type": "int"}]}`)
+	if ok, err := client.IsCompatibleWithVersion("jobs-value", 1, withoutDefault); err != nil || ok {
+		t.Errorf("field without a default is compatible = %v, %v", ok, err)
+	}
+	result, err := client.TestCompatibility("jobs-value", "", &RawSchema{Schema: withoutDefault.Schema()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.IsCompatible || len(result.Messages) == 0 {
+		t.Errorf("compatibility result %+v, want the incompatibilities", result)
+	}
+
+	if _, err := client.IsCompatible("cars-value", withDefault); !errors.IsNotFound(err) {
+		t.Errorf("compatibility with an unknown subject: %v", err)
+	}
+	if _, err := client.IsCompatibleWithVersion("jobs-value", 2, withDefault); !errors.IsNotFound(err) {
+		t.Errorf("compatibility with an unknown version: %v", err)
+	}
+}
+
+func TestCompatibilityLevels(t *testing.T) {
+	client := newTestRegistryClient(t)
+	if level, err := client.GetCompatibilityLevel(); err != nil || level != CompatibilityBackward {
+		t.Fatalf("global level %q, %v, want BACKWARD", level, err)
+	}
+	if err := client.SetCompatibilityLevel(CompatibilityFull); err != nil {
+		t.Fatal(err)
+	}
+	// the subjects without a level of their own have the global level
+	if level, err := client.GetSubjectCompatibilityLevel("jobs-value"); err != nil || level != CompatibilityFull {
+		t.Fatalf("subject level %q, %v, want the global FULL", level, err)
+	}
+	if err := client.SetSubjectCompatibilityLevel("jobs-value", CompatibilityNone); err != nil {
+		t.Fatal(err)
+	}
+	if level, err := client.GetSubjectCompatibilityLevel("jobs-value"); err != nil || level != CompatibilityNone {
+		t.Fatalf("subject level %q, %v, want NONE", level, err)
+	}
+	if level, err := client.GetCompatibilityLevel(); err != nil || level != CompatibilityFull {
+		t.Fatalf("global level %q, %v, want FULL", level, err)
+	}
+
+	if err := client.SetCompatibilityLevel("SOMETIMES"); !errors.IsInvalidArg(err) {
+		t.Errorf("unknown global level: %v", err)
+	}
+	if err := client.SetSubjectCompatibilityLevel("jobs-value", "backward"); !errors.IsInvalidArg(err) {
+		t.Errorf("unknown subject level: %v", err)
+	}
+}
+
+// authRegistry serves the registry to the requests with the Authorization
+// header only
+func authRegistry(t *testing.T, header string) string {
+	registry := registrytest.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != header {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		registry.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestRegistryAuthentication(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorizer client.Authorizer
+	}{
+		{"basic", &client.BasicAuthorizer{Username: "runner", Password: "secret"}},
+		{"bearer", &client.BearerAuthorizer{Token: "token"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := authRegistry(t, test.authorizer.AuthHeader())
+			if _, err := NewSchemaRegistryClient([]string{url}).GetSubjects(); !errors.IsBadService(err) {
+				t.Fatalf("request without credentials: %v", err)
+			}
+			registryClient := NewSchemaRegistryClientWithOptions([]string{url}, SchemaRegistryOptions{Authorizer: test.authorizer})
+			if _, err := registryClient.GetSubjects(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRegistryTLS(t *testing.T) {
+	server := httptest.NewTLSServer(registrytest.New())
+	defer server.Close()
+	if _, err := NewSchemaRegistryClient([]string{server.URL}).GetSubjects(); err == nil {
+		t.Fatal("request to a server of an unknown authority")
+	}
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	previous := conf.Get("kafka.schemaRegistry.tls.ca")
+	conf.Set("kafka.schemaRegistry.tls.ca", ca)
+	t.Cleanup(func() { conf.Set("kafka.schemaRegistry.tls.ca", previous) })
+	opts, err := LoadSchemaRegistryOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSchemaRegistryClientWithOptions([]string{server.URL}, opts).GetSubjects(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(ca, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSchemaRegistryOptions(); !errors.IsInvalidArg(err) {
+		t.Fatalf("bad CA file: %v", err)
+	}
+}
+
+func TestRegistryContext(t *testing.T) {
+	stop := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	defer server.Close()
+	defer close(stop)
+	registryClient := NewSchemaRegistryClientWithOptions([]string{server.URL}, SchemaRegistryOptions{Timeout: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := registryClient.GetSubjectsContext(ctx); err == nil {
+		t.Fatal("request of a cancelled context succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("request cancelled after %s", elapsed)
+	}
+}
@@ -0,0 +1,139 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	The schema store keeps the schemas fetched from the registry in a
+	directory, so that a restarted runner decodes the known schemas while the
+	registry is down:
+		<dir>/schemas/<id>.json         the RawSchema of the id
+		<dir>/subjects/<sha256>.json    a schema registered under a subject
+*/
+
+const (
+	storeSchemasDir  = "schemas"
+	storeSubjectsDir = "subjects"
+	storeExt         = ".json"
+)
+
+// schemaStore is the directory of the schemas cached on disk
+type schemaStore struct {
+	dir string
+}
+
+// storedSubject is a schema registered under a subject with its id
+type storedSubject struct {
+	Subject string `json:"subject"`
+	RawSchema
+	Id int `json:"id"`
+}
+
+// openSchemaStore creates the directories of the store
+func openSchemaStore(dir string) (*schemaStore, error) {
+	for _, sub := range []string{storeSchemasDir, storeSubjectsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &schemaStore{dir: dir}, nil
+}
+
+// schemaKey is the key of a schema registered under a subject
+func schemaKey(subject string, schema *RawSchema) string {
+	return subject + ":" + schema.Type() + ":" + schema.Schema
+}
+
+// loadSchemas reads the schemas by id, the unreadable files are skipped
+func (s *schemaStore) loadSchemas() (map[int]*RawSchema, error) {
+	schemas := make(map[int]*RawSchema)
+	err := s.walk(storeSchemasDir, func(name string, b []byte) error {
+		id, err := strconv.Atoi(strings.TrimSuffix(name, storeExt))
+		if err != nil {
+			return err
+		}
+		schema := new(RawSchema)
+		if err := json.Unmarshal(b, schema); err != nil {
+			return err
+		}
+		schemas[id] = schema
+		return nil
+	})
+	return schemas, err
+}
+
+// loadSubjects reads the ids by schemaKey
+func (s *schemaStore) loadSubjects() (map[string]int, error) {
+	ids := make(map[string]int)
+	err := s.walk(storeSubjectsDir, func(name string, b []byte) error {
+		var stored storedSubject
+		if err := json.Unmarshal(b, &stored); err != nil {
+			return err
+		}
+		ids[schemaKey(stored.Subject, &stored.RawSchema)] = stored.Id
+		return nil
+	})
+	return ids, err
+}
+
+func (s *schemaStore) walk(sub string, load func(name string, b []byte) error) error {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, sub))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != storeExt {
+			continue
+		}
+		file := filepath.Join(s.dir, sub, f.Name())
+		b, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = load(f.Name(), b)
+		}
+		if err != nil {
+			log.Warnf("skipping cached schema %s: %s", file, err)
+		}
+	}
+	return nil
+}
+
+// putSchema writes the schema of the id
+func (s *schemaStore) putSchema(id int, schema *RawSchema) error {
+	return s.write(storeSchemasDir, strconv.Itoa(id), schema)
+}
+
+// putSubject writes the id of the schema registered under the subject
+func (s *schemaStore) putSubject(subject string, schema *RawSchema, id int) error {
+	sum := sha256.Sum256([]byte(schemaKey(subject, schema)))
+	return s.write(storeSubjectsDir, hex.EncodeToString(sum[:]), &storedSubject{subject, *schema, id})
+}
+
+// write replaces the file atomically, a crash never leaves half a schema
+func (s *schemaStore) write(sub string, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, sub), name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, sub, name+storeExt))
+}
@@ -0,0 +1,87 @@
+package kafka
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"keyayun.com/seal-kafka-runner/pkg/kafka/registrytest"
+)
+
+func TestCacheDirOutlivesTheRegistry(t *testing.T) {
+	dir := t.TempDir()
+	registry := registrytest.NewServer()
+	defer registry.Close()
+	client := NewCachedSchemaRegistryClient([]string{registry.URL})
+	if err := client.UseCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	b := frameJob(t, client, "jobs-value", testSchema, 3)
+	// the consumer fetches the schema of the id
+	if _, err := NewRegistryDeserializer(client).Deserialize(context.Background(), "jobs", false, b); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{storeSchemasDir, storeSubjectsDir} {
+		files, err := filepath.Glob(filepath.Join(dir, sub, "*"+storeExt))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("cached %s %v, %v, want 1 file", sub, files, err)
+		}
+	}
+
+	// a restarted runner decodes the known schemas while the registry is down
+	registry.Close()
+	restarted := NewCachedSchemaRegistryClientWithRetries([]string{registry.URL}, 0)
+	if err := restarted.UseCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := NewRegistryDeserializer(restarted).Deserialize(context.Background(), "jobs", false, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if textual, _ := payload.Textual(); string(textual) != `{"id":3}` {
+		t.Fatalf("decoded %s", textual)
+	}
+	if id, err := restarted.IsSchemaRegistered("jobs-value", newTestCodec(t, testSchema)); err != nil || id != payload.SchemaId {
+		t.Fatalf("cached subject schema id %d, %v, want %d", id, err, payload.SchemaId)
+	}
+	if _, err := restarted.GetSchema(payload.SchemaId + 1); err == nil {
+		t.Fatal("schema not cached nor in the registry")
+	}
+}
+
+func TestCacheDirSkipsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openSchemaStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.putSchema(4, &RawSchema{Schema: testSchema}); err != nil {
+		t.Fatal(err)
+	}
+	bad := map[string]string{
+		filepath.Join(storeSchemasDir, "5.json"):      "{not json",
+		filepath.Join(storeSchemasDir, "six.json"):    "{}",
+		filepath.Join(storeSubjectsDir, "bad.json"):   "[]",
+		filepath.Join(storeSchemasDir, "7.json.tmp"):  "{}",
+		filepath.Join(storeSchemasDir, "README"):      "notes",
+		filepath.Join(storeSubjectsDir, "empty.json"): "",
+	}
+	for name, content := range bad {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := NewCachedSchemaRegistryClientWithRetries([]string{"http://127.0.0.1:1"}, 0)
+	if err := client.UseCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if schema, err := client.GetRawSchema(4); err != nil || schema.Schema != testSchema {
+		t.Fatalf("cached schema %v, %v", schema, err)
+	}
+	if len(client.rawSchemaCache) != 1 || len(client.schemaIdCache) != 0 {
+		t.Fatalf("loaded %d schemas and %d subjects, want the valid schema only",
+			len(client.rawSchemaCache), len(client.schemaIdCache))
+	}
+}
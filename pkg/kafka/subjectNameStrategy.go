@@ -0,0 +1,168 @@
+package kafka
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// SubjectNameStrategy names the registry subject the schema of a topic key or
+// value is registered under, record is the full name of the Avro record or the
+// title of the JSON schema, "" when the schema has none
+type SubjectNameStrategy interface {
+	Subject(topic string, isKey bool, record string) (string, error)
+}
+
+// Names of the subject name strategies in the config
+const (
+	SubjectTopicName       = "topic"
+	SubjectRecordName      = "record"
+	SubjectTopicRecordName = "topic-record"
+)
+
+var (
+	// TopicNameStrategy names the subjects <topic>-key and <topic>-value, a
+	// topic then carries a single type of records
+	TopicNameStrategy SubjectNameStrategy = topicNameStrategy{}
+	// RecordNameStrategy names the subjects after the record full name, a
+	// record type then has the same schema in every topic
+	RecordNameStrategy SubjectNameStrategy = recordNameStrategy{}
+	// TopicRecordNameStrategy names the subjects <topic>-<record full name>,
+	// a topic then carries several types of records
+	TopicRecordNameStrategy SubjectNameStrategy = topicRecordNameStrategy{}
+)
+
+// ParseSubjectNameStrategy parses a subject name strategy of the config, the
+// default is TopicNameStrategy
+func ParseSubjectNameStrategy(name string) (SubjectNameStrategy, error) {
+	switch name {
+	case "", SubjectTopicName:
+		return TopicNameStrategy, nil
+	case SubjectRecordName:
+		return RecordNameStrategy, nil
+	case SubjectTopicRecordName:
+		return TopicRecordNameStrategy, nil
+	}
+	return nil, errors.InvalidArg("unknown subject name strategy", name)
+}
+
+type topicNameStrategy struct{}
+
+func (topicNameStrategy) Subject(topic string, isKey bool, record string) (string, error) {
+	if isKey {
+		return topic + "-key", nil
+	}
+	return topic + "-value", nil
+}
+
+type recordNameStrategy struct{}
+
+func (recordNameStrategy) Subject(topic string, isKey bool, record string) (string, error) {
+	if record == "" {
+		return "", errors.InvalidType("the record name strategies need a named schema")
+	}
+	return record, nil
+}
+
+type topicRecordNameStrategy struct{}
+
+func (topicRecordNameStrategy) Subject(topic string, isKey bool, record string) (string, error) {
+	if record == "" {
+		return "", errors.InvalidType("the record name strategies need a named schema")
+	}
+	return topic + "-" + record, nil
+}
+
+// avroRecordName returns the full name of the record of the schema, "" when
+// it is not a record
+func avroRecordName(codec *goavro.Codec) (string, error) {
+	node, err := schemaOf(codec)
+	if err != nil {
+		return "", err
+	}
+	if node.kind != "record" {
+		return "", nil
+	}
+	return node.name, nil
+}
+
+// subjectNames gives the subject name strategy of each topic, by name then by
+// pattern, the other topics use the fallback strategy
+type subjectNames struct {
+	fallback SubjectNameStrategy
+
+	mu         sync.RWMutex
+	names      map[string]SubjectNameStrategy
+	patterns   []*regexp.Regexp
+	strategies []SubjectNameStrategy
+}
+
+func newSubjectNames(fallback SubjectNameStrategy, topics []TopicConfig) (*subjectNames, error) {
+	s := &subjectNames{fallback: fallback, names: make(map[string]SubjectNameStrategy)}
+	for _, t := range topics {
+		if t.SubjectStrategy == "" {
+			continue
+		}
+		strategy, err := ParseSubjectNameStrategy(t.SubjectStrategy)
+		if err != nil {
+			return nil, err
+		}
+		if t.Pattern != "" {
+			s.patterns = append(s.patterns, regexp.MustCompile(t.Pattern))
+			s.strategies = append(s.strategies, strategy)
+		} else {
+			s.names[t.Name] = strategy
+		}
+	}
+	return s, nil
+}
+
+// loadSubjectNames reads the strategies of kafka.topics, the fallback is
+// kafka.subjectStrategy
+func loadSubjectNames() (*subjectNames, error) {
+	fallback, err := ParseSubjectNameStrategy(conf.GetString("kafka.subjectStrategy"))
+	if err != nil {
+		return nil, err
+	}
+	topics, err := LoadTopicConfigs()
+	if err != nil {
+		return nil, err
+	}
+	return newSubjectNames(fallback, topics)
+}
+
+func (s *subjectNames) set(topic string, strategy SubjectNameStrategy) {
+	s.mu.Lock()
+	s.names[topic] = strategy
+	s.mu.Unlock()
+}
+
+func (s *subjectNames) strategy(topic string) SubjectNameStrategy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if strategy, ok := s.names[topic]; ok {
+		return strategy
+	}
+	for i, re := range s.patterns {
+		if re.MatchString(topic) {
+			return s.strategies[i]
+		}
+	}
+	return s.fallback
+}
+
+// subject returns the subject of the schema of the topic key or value
+func (s *subjectNames) subject(topic string, isKey bool, record string) (string, error) {
+	return s.strategy(topic).Subject(topic, isKey, record)
+}
+
+// avroSubject returns the subject of the Avro schema of the topic key or value
+func (s *subjectNames) avroSubject(topic string, isKey bool, codec *goavro.Codec) (string, error) {
+	record, err := avroRecordName(codec)
+	if err != nil {
+		return "", err
+	}
+	return s.subject(topic, isKey, record)
+}
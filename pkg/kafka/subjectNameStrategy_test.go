@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+const createdSchema = `{
+	"type": "record",
+	"name": "Created",
+	"namespace": "test.events",
+	"fields": [{"name": "id", "type": "int"}]
+}`
+
+const deletedSchema = `{
+	"type": "record",
+	"name": "Deleted",
+	"namespace": "test.events",
+	"fields": [{"name": "id", "type": "int"}, {"name": "reason", "type": "string"}]
+}`
+
+func TestSubjectNameStrategies(t *testing.T) {
+	tests := []struct {
+		strategy string
+		isKey    bool
+		record   string
+		want     string
+	}{
+		{SubjectTopicName, false, "test.events.Created", "events-value"},
+		{SubjectTopicName, true, "", "events-key"},
+		{"", false, "", "events-value"},
+		{SubjectRecordName, false, "test.events.Created", "test.events.Created"},
+		{SubjectRecordName, true, "test.events.Created", "test.events.Created"},
+		{SubjectTopicRecordName, false, "test.events.Created", "events-test.events.Created"},
+	}
+	for _, test := range tests {
+		strategy, err := ParseSubjectNameStrategy(test.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject, err := strategy.Subject("events", test.isKey, test.record)
+		if err != nil || subject != test.want {
+			t.Errorf("%q strategy subject = %q, %v, want %q", test.strategy, subject, err, test.want)
+		}
+	}
+
+	for _, strategy := range []SubjectNameStrategy{RecordNameStrategy, TopicRecordNameStrategy} {
+		if _, err := strategy.Subject("events", false, ""); !errors.IsInvalidType(err) {
+			t.Errorf("subject of an unnamed schema: %v", err)
+		}
+	}
+	if _, err := ParseSubjectNameStrategy("record-topic"); !errors.IsInvalidArg(err) {
+		t.Errorf("unknown strategy: %v", err)
+	}
+}
+
+func TestSubjectNamesByTopic(t *testing.T) {
+	subjects, err := newSubjectNames(TopicNameStrategy, []TopicConfig{
+		{Name: "events", SubjectStrategy: SubjectTopicRecordName},
+		{Pattern: "^audit\\..*", SubjectStrategy: SubjectRecordName},
+		{Name: "jobs"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{"events", "events-test.Job"},
+		{"audit.cars", "test.Job"},
+		{"jobs", "jobs-value"},
+		{"other", "other-value"},
+	}
+	for _, test := range tests {
+		if subject, err := subjects.subject(test.topic, false, "test.Job"); err != nil || subject != test.want {
+			t.Errorf("subject of %s = %q, %v, want %q", test.topic, subject, err, test.want)
+		}
+	}
+	if _, err := newSubjectNames(TopicNameStrategy, []TopicConfig{{Name: "events", SubjectStrategy: "bad"}}); !errors.IsInvalidArg(err) {
+		t.Errorf("unknown strategy of a topic: %v", err)
+	}
+}
+
+func TestTopicRecordSubjects(t *testing.T) {
+	h := newMemoryHarness(t, 1)
+	producer := h.producer()
+	producer.SetSubjectNameStrategy("events", TopicRecordNameStrategy)
+	if err := producer.Add("events", createdSchema, nil, []byte(`{"id": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Add("events", deletedSchema, nil, []byte(`{"id": 1, "reason": "sold"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewCachedSchemaRegistryClient([]string{h.registry})
+	subjects, err := client.GetSubjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(subjects)
+	if strings.Join(subjects, " ") != "events-test.events.Created events-test.events.Deleted" {
+		t.Fatalf("subjects %v, want one subject per record type", subjects)
+	}
+
+	// the consumer checks the subjects with the strategy of the topic
+	d := NewRegistryDeserializer(client)
+	messages := h.cluster.Messages("events")
+	if _, err := d.Deserialize(context.Background(), "events", false, messages[0].Value); !errors.IsBadData(err) {
+		t.Fatalf("record subject checked with the topic strategy: %v, want BadData", err)
+	}
+	d.SetSubjectNameStrategy("events", TopicRecordNameStrategy)
+	for i, want := range []string{"", "sold"} {
+		payload, err := d.Deserialize(context.Background(), "events", false, messages[i].Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var event struct {
+			ID     int    `avro:"id"`
+			Reason string `avro:"reason"`
+		}
+		if err := payload.Decode(&event); err != nil || event.ID != 1 || event.Reason != want {
+			t.Errorf("event %d = %+v, %v, want the reason %q", i, event, err, want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package kafka
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+
+	"github.com/spf13/viper"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// Key formats of the topics
+const (
+	// KeyFormatString keys are raw bytes, read as strings
+	KeyFormatString = "string"
+	// KeyFormatAvro keys are framed with the id of their Avro (or JSON)
+	// schema, registered under the key subject of the topic
+	KeyFormatAvro = "avro"
+)
+
+// TopicConfig is an entry of the kafka.topics config list. An entry is either
+// a plain topic name or a map giving the topic name (or a regex pattern of
+// topic names), the group id consuming it, the service handling it, the
+// format of its keys and the subject name strategy of its schemas.
+type TopicConfig struct {
+	Name            string `mapstructure:"name"`
+	Pattern         string `mapstructure:"pattern"`
+	Group           string `mapstructure:"group"`
+	Service         string `mapstructure:"service"`
+	Version         string `mapstructure:"version"`
+	KeyFormat       string `mapstructure:"keyFormat"`
+	SubjectStrategy string `mapstructure:"subjectStrategy"`
+}
+
+// LoadTopicConfigs reads kafka.topics, entries without group, service or
+// subject strategy get the kafka.group, kafka.service and
+// kafka.subjectStrategy defaults
+func LoadTopicConfigs() ([]TopicConfig, error) {
+	var topics []TopicConfig
+	if err := conf.UnmarshalKey("kafka.topics", &topics, viper.DecodeHook(topicNameHook)); err != nil {
+		return nil, err
+	}
+	defaultGroup := conf.GetString("kafka.group")
+	if defaultGroup == "" {
+		defaultGroup = group
+	}
+	defaultService := conf.GetString("kafka.service")
+	defaultSubjectStrategy := conf.GetString("kafka.subjectStrategy")
+	if defaultSubjectStrategy == "" {
+		defaultSubjectStrategy = SubjectTopicName
+	}
+	for i := range topics {
+		t := &topics[i]
+		if (t.Name == "") == (t.Pattern == "") {
+			return nil, errors.InvalidArg("kafka.topics entry needs exactly one of name or pattern")
+		}
+		if t.Pattern != "" {
+			if _, err := regexp.Compile(t.Pattern); err != nil {
+				return nil, errors.InvalidArg("bad topic pattern", t.Pattern, err)
+			}
+		}
+		if t.Group == "" {
+			t.Group = defaultGroup
+		}
+		if t.Service == "" {
+			t.Service = defaultService
+		}
+		if t.Service == "" {
+			return nil, errors.InvalidArg("no service for topic", t.Name+t.Pattern)
+		}
+		switch t.KeyFormat {
+		case "":
+			t.KeyFormat = KeyFormatString
+		case KeyFormatString, KeyFormatAvro:
+		default:
+			return nil, errors.InvalidArg("unknown key format", t.KeyFormat)
+		}
+		if t.SubjectStrategy == "" {
+			t.SubjectStrategy = defaultSubjectStrategy
+		}
+		if _, err := ParseSubjectNameStrategy(t.SubjectStrategy); err != nil {
+			return nil, err
+		}
+	}
+	return topics, nil
+}
+
+// topicNameHook decodes the plain string entries of kafka.topics
+func topicNameHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() == reflect.String && to == reflect.TypeOf(TopicConfig{}) {
+		return map[string]interface{}{"name": data}, nil
+	}
+	return data, nil
+}
+
+// topicSubscription is the set of topics consumed by a group, the patterns
+// are resolved against the topics known by the cluster. The retry topics of
+// every topic are consumed along with it.
+type topicSubscription struct {
+	names    []string
+	patterns []*regexp.Regexp
+	retry    *retryPolicy
+
+	configs        map[string]TopicConfig
+	patternConfigs []TopicConfig
+}
+
+func newTopicSubscription(topics []TopicConfig, retry *retryPolicy) *topicSubscription {
+	sub := &topicSubscription{retry: retry, configs: make(map[string]TopicConfig)}
+	for _, t := range topics {
+		if t.Pattern != "" {
+			sub.patterns = append(sub.patterns, regexp.MustCompile(t.Pattern))
+			sub.patternConfigs = append(sub.patternConfigs, t)
+		} else {
+			sub.names = append(sub.names, t.Name)
+			sub.configs[t.Name] = t
+		}
+	}
+	return sub
+}
+
+// topicConfig returns the config of the topic, found by name then by pattern
+func (sub *topicSubscription) topicConfig(topic string) (TopicConfig, bool) {
+	if t, ok := sub.configs[topic]; ok {
+		return t, true
+	}
+	for i, re := range sub.patterns {
+		if re.MatchString(topic) {
+			return sub.patternConfigs[i], true
+		}
+	}
+	return TopicConfig{}, false
+}
+
+func (sub *topicSubscription) hasPatterns() bool {
+	return len(sub.patterns) > 0
+}
+
+// resolve returns the sorted and de-duplicated topics of the subscription,
+// available is the list of the topics existing in the cluster
+func (sub *topicSubscription) resolve(available []string) []string {
+	set := make(map[string]bool)
+	for _, name := range sub.names {
+		set[name] = true
+	}
+	for _, topic := range available {
+		if isRetryOrDLQTopic(topic) {
+			continue
+		}
+		for _, re := range sub.patterns {
+			if re.MatchString(topic) {
+				set[topic] = true
+				break
+			}
+		}
+	}
+	topics := make([]string, 0, len(set))
+	for topic := range set {
+		topics = append(topics, topic)
+		if sub.retry != nil {
+			topics = append(topics, sub.retry.retryTopics(topic)...)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func sameTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
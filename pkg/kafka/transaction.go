@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/services"
+)
+
+const defaultTxnBatch = 100
+
+// txnConfig enables the exactly-once consume-transform-produce mode: the
+// events emitted by the jobs of a batch and the offsets of the batch are
+// committed within one transaction
+type txnConfig struct {
+	id    string
+	batch int
+}
+
+// loadTxnConfig reads kafka.transaction, it returns nil when disabled
+func loadTxnConfig() *txnConfig {
+	if !conf.GetBool("kafka.transaction.enabled") {
+		return nil
+	}
+	txn := &txnConfig{
+		id:    conf.GetString("kafka.transaction.id"),
+		batch: conf.GetInt("kafka.transaction.batch"),
+	}
+	if txn.id == "" {
+		txn.id = group
+	}
+	if txn.batch <= 0 {
+		txn.batch = defaultTxnBatch
+	}
+	return txn
+}
+
+// transactionalId is bound to the claimed partition, the producer of the
+// member claiming the partition after a rebalance fences off the previous one
+func (txn *txnConfig) transactionalId(topic string, partition int32) string {
+	return fmt.Sprintf("%s-%s-%d", txn.id, topic, partition)
+}
+
+// consumeTransactional runs the jobs of the claim in order, one transaction
+// per batch of the messages readily available
+func (handler *groupConsumerHandler) consumeTransactional(session broker.Session, claim broker.Claim) error {
+	ac := handler.consumer
+	producer, err := NewTransactionalAvroProducerFromCluster(ac.cluster, ac.schemaRegistryServers,
+		handler.txn.transactionalId(claim.Topic(), claim.Partition()))
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+	for {
+		batch, ok := handler.nextBatch(session, claim)
+		if len(batch) > 0 {
+			if err := handler.runTxnBatch(handler.jobContext(), producer, batch); err != nil {
+				log.WithError(err).Errorf("transaction failed, topic = %s, partition = %d", claim.Topic(), claim.Partition())
+				return err
+			}
+		}
+		if !ok {
+			return nil
+		}
+	}
+}
+
+// nextBatch waits for a message then adds the ones already fetched, ok is
+// false once the claim is over
+func (handler *groupConsumerHandler) nextBatch(session broker.Session, claim broker.Claim) (batch []*broker.Message, ok bool) {
+	var message *broker.Message
+	select {
+	case message, ok = <-claim.Messages():
+		if !ok {
+			return nil, false
+		}
+	case <-session.Context().Done():
+		return nil, false
+	}
+	batch = append(batch, message)
+	for len(batch) < handler.txn.batch {
+		select {
+		case message, ok = <-claim.Messages():
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, message)
+		default:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+// runTxnBatch runs the jobs of the batch, then commits their events and the
+// batch offsets atomically. The transaction is aborted when a job fails and
+// cannot be parked in the retry topics.
+func (handler *groupConsumerHandler) runTxnBatch(ctx context.Context, producer *AvroProducer, batch []*broker.Message) error {
+	if err := producer.BeginTxn(); err != nil {
+		return err
+	}
+	for _, message := range batch {
+		err := handler.runTxnJob(ctx, producer, message)
+		if err != nil && handler.retrier != nil && ctx.Err() == nil {
+			err = handler.retrier.retryWith(producer, message, err)
+		}
+		if err == nil {
+			err = producer.AddMessageToTxn(message, handler.consumer.groupId)
+		}
+		if err != nil {
+			return errors.Append(err, producer.AbortTxn())
+		}
+	}
+	if err := producer.CommitTxn(); err != nil {
+		return errors.Append(err, producer.AbortTxn())
+	}
+	return nil
+}
+
+func (handler *groupConsumerHandler) runTxnJob(ctx context.Context, producer *AvroProducer, message *broker.Message) error {
+	service, err := handler.dispatcher.Resolve(message)
+	if err != nil {
+		return err
+	}
+	events, err := handler.runJob(&job{ctx: ctx, message: message, service: service})
+	if err != nil {
+		return err
+	}
+	return publishEvents(producer, events)
+}
+
+// publishEvents encodes and sends the events emitted by a job
+func publishEvents(producer *AvroProducer, events []services.Event) error {
+	for _, event := range events {
+		if err := producer.Add(event.Topic, event.Schema, event.Key, event.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package kafka
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/services"
+)
+
+const (
+	defaultWorkers   = 1
+	defaultQueueSize = 10
+)
+
+// job is a consumed message waiting for its service to run it
+type job struct {
+	// ctx is cancelled when a rebalance revokes the session, or at the drain
+	// timeout of a shutdown
+	ctx context.Context
+	// claimed is done once the session of the claim ends, the job is skipped
+	// when it has not started by then
+	claimed context.Context
+	message *broker.Message
+	service services.Service
+	tracker *offsetTracker
+}
+
+// workerPool runs the jobs of a service on a bounded number of workers. The
+// jobs sharing a message key always go to the same worker, so that they are
+// run in order, while the jobs with different keys run in parallel. Once a job
+// failed, the queued jobs of its key and partition are skipped so that they
+// are consumed again after it.
+type workerPool struct {
+	queues []chan *job
+	run    func(*job) error
+	next   uint32
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(workers, queueSize int, run func(*job) error) *workerPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	pool := &workerPool{
+		queues: make([]chan *job, workers),
+		run:    run,
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan *job, queueSize)
+		pool.wg.Add(1)
+		go pool.work(pool.queues[i])
+	}
+	return pool
+}
+
+func (pool *workerPool) work(queue chan *job) {
+	defer pool.wg.Done()
+	for j := range queue {
+		if j.claimed.Err() != nil || j.tracker.blocked(j.message.Key) {
+			// left unmarked, the next session consumes it again
+			j.tracker.skip()
+			continue
+		}
+		err := pool.run(j)
+		if err != nil && j.ctx.Err() != nil {
+			// cancelled with its session, the next session consumes it again
+			j.tracker.skip()
+			continue
+		}
+		if err != nil {
+			// the next jobs of the key must not run before it
+			j.tracker.block(j.message.Key)
+		}
+		j.tracker.complete(j.message.Offset, err)
+	}
+}
+
+// submit queues the job, blocking while the worker in charge of its key is busy
+func (pool *workerPool) submit(ctx context.Context, j *job) error {
+	queue := pool.queues[pool.index(j.message.Key)]
+	j.tracker.add(j.message.Offset)
+	select {
+	case queue <- j:
+		return nil
+	case <-ctx.Done():
+		j.tracker.complete(j.message.Offset, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// index picks the worker of a key, messages without key are spread round-robin
+func (pool *workerPool) index(key []byte) int {
+	if len(key) == 0 {
+		return int(atomic.AddUint32(&pool.next, 1) % uint32(len(pool.queues)))
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(pool.queues)))
+}
+
+// close stops the workers once the queued jobs are done
+func (pool *workerPool) close() {
+	for _, queue := range pool.queues {
+		close(queue)
+	}
+	pool.wg.Wait()
+}
+
+// offsetTracker marks the offsets of a claimed partition as the jobs complete.
+// Jobs complete out of order, so the marked offset only moves up to the lowest
+// contiguous completed offset. A failed job stops the mark from moving past it
+// and is reported on failed. The committer, if any, is told about the marks.
+type offsetTracker struct {
+	session   broker.Session
+	committer *committer
+	topic     string
+	partition int32
+
+	mu      sync.Mutex
+	pending []int64
+	done    map[int64]bool
+	// failedKeys are the keys of the failed jobs, their next jobs are skipped
+	failedKeys map[string]bool
+	inflight   sync.WaitGroup
+	failed     chan error
+}
+
+func newOffsetTracker(session broker.Session, committer *committer, topic string, partition int32) *offsetTracker {
+	return &offsetTracker{
+		session:    session,
+		committer:  committer,
+		topic:      topic,
+		partition:  partition,
+		done:       make(map[int64]bool),
+		failedKeys: make(map[string]bool),
+		failed:     make(chan error, 1),
+	}
+}
+
+func (t *offsetTracker) add(offset int64) {
+	t.inflight.Add(1)
+	t.mu.Lock()
+	t.pending = append(t.pending, offset)
+	t.mu.Unlock()
+}
+
+func (t *offsetTracker) complete(offset int64, err error) {
+	defer t.inflight.Done()
+	if err != nil {
+		select {
+		case t.failed <- err:
+		default:
+		}
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[offset] = true
+	mark, n := int64(-1), 0
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		mark = t.pending[0]
+		delete(t.done, mark)
+		t.pending = t.pending[1:]
+		n++
+	}
+	if mark < 0 {
+		return
+	}
+	t.session.MarkOffset(t.topic, t.partition, mark+1)
+	if t.committer != nil {
+		t.committer.mark(n)
+	}
+}
+
+// block skips the next jobs of the key, the jobs without key are not ordered
+func (t *offsetTracker) block(key []byte) {
+	if len(key) == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.failedKeys[string(key)] = true
+	t.mu.Unlock()
+}
+
+// blocked tells if a job of the key failed
+func (t *offsetTracker) blocked(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failedKeys[string(key)]
+}
+
+// skip gives up a job without marking it, the mark stays below its offset
+func (t *offsetTracker) skip() {
+	t.inflight.Done()
+}
+
+// wait blocks until the jobs of the partition are complete
+func (t *offsetTracker) wait() {
+	t.inflight.Wait()
+}
@@ -0,0 +1,114 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"keyayun.com/seal-kafka-runner/pkg/broker"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+)
+
+// markingSession records the offsets marked by the tracker
+type markingSession struct {
+	broker.Session
+
+	mu     sync.Mutex
+	marked int64
+}
+
+func (s *markingSession) MarkOffset(topic string, partition int32, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = offset
+}
+
+func (s *markingSession) mark() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.marked
+}
+
+func TestWorkerPoolRunsKeysInOrder(t *testing.T) {
+	session := &markingSession{}
+	tracker := newOffsetTracker(session, nil, "jobs", 0)
+	var mu sync.Mutex
+	var runs []int64
+	pool := newWorkerPool(4, 10, func(j *job) error {
+		if j.message.Offset == 0 {
+			// the next jobs of the key wait for it
+			time.Sleep(50 * time.Millisecond)
+		}
+		mu.Lock()
+		runs = append(runs, j.message.Offset)
+		mu.Unlock()
+		return nil
+	})
+	for offset := int64(0); offset < 5; offset++ {
+		j := &job{
+			ctx:     context.Background(),
+			claimed: context.Background(),
+			message: &broker.Message{Key: []byte("a"), Offset: offset},
+			tracker: tracker,
+		}
+		if err := pool.submit(context.Background(), j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker.wait()
+	pool.close()
+
+	if len(runs) != 5 {
+		t.Fatalf("ran %v, want the 5 jobs", runs)
+	}
+	for i, offset := range runs {
+		if offset != int64(i) {
+			t.Fatalf("jobs of a key run as %v, want in order", runs)
+		}
+	}
+	if mark := session.mark(); mark != 5 {
+		t.Fatalf("marked %d, want 5", mark)
+	}
+}
+
+func TestWorkerPoolSkipsTheKeyOfAFailedJob(t *testing.T) {
+	session := &markingSession{}
+	tracker := newOffsetTracker(session, nil, "jobs", 0)
+	var mu sync.Mutex
+	ran := make(map[int64]bool)
+	pool := newWorkerPool(1, 10, func(j *job) error {
+		mu.Lock()
+		ran[j.message.Offset] = true
+		mu.Unlock()
+		if j.message.Offset == 1 {
+			return errors.InternalError("failed")
+		}
+		return nil
+	})
+	keys := []string{"a", "a", "a", "b"}
+	for offset, key := range keys {
+		j := &job{
+			ctx:     context.Background(),
+			claimed: context.Background(),
+			message: &broker.Message{Key: []byte(key), Offset: int64(offset)},
+			tracker: tracker,
+		}
+		if err := pool.submit(context.Background(), j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker.wait()
+	pool.close()
+
+	if ran[2] || !ran[3] {
+		t.Fatalf("ran %v, want the job of b but not the next job of a", ran)
+	}
+	if err := <-tracker.failed; err == nil {
+		t.Fatal("failure not reported")
+	}
+	// the mark stays below the failed job
+	if mark := session.mark(); mark != 1 {
+		t.Fatalf("marked %d, want 1", mark)
+	}
+}
@@ -0,0 +1,8 @@
+package registry
+
+import "keyayun.com/seal-kafka-runner/pkg/services"
+
+// builtin services shipped with the runner
+func init() {
+	MustRegister(services.NewCarsService())
+}
@@ -0,0 +1,190 @@
+package registry
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"keyayun.com/seal-kafka-runner/pkg/client"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/services"
+)
+
+// Registry keeps track of the registered services, several versions of a
+// service can coexist, each one keyed by its Version()
+type Registry struct {
+	mu       sync.RWMutex
+	services map[string]map[string]services.Service
+}
+
+// Default is the registry used by the package level functions
+var Default = New()
+
+func New() *Registry {
+	return &Registry{
+		services: make(map[string]map[string]services.Service),
+	}
+}
+
+// Register adds the service under its Name() and Version(), registering the
+// same name and version twice is rejected
+func (r *Registry) Register(s services.Service) error {
+	name, version := s.Name(), s.Version()
+	if name == "" || version == "" {
+		return errors.InvalidArg("service name and version are required")
+	}
+	if _, ok := s.Params()[version]; !ok {
+		return errors.InvalidArg("service", name, "has no params for version", version)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions, ok := r.services[name]
+	if !ok {
+		versions = make(map[string]services.Service)
+		r.services[name] = versions
+	}
+	if _, ok := versions[version]; ok {
+		return errors.Conflict("service", name, version)
+	}
+	versions[version] = s
+	return nil
+}
+
+// MustRegister is like Register but panics on error
+func (r *Registry) MustRegister(s services.Service) {
+	errors.Must(r.Register(s))
+}
+
+// Lookup returns the service with the given name and version,
+// the latest version is returned when version is empty
+func (r *Registry) Lookup(name, version string) (services.Service, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	versions, ok := r.services[name]
+	if !ok {
+		return nil, errors.NotFound("service", name)
+	}
+	if version == "" {
+		version = latest(versions)
+	}
+	s, ok := versions[version]
+	if !ok {
+		return nil, errors.NotFound("service", name, version)
+	}
+	return s, nil
+}
+
+// Versions returns the registered versions of a service, oldest first
+func (r *Registry) Versions(name string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return sortedVersions(r.services[name])
+}
+
+// Params returns the params of the given service version
+func (r *Registry) Params(name, version string) ([]client.Param, error) {
+	s, err := r.Lookup(name, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.Params()[s.Version()], nil
+}
+
+// List returns every registered service sorted by name then version
+func (r *Registry) List() []services.Service {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.services))
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]services.Service, 0, len(names))
+	for _, name := range names {
+		versions := r.services[name]
+		for _, version := range sortedVersions(versions) {
+			list = append(list, versions[version])
+		}
+	}
+	return list
+}
+
+func Register(s services.Service) error {
+	return Default.Register(s)
+}
+
+func MustRegister(s services.Service) {
+	Default.MustRegister(s)
+}
+
+func Lookup(name, version string) (services.Service, error) {
+	return Default.Lookup(name, version)
+}
+
+func Versions(name string) []string {
+	return Default.Versions(name)
+}
+
+func Params(name, version string) ([]client.Param, error) {
+	return Default.Params(name, version)
+}
+
+func List() []services.Service {
+	return Default.List()
+}
+
+func latest(versions map[string]services.Service) string {
+	sorted := sortedVersions(versions)
+	if len(sorted) == 0 {
+		return ""
+	}
+	return sorted[len(sorted)-1]
+}
+
+func sortedVersions(versions map[string]services.Service) []string {
+	sorted := make([]string, 0, len(versions))
+	for version := range versions {
+		sorted = append(sorted, version)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := compareVersions(sorted[i], sorted[j]); c != 0 {
+			return c < 0
+		}
+		// "v1.2" and "1.2.0" are the same version, keep a stable order
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// compareVersions compares "v1.2.3" like versions numerically, falling back
+// to a string comparison for the segments which are not numbers. The missing
+// segments are 0, "1.2" is "1.2.0".
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xerr != nil || yerr != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
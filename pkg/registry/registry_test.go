@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"testing"
+
+	"keyayun.com/seal-kafka-runner/pkg/client"
+	"keyayun.com/seal-kafka-runner/pkg/errors"
+	"keyayun.com/seal-kafka-runner/pkg/services"
+)
+
+// testService is a service of the given name and version, the methods the
+// registry does not call are left to the nil Service
+type testService struct {
+	services.Service
+	name, version string
+	params        map[string][]client.Param
+}
+
+func newTestService(name, version string) *testService {
+	return &testService{name: name, version: version,
+		params: map[string][]client.Param{version: {{Name: version}}}}
+}
+
+func (s *testService) Name() string                      { return s.name }
+func (s *testService) Version() string                   { return s.version }
+func (s *testService) Params() map[string][]client.Param { return s.params }
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1", "1.0.0", 0},
+		{"1.2", "1.2.1", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"v0.1.0", "v0.2.0", -1},
+		{"1.2.beta", "1.2.alpha", 1},
+		{"1.2.0", "1.2.rc1", -1},
+		{"1.x", "1.x", 0},
+		{"", "", 0},
+		{"", "0.1", -1},
+		{"1", "", 1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := compareVersions(test.b, test.a); got != -test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := New()
+	if err := r.Register(newTestService("cars", "v1.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(newTestService("cars", "v1.0.0")); !errors.IsConflict(err) {
+		t.Errorf("duplicate version: %v", err)
+	}
+	if err := r.Register(newTestService("", "v1.0.0")); !errors.IsInvalidArg(err) {
+		t.Errorf("empty name: %v", err)
+	}
+	if err := r.Register(newTestService("cars", "")); !errors.IsInvalidArg(err) {
+		t.Errorf("empty version: %v", err)
+	}
+	noParams := newTestService("cars", "v2.0.0")
+	noParams.params = nil
+	if err := r.Register(noParams); !errors.IsInvalidArg(err) {
+		t.Errorf("version without params: %v", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r := New()
+	for _, version := range []string{"v0.10.0", "v0.2.0", "v0.9.1"} {
+		r.MustRegister(newTestService("cars", version))
+	}
+	r.MustRegister(newTestService("boats", "v1.0.0"))
+
+	tests := []struct {
+		name, version string
+		want          string
+	}{
+		{"cars", "", "v0.10.0"},
+		{"cars", "v0.2.0", "v0.2.0"},
+		{"boats", "", "v1.0.0"},
+	}
+	for _, test := range tests {
+		s, err := r.Lookup(test.name, test.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Name() != test.name || s.Version() != test.want {
+			t.Errorf("Lookup(%q, %q) = %s %s, want %s", test.name, test.version, s.Name(), s.Version(), test.want)
+		}
+	}
+	if _, err := r.Lookup("planes", ""); !errors.IsNotFound(err) {
+		t.Errorf("unknown service: %v", err)
+	}
+	if _, err := r.Lookup("cars", "v0.3.0"); !errors.IsNotFound(err) {
+		t.Errorf("unknown version: %v", err)
+	}
+
+	params, err := r.Params("cars", "v0.9.1")
+	if err != nil || len(params) != 1 || params[0].Name != "v0.9.1" {
+		t.Errorf("Params = %v, %v", params, err)
+	}
+	if _, err := r.Params("cars", "v3"); !errors.IsNotFound(err) {
+		t.Errorf("params of an unknown version: %v", err)
+	}
+
+	if versions := r.Versions("cars"); len(versions) != 3 || versions[0] != "v0.2.0" || versions[2] != "v0.10.0" {
+		t.Errorf("Versions = %v", versions)
+	}
+	if versions := r.Versions("planes"); len(versions) != 0 {
+		t.Errorf("versions of an unknown service: %v", versions)
+	}
+	var listed []string
+	for _, s := range r.List() {
+		listed = append(listed, s.Name()+" "+s.Version())
+	}
+	want := []string{"boats v1.0.0", "cars v0.2.0", "cars v0.9.1", "cars v0.10.0"}
+	if len(listed) != len(want) {
+		t.Fatalf("List = %v, want %v", listed, want)
+	}
+	for i := range want {
+		if listed[i] != want[i] {
+			t.Fatalf("List = %v, want %v", listed, want)
+		}
+	}
+}
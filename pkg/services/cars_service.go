@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"time"
@@ -53,8 +54,12 @@ func (c *carsService) Triggers() dict {
 	return nil
 }
 
-func (c *carsService) RunJob(msg []byte) error {
+func (c *carsService) RunJob(ctx context.Context, msg []byte) error {
 	fmt.Println("carsService msg: ", string(msg))
-	time.Sleep(10 * time.Second)
-	return nil
+	select {
+	case <-time.After(10 * time.Second):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
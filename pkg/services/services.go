@@ -1,6 +1,9 @@
 package services
 
 import (
+	"context"
+	"time"
+
 	"keyayun.com/seal-kafka-runner/pkg/client"
 	"keyayun.com/seal-kafka-runner/pkg/utils"
 )
@@ -21,5 +24,60 @@ type Service interface {
 	DocTypes() client.DocDefs
 	RootDir() string
 	Triggers() dict
-	RunJob(b []byte) error
+	// RunJob runs the job of a message, ctx carries its JobInfo. ctx is
+	// cancelled when a rebalance revokes the partition of the message, or when
+	// the runner shuts down and the drain timeout expires: the job should then
+	// return promptly, its message is consumed again.
+	RunJob(ctx context.Context, b []byte) error
+}
+
+// JobInfo describes the message a job was consumed from
+type JobInfo struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	// Key is the raw key of the message, nil for the messages without key
+	Key       []byte
+	Headers   map[string]string
+	Timestamp time.Time
+	// Attempt is 1 for the first run of the message, then increases each
+	// time it is consumed again from a retry topic
+	Attempt int
+}
+
+type jobInfoKey struct{}
+
+// WithJobInfo returns a copy of ctx carrying info
+func WithJobInfo(ctx context.Context, info *JobInfo) context.Context {
+	return context.WithValue(ctx, jobInfoKey{}, info)
+}
+
+// JobInfoFromContext returns the JobInfo of the job ctx belongs to
+func JobInfoFromContext(ctx context.Context) (*JobInfo, bool) {
+	info, ok := ctx.Value(jobInfoKey{}).(*JobInfo)
+	return info, ok
+}
+
+// Event is a result record produced by a job, Value is the textual JSON form
+// of a record of the Avro Schema
+type Event struct {
+	Topic  string
+	Key    []byte
+	Schema string
+	Value  []byte
+}
+
+// Emitter is implemented by the services whose jobs produce result events
+type Emitter interface {
+	Service
+	RunJobAndEmit(ctx context.Context, b []byte) ([]Event, error)
+}
+
+// TypedService is implemented by the services whose jobs are decoded into Go
+// values rather than handed over as JSON, NewJob returns a pointer to decode
+// the job into, mapped to the Avro record through its avro tags
+type TypedService interface {
+	Service
+	NewJob() interface{}
+	RunTypedJob(ctx context.Context, job interface{}) error
 }